@@ -39,6 +39,10 @@ const int TZ_OFFSET = 2; //change this to adapt it to your time zone
 int connected = 0;
 int piezoPin = 0;
 
+// Sent to the server in the handshake, so it can tell which firmware
+// recorded what.
+const char FIRMWARE_VERSION[] = "2019.11-handshake";
+
 #include "packets.h"
 
 void setup() {
@@ -138,6 +142,8 @@ void setup() {
     }
   }
 
+  sendHandshake();
+
   tone(piezoPin, NOTE_C3, 250);
   delay(250);
   tone(piezoPin, NOTE_E3, 250);
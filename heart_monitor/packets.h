@@ -22,6 +22,7 @@
 const char TIMESTAMP = 1;
 const char HEARTDATA = 2;
 const char ERROR = 3;
+const char HANDSHAKE = 9;
 const int INITIAL = -1;
 const int ERROR_PKT = -2;
 const int BUFFER_SIZE = 16384;
@@ -144,3 +145,34 @@ void everyTwoSeconds () {
   // reset the alarm so it fires again regardless of what happens
   rtc.setAlarmSeconds((rtc.getSeconds() + 2) % 60);
 }
+
+// Tells the server who we are. This has to be the first thing sent on the
+// connection. The sample rate goes as millihertz so there's no floating
+// point to encode; it matches the delay(20) in loop().
+void sendHandshake() {
+  const unsigned long sampleRateMilliHz = 50000;
+  const char adcBits = 10;
+  int idLen = strlen(deviceID);
+  int fwLen = strlen(FIRMWARE_VERSION);
+  int l = 6 + idLen + fwLen;
+
+  newPacket();
+  pktWrite(HANDSHAKE);
+  pktWrite(l / 256);
+  pktWrite(l % 256);
+  pktWrite(sampleRateMilliHz >> 24);
+  pktWrite((sampleRateMilliHz >> 16) & 0xff);
+  pktWrite((sampleRateMilliHz >> 8) & 0xff);
+  pktWrite(sampleRateMilliHz & 0xff);
+  pktWrite(adcBits);
+  pktWrite(idLen);
+  for (int i = 0; i < idLen; i++) {
+    pktWrite(deviceID[i]);
+  }
+  for (int i = 0; i < fwLen; i++) {
+    pktWrite(FIRMWARE_VERSION[i]);
+  }
+
+  client.write(nextPacket, nextPacketIdx + 1);
+  nextPacketIdx = INITIAL;
+}
@@ -0,0 +1,266 @@
+// Package afib looks at the times of heartbeats and tries to decide
+// whether they're irregular in the way atrial fibrillation is.
+//
+// The defining feature of AF, from the point of view of someone who can
+// only see the R peaks, is that the ventricles are being driven by a
+// chaotic atrial signal and so the intervals between beats ("RR
+// intervals") are "irregularly irregular". Fast isn't the point; rate
+// controlled AF can sit at a perfectly normal rate, and a sinus
+// tachycardia is fast but regular.
+//
+// The metrics here are mostly drawn from Dash et al., "Automatic Real
+// Time Detection of Atrial Fibrillation", Annals of Biomedical
+// Engineering, 2009, which combines RMSSD, Shannon entropy and the
+// turning point ratio. I've added the normalized successive difference,
+// which is cheap and is a bit more robust to a single ectopic beat than
+// RMSSD is.
+//
+// None of this is a diagnosis. See the README.
+package afib
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// MinBeats is the fewest beats a window must have before Classify will
+// give a probability. Below this the statistics are just noise.
+const MinBeats = 16
+
+// Thresholds for the individual metrics. RMSSD's and entropy's are from
+// Dash et al. The normalized successive difference's isn't from anywhere;
+// it's an arbitrary guess, a little under RMSSD's since the mean of the
+// absolute differences is never more than their root mean square.
+const (
+	RMSSDThreshold   = 0.1
+	NSDThreshold     = 0.08
+	EntropyThreshold = 0.7
+)
+
+// entropyBins is how many bins the RR histogram uses for the Shannon
+// entropy.
+const entropyBins = 16
+
+// Metrics are the irregularity measures for a window of beats.
+type Metrics struct {
+	// Beats is the number of beats in the window.
+	Beats int
+	// MeanRR is the mean RR interval.
+	MeanRR time.Duration
+	// RMSSD is the root mean square of the successive differences
+	// between RR intervals.
+	RMSSD time.Duration
+	// NormalizedRMSSD is RMSSD divided by MeanRR, so it doesn't depend
+	// on the heart rate.
+	NormalizedRMSSD float64
+	// NormalizedSuccessiveDifference is the mean absolute successive
+	// difference divided by MeanRR.
+	NormalizedSuccessiveDifference float64
+	// ShannonEntropy is the entropy of a histogram of the RR intervals,
+	// normalized to the range 0-1.
+	ShannonEntropy float64
+	// TurningPointRatio is the fraction of RR intervals that are a
+	// local maximum or minimum. For a random sequence this is expected
+	// to be 2/3.
+	TurningPointRatio float64
+	// TurningPointZ is how many standard deviations the turning point
+	// count is from what a random sequence would produce.
+	TurningPointZ float64
+}
+
+// Result is the outcome of classifying a window.
+type Result struct {
+	Metrics
+
+	// Sufficient is false if the window didn't have enough beats to say
+	// anything about, in which case Probability is 0.
+	Sufficient bool
+
+	// Probability is a rough probability that the window is AF. It
+	// isn't calibrated against anything, so it's only a probability in
+	// that it goes from 0 to 1; treat 0.5 as "probably" and not much
+	// more.
+	Probability float64
+}
+
+// Classify looks at the given beat times, which must be in ascending
+// order, and returns how likely they are to be AF.
+func Classify(beats []time.Time) Result {
+	rrs := Intervals(beats)
+	metrics := Compute(rrs)
+	metrics.Beats = len(beats)
+
+	if len(beats) < MinBeats {
+		return Result{Metrics: metrics}
+	}
+
+	return Result{
+		Metrics:     metrics,
+		Sufficient:  true,
+		Probability: metrics.Probability(),
+	}
+}
+
+// Intervals returns the RR intervals between the given beats.
+func Intervals(beats []time.Time) []time.Duration {
+	if len(beats) < 2 {
+		return nil
+	}
+	rrs := make([]time.Duration, len(beats)-1)
+	for idx := range rrs {
+		rrs[idx] = beats[idx+1].Sub(beats[idx])
+	}
+	return rrs
+}
+
+// Compute returns the metrics for the given RR intervals. Beats is left
+// as len(rrs)+1.
+func Compute(rrs []time.Duration) Metrics {
+	m := Metrics{}
+	if len(rrs) == 0 {
+		return m
+	}
+	m.Beats = len(rrs) + 1
+
+	// The turning point ratio wants the sequence exactly as it came.
+	m.TurningPointRatio, m.TurningPointZ = turningPoints(rrs)
+
+	// Everything else is sensitive to ectopic beats, which show up as
+	// one very short interval followed by one very long one. Dash et
+	// al. drop the 8 longest and 8 shortest of 128; we do the
+	// proportional thing.
+	trimmed := trim(rrs, len(rrs)/16)
+
+	mean := float64(0)
+	for _, rr := range trimmed {
+		mean += float64(rr)
+	}
+	mean /= float64(len(trimmed))
+	m.MeanRR = time.Duration(mean)
+
+	if len(trimmed) > 1 && mean > 0 {
+		sumSq := float64(0)
+		sumAbs := float64(0)
+		for idx := 1; idx < len(trimmed); idx++ {
+			diff := float64(trimmed[idx] - trimmed[idx-1])
+			sumSq += diff * diff
+			sumAbs += math.Abs(diff)
+		}
+		n := float64(len(trimmed) - 1)
+		rmssd := math.Sqrt(sumSq / n)
+		m.RMSSD = time.Duration(rmssd)
+		m.NormalizedRMSSD = rmssd / mean
+		m.NormalizedSuccessiveDifference = sumAbs / n / mean
+	}
+
+	m.ShannonEntropy = entropy(trimmed)
+
+	return m
+}
+
+// Probability combines the metrics into a single rough probability of AF.
+//
+// Each metric is turned into a soft vote around its threshold, and the
+// votes are averaged with weights. The weights and how soft the votes
+// are aren't fitted to any data; they're arbitrary, and so is RMSSD
+// getting the most weight. Entropy gets very little on purpose, because
+// with only a minute of beats there are only a few to each of the
+// histogram's bins, and a rhythm that varies at all spreads them out
+// enough to score high.
+func (m Metrics) Probability() float64 {
+	rmssd := logistic((m.NormalizedRMSSD - RMSSDThreshold) / 0.02)
+	nsd := logistic((m.NormalizedSuccessiveDifference - NSDThreshold) / 0.02)
+	entropy := logistic((m.ShannonEntropy - EntropyThreshold) / 0.05)
+	// A sinus rhythm's intervals drift smoothly and so have too few
+	// turning points; AF's look like random noise.
+	turning := math.Exp(-m.TurningPointZ * m.TurningPointZ / 2)
+
+	return 0.5*rmssd + 0.25*nsd + 0.1*entropy + 0.15*turning
+}
+
+func logistic(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// trim drops the n largest and n smallest intervals, keeping the rest in
+// their original order since the successive differences depend on it.
+func trim(rrs []time.Duration, n int) []time.Duration {
+	if n == 0 || len(rrs) <= 2*n+1 {
+		return rrs
+	}
+	sorted := append([]time.Duration(nil), rrs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	low := sorted[n]
+	high := sorted[len(sorted)-1-n]
+
+	// Ties at the boundaries mean we may keep a few more than
+	// len-2n, which is fine.
+	trimmed := make([]time.Duration, 0, len(rrs)-2*n)
+	for _, rr := range rrs {
+		if rr >= low && rr <= high {
+			trimmed = append(trimmed, rr)
+		}
+	}
+	return trimmed
+}
+
+// entropy returns the Shannon entropy of a histogram of the intervals,
+// normalized by the maximum possible entropy for the number of bins.
+func entropy(rrs []time.Duration) float64 {
+	if len(rrs) < 2 {
+		return 0
+	}
+	low, high := rrs[0], rrs[0]
+	for _, rr := range rrs {
+		if rr < low {
+			low = rr
+		}
+		if rr > high {
+			high = rr
+		}
+	}
+	if high == low {
+		return 0
+	}
+
+	bins := make([]int, entropyBins)
+	width := float64(high-low) / entropyBins
+	for _, rr := range rrs {
+		bin := int(float64(rr-low) / width)
+		if bin >= entropyBins {
+			bin = entropyBins - 1
+		}
+		bins[bin]++
+	}
+
+	total := float64(len(rrs))
+	e := float64(0)
+	for _, count := range bins {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		e -= p * math.Log(p)
+	}
+	return e / math.Log(entropyBins)
+}
+
+// turningPoints returns the turning point ratio and how far the count is
+// from the expected count for a random sequence, in standard deviations.
+func turningPoints(rrs []time.Duration) (float64, float64) {
+	n := len(rrs)
+	if n < 3 {
+		return 0, 0
+	}
+	count := 0
+	for idx := 1; idx < n-1; idx++ {
+		prev, cur, next := rrs[idx-1], rrs[idx], rrs[idx+1]
+		if (cur > prev && cur > next) || (cur < prev && cur < next) {
+			count++
+		}
+	}
+	expected := float64(2*n-4) / 3
+	stddev := math.Sqrt(float64(16*n-29) / 90)
+	return float64(count) / float64(n-2), (float64(count) - expected) / stddev
+}
@@ -0,0 +1,132 @@
+package afib_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/thejerf/afibmon/heartmon"
+	"github.com/thejerf/afibmon/heartmon/afib"
+)
+
+// beatsFrom returns the beat times with the given intervals between them,
+// in milliseconds.
+func beatsFrom(rrs []float64) []time.Time {
+	t := time.Unix(1556595000, 0)
+	beats := []time.Time{t}
+	for _, rr := range rrs {
+		t = t.Add(time.Duration(rr * float64(time.Millisecond)))
+		beats = append(beats, t)
+	}
+	return beats
+}
+
+// sinus is n intervals of a regular rhythm at the given rate, which
+// speeds up and slows down by 4% with breathing, every 4 beats or so.
+func sinus(n int, bpm float64) []float64 {
+	rrs := make([]float64, n)
+	for i := range rrs {
+		rrs[i] = 60000 / bpm * (1 + 0.04*math.Sin(2*math.Pi*float64(i)/4.3))
+	}
+	return rrs
+}
+
+// fibrillating is n intervals with no pattern to them at all, averaging
+// the given rate.
+func fibrillating(n int, bpm float64) []float64 {
+	r := rand.New(rand.NewSource(int64(n)))
+	mean := 60000 / bpm
+	rrs := make([]float64, n)
+	for i := range rrs {
+		rrs[i] = mean * (0.6 + 0.8*r.Float64())
+	}
+	return rrs
+}
+
+func TestClassify(t *testing.T) {
+	ectopic := sinus(60, 70)
+	ectopic[30] *= 0.6
+	ectopic[31] *= 1.4
+
+	for _, test := range []struct {
+		name string
+		rrs  []float64
+		af   bool
+	}{
+		{"sinus", sinus(60, 70), false},
+		{"slow sinus", sinus(60, 50), false},
+		{"fast sinus", sinus(120, 150), false},
+		{"an ectopic beat", ectopic, false},
+		{"AF", fibrillating(60, 70), true},
+		{"rate controlled AF", fibrillating(60, 60), true},
+		{"fast AF", fibrillating(120, 140), true},
+	} {
+		result := afib.Classify(beatsFrom(test.rrs))
+		if !result.Sufficient {
+			t.Fatalf("%s: %d beats weren't enough", test.name, result.Beats)
+		}
+		if (result.Probability > heartmon.AFThreshold) != test.af {
+			t.Fatalf("%s: got a probability of %v from %+v", test.name,
+				result.Probability, result.Metrics)
+		}
+	}
+}
+
+func TestClassifyTooFewBeats(t *testing.T) {
+	for _, beats := range [][]time.Time{
+		nil,
+		beatsFrom(nil),
+		beatsFrom([]float64{800}),
+		beatsFrom(fibrillating(afib.MinBeats-2, 70)),
+	} {
+		result := afib.Classify(beats)
+		if result.Sufficient || result.Probability != 0 ||
+			result.Beats != len(beats) {
+			t.Fatalf("%d beats: got %+v", len(beats), result)
+		}
+	}
+
+	result := afib.Classify(beatsFrom(fibrillating(afib.MinBeats-1, 70)))
+	if !result.Sufficient {
+		t.Fatalf("%d beats weren't enough", afib.MinBeats)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	m := afib.Compute(nil)
+	if m != (afib.Metrics{}) {
+		t.Fatalf("got %+v from no intervals", m)
+	}
+
+	m = afib.Compute([]time.Duration{800 * time.Millisecond})
+	if m.Beats != 2 || m.MeanRR != 800*time.Millisecond || m.RMSSD != 0 ||
+		m.ShannonEntropy != 0 || m.TurningPointRatio != 0 {
+		t.Fatalf("got %+v from one interval", m)
+	}
+
+	// Perfectly regular: nothing to measure.
+	rrs := make([]time.Duration, 30)
+	for i := range rrs {
+		rrs[i] = time.Second
+	}
+	m = afib.Compute(rrs)
+	if m.MeanRR != time.Second || m.RMSSD != 0 ||
+		m.NormalizedSuccessiveDifference != 0 || m.ShannonEntropy != 0 {
+		t.Fatalf("got %+v from a metronome", m)
+	}
+
+	// Alternating, so every interval but the ends is a turning point.
+	for i := range rrs {
+		rrs[i] = time.Second + time.Duration(i%2)*100*time.Millisecond
+	}
+	m = afib.Compute(rrs)
+	if m.TurningPointRatio != 1 {
+		t.Fatalf("got a turning point ratio of %v from alternating intervals",
+			m.TurningPointRatio)
+	}
+	if math.Abs(m.NormalizedRMSSD-0.1/1.05) > 0.001 {
+		t.Fatalf("got a normalized RMSSD of %v, expected %v",
+			m.NormalizedRMSSD, 0.1/1.05)
+	}
+}
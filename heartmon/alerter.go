@@ -0,0 +1,573 @@
+package heartmon
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertKind is what an alert is about.
+type AlertKind int
+
+const (
+	// AlertAF is the heart doing something it shouldn't.
+	AlertAF = AlertKind(iota)
+	// AlertCheckElectrodes is the signal being too poor to tell.
+	AlertCheckElectrodes
+	// AlertDisconnected is the monitor not sending anything at all, so
+	// nobody's watching.
+	AlertDisconnected
+)
+
+func (ak AlertKind) String() string {
+	switch ak {
+	case AlertAF:
+		return "AF"
+	case AlertCheckElectrodes:
+		return "check electrodes"
+	case AlertDisconnected:
+		return "monitor disconnected"
+	default:
+		return fmt.Sprintf("unknown alert %d", int(ak))
+	}
+}
+
+// MarshalText marshals the kind as its name, so it's readable in JSON.
+func (ak AlertKind) MarshalText() ([]byte, error) {
+	return []byte(ak.String()), nil
+}
+
+// shortName returns the name ParseAlertKind takes, which is also fit to
+// go in a filename.
+func (ak AlertKind) shortName() string {
+	switch ak {
+	case AlertAF:
+		return "af"
+	case AlertCheckElectrodes:
+		return "electrodes"
+	case AlertDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("alert%d", int(ak))
+	}
+}
+
+// ParseAlertKind returns the kind of alert with the given name, "af",
+// "electrodes" or "disconnected".
+func ParseAlertKind(name string) (AlertKind, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "af":
+		return AlertAF, nil
+	case "electrodes", "check electrodes":
+		return AlertCheckElectrodes, nil
+	case "disconnected", "monitor disconnected":
+		return AlertDisconnected, nil
+	default:
+		return 0, fmt.Errorf("unknown alert kind %q", name)
+	}
+}
+
+// Alert is what the Notifiers are told about.
+type Alert struct {
+	Kind AlertKind
+	// Started is when the alert started.
+	Started time.Time
+	// Time is when whatever the Notifier is being told about happened.
+	Time time.Time
+	// Level starts at 0, and goes up by one each time the alert is
+	// escalated.
+	Level int
+	// Detail is a human-readable description of why the alert started.
+	Detail string
+	// Who is who the alert is about, if the Alerter was told.
+	Who string
+}
+
+// title is what the alert is called when telling people about it.
+func (alert Alert) title() string {
+	if alert.Who == "" {
+		return fmt.Sprintf("%s alert", alert.Kind)
+	}
+	return fmt.Sprintf("%s alert for %s", alert.Kind, alert.Who)
+}
+
+// DefaultEscalation is how long an alert goes unacknowledged at each level
+// before it is escalated by default: two minutes of the first sound, then
+// five of the second, then everything.
+var DefaultEscalation = []time.Duration{2 * time.Minute, 5 * time.Minute}
+
+// DefaultSnooze is how long a snooze lasts if the user doesn't say.
+const DefaultSnooze = 15 * time.Minute
+
+// MaxSnooze is the longest snooze AlertControl will take. Any longer and
+// it isn't a snooze, it's turning the monitor off.
+const MaxSnooze = 2 * time.Hour
+
+// Alerter keeps track of whether an alert is going, and tells its
+// Notifiers when one starts, escalates, or stops.
+//
+// An alert that goes on without being acknowledged is escalated to the
+// next level after the time given for its current level in Escalation.
+// What a level means is up to the Notifiers; a CommandNotifier can play a
+// louder sound, and a notifier can be configured not to start at all
+// until a given level, so it takes a while to start texting someone else.
+//
+// Acknowledging an alert silences it until it stops and something new
+// starts. Snoozing silences everything for a while; if the alert is still
+// going afterwards it starts again.
+//
+// The Notifiers are each run on a goroutine of their own, so a slow
+// webhook or mail server can't hold up the detection, and a slow one
+// can't hold up the others. Each one sees the calls in order. If one falls
+// so far behind that more than NotifierQueue calls are waiting for it,
+// they're boiled down to what it takes to bring it up to date: stopping
+// the alert it knows about, if that's stopped, and starting or escalating
+// the one going now. It misses out on whatever came and went in between,
+// but it's never left sounding an alarm that's been stopped.
+//
+// The times the Alerter is given are the times of the heart data, which
+// for a replayed file are nothing like the wall clock time. Everything
+// including snoozes runs on those.
+type Alerter struct {
+	// Notifiers are told about the alerts. NewAlerter sets it to the
+	// DefaultNotifiers. It must not be changed once an alert has
+	// started.
+	Notifiers []Notifier
+	// Escalation is how long an alert may go unacknowledged at each
+	// level before it is escalated to the next. After the last, it
+	// stays where it is. NewAlerter sets it to DefaultEscalation.
+	Escalation []time.Duration
+	// Who is who the alerts are about, when there's more than one
+	// person being monitored; empty if there isn't.
+	Who string
+	// Device and Person are the device and the person wearing it, if
+	// they're known, so AlertControl can pick out this Alerter's alerts
+	// from the rest.
+	Device string
+	Person string
+
+	logstream io.Writer
+
+	sync.Mutex
+	// the latest time we've been told about
+	now time.Time
+	// whether an alert is going, and which
+	active bool
+	alert  Alert
+	// when the alert got to its current level
+	levelSince time.Time
+	// whether the Notifiers have been told about the alert and not told
+	// it's stopped; an acknowledged or snoozed alert is still going, but
+	// nobody's being bothered with it
+	notified     bool
+	acknowledged bool
+	snoozedUntil time.Time
+
+	queues []*notifierQueue
+	wg     sync.WaitGroup
+	closed bool
+	// how many times the Notifiers have been told an alert started, so
+	// each call can say which it's about
+	starts int
+
+	// where the AlertRecords go; the RateDetector sets this up
+	journal *journal
+}
+
+func NewAlerter(out io.Writer) *Alerter {
+	return &Alerter{
+		Notifiers:  DefaultNotifiers(out),
+		Escalation: DefaultEscalation,
+		logstream:  out,
+	}
+}
+
+// NotifierQueue is how many calls can be waiting for a Notifier before
+// they're merged.
+const NotifierQueue = 16
+
+// notification is a call waiting to be made to a Notifier.
+type notification struct {
+	// AlertStarted, AlertEscalated or AlertStopped
+	action AlertAction
+	alert  Alert
+	// which start of an alert it's about; see Alerter.starts
+	start int
+}
+
+func (n notification) call(notifier Notifier) error {
+	switch n.action {
+	case AlertStarted:
+		return notifier.Start(n.alert)
+	case AlertEscalated:
+		return notifier.Escalate(n.alert)
+	default:
+		return notifier.Stop(n.alert)
+	}
+}
+
+// notifierQueue holds the calls waiting for one Notifier, and runs them.
+type notifierQueue struct {
+	notifier  Notifier
+	logstream io.Writer
+
+	sync.Mutex
+	ready   *sync.Cond
+	waiting []notification
+	closed  bool
+	// whether the Notifier has an alert going, once it's made the calls
+	// already taken off the queue, and the last of those calls
+	going bool
+	last  notification
+}
+
+func newNotifierQueue(notifier Notifier, logstream io.Writer) *notifierQueue {
+	nq := &notifierQueue{notifier: notifier, logstream: logstream}
+	nq.ready = sync.NewCond(&nq.Mutex)
+	return nq
+}
+
+// run makes the calls as they come in, until the queue is closed and
+// they've all been made.
+func (nq *notifierQueue) run() {
+	for {
+		nq.Lock()
+		for len(nq.waiting) == 0 && !nq.closed {
+			nq.ready.Wait()
+		}
+		if len(nq.waiting) == 0 {
+			nq.Unlock()
+			return
+		}
+		n := nq.waiting[0]
+		nq.waiting = nq.waiting[1:]
+		nq.going = n.action != AlertStopped
+		nq.last = n
+		nq.Unlock()
+
+		err := n.call(nq.notifier)
+		if err != nil {
+			fmt.Fprintf(nq.logstream, "Notifier %s failed: %v\n",
+				nq.notifier.Name(), err)
+		}
+	}
+}
+
+func (nq *notifierQueue) add(n notification) {
+	nq.Lock()
+	defer nq.Unlock()
+
+	if nq.closed {
+		return
+	}
+	nq.waiting = append(nq.waiting, n)
+	if len(nq.waiting) > NotifierQueue {
+		fmt.Fprintf(nq.logstream,
+			"Notifier %s is too far behind; only telling it the latest\n",
+			nq.notifier.Name())
+		nq.merge()
+	}
+	nq.ready.Signal()
+}
+
+// merge replaces the waiting calls with the fewest that leave the
+// Notifier where the last of them would have.
+func (nq *notifierQueue) merge() {
+	latest := nq.waiting[len(nq.waiting)-1]
+	var merged []notification
+	switch {
+	case latest.action == AlertStopped:
+		if nq.going {
+			merged = append(merged, nq.stopping(latest))
+		}
+	case nq.going && latest.start == nq.last.start:
+		if latest.alert.Level > nq.last.alert.Level {
+			merged = append(merged, notification{AlertEscalated,
+				latest.alert, latest.start})
+		}
+	default:
+		if nq.going {
+			merged = append(merged, nq.stopping(latest))
+		}
+		merged = append(merged, notification{AlertStarted, latest.alert,
+			latest.start})
+	}
+	nq.waiting = merged
+}
+
+// stopping returns the call stopping the alert the Notifier knows about,
+// as of the given call. It's the alert as the Notifier last heard of it,
+// so the likes of FromLevel see the level they were told about.
+func (nq *notifierQueue) stopping(at notification) notification {
+	alert := nq.last.alert
+	alert.Time = at.alert.Time
+	return notification{AlertStopped, alert, nq.last.start}
+}
+
+func (nq *notifierQueue) close() {
+	nq.Lock()
+	defer nq.Unlock()
+
+	nq.closed = true
+	nq.ready.Signal()
+}
+
+// notify queues up the call for each of the Notifiers. It never waits for
+// them; the Alerter is locked.
+func (a *Alerter) notify(action AlertAction, alert Alert) {
+	if a.closed {
+		return
+	}
+	if a.queues == nil {
+		for _, notifier := range a.Notifiers {
+			queue := newNotifierQueue(notifier, a.logstream)
+			a.queues = append(a.queues, queue)
+			a.wg.Add(1)
+			go func(queue *notifierQueue) {
+				defer a.wg.Done()
+				queue.run()
+			}(queue)
+		}
+	}
+
+	for _, queue := range a.queues {
+		queue.add(notification{action, alert, a.starts})
+	}
+}
+
+// Alert says the given kind of alert should be going as of now. If it
+// isn't, it starts; if a different kind of alert is going, that is
+// stopped first. If it is, it may be escalated. The detail is only used
+// when the alert starts.
+//
+// This should be called every time the caller looks at the data and
+// decides the alert should be going, not just the first time, because
+// that's what drives the escalation.
+func (a *Alerter) Alert(kind AlertKind, now time.Time, detail string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.now = now
+	if a.active && a.alert.Kind != kind {
+		a.stop(now)
+	}
+
+	if !a.active {
+		a.active = true
+		a.acknowledged = false
+		a.levelSince = now
+		a.alert = Alert{
+			Kind:    kind,
+			Started: now,
+			Time:    now,
+			Detail:  detail,
+			Who:     a.Who,
+		}
+		a.record(AlertStarted, now, detail)
+	}
+
+	if a.acknowledged || now.Before(a.snoozedUntil) {
+		return
+	}
+
+	if !a.notified {
+		// Either it's new, or a snooze just ran out.
+		a.notified = true
+		a.levelSince = now
+		a.alert.Time = now
+		a.starts++
+		a.notify(AlertStarted, a.alert)
+		return
+	}
+
+	level := a.alert.Level
+	if level < len(a.Escalation) &&
+		now.Sub(a.levelSince) >= a.Escalation[level] {
+		a.escalate(now)
+	}
+}
+
+// Escalate raises the level of the alert that's going right away, if any.
+func (a *Alerter) Escalate(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.active && a.notified {
+		a.escalate(now)
+	}
+}
+
+func (a *Alerter) escalate(now time.Time) {
+	a.alert.Level++
+	a.alert.Time = now
+	a.levelSince = now
+	a.record(AlertEscalated, now, "")
+	a.notify(AlertEscalated, a.alert)
+}
+
+// Stop stops the alert that's going, if any.
+func (a *Alerter) Stop(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.now = now
+	a.stop(now)
+}
+
+func (a *Alerter) stop(now time.Time) {
+	if !a.active {
+		return
+	}
+
+	a.active = false
+	a.record(AlertStopped, now, "")
+	a.silence(now)
+}
+
+func (a *Alerter) setJournal(j *journal) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.journal = j
+}
+
+// record journals something happening to the alert.
+func (a *Alerter) record(action AlertAction, now time.Time, detail string) {
+	a.journal.write(AlertRecord{
+		Time:   now,
+		Kind:   a.alert.Kind,
+		Action: action,
+		Level:  a.alert.Level,
+		Detail: detail,
+	})
+}
+
+// silence tells the Notifiers the alert has stopped, whether or not it
+// really has.
+func (a *Alerter) silence(now time.Time) {
+	if !a.notified {
+		return
+	}
+
+	a.notified = false
+	a.alert.Time = now
+	a.notify(AlertStopped, a.alert)
+}
+
+// Acknowledge silences the alert that's going, until it stops. It returns
+// false if there was no alert to acknowledge.
+func (a *Alerter) Acknowledge() bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.active || a.acknowledged {
+		return false
+	}
+
+	fmt.Fprintf(a.logstream, "%s acknowledged at %s\n",
+		a.alert.title(), a.now)
+	a.acknowledged = true
+	a.record(AlertAcknowledged, a.now, "")
+	a.silence(a.now)
+	return true
+}
+
+// Snooze silences all alerts for the given duration from the time of the
+// latest data, including any that start in the meantime. Snoozing for 0
+// cancels a snooze. It returns when the snooze ends.
+func (a *Alerter) Snooze(d time.Duration) time.Time {
+	a.Lock()
+	defer a.Unlock()
+
+	// If no data has come in yet, the wall clock is the best guess.
+	now := a.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	a.snoozedUntil = now.Add(d)
+	if d > 0 {
+		fmt.Fprintf(a.logstream, "Alerts snoozed until %s\n", a.snoozedUntil)
+		a.record(AlertSnoozed, now, fmt.Sprintf("until %s",
+			a.snoozedUntil.Format(time.RFC3339)))
+		a.silence(now)
+	} else {
+		fmt.Fprintf(a.logstream, "Snooze cancelled at %s\n", now)
+		a.record(AlertSnoozed, now, "cancelled")
+	}
+	return a.snoozedUntil
+}
+
+// AlertState describes what the Alerter is up to.
+type AlertState struct {
+	// Who is who the Alerter's alerts are about, if it was told, and
+	// Device and Person the same split up.
+	Who    string
+	Device string
+	Person string
+	// Active is whether an alert is going. The rest of the alert fields
+	// are only meaningful if it is.
+	Active       bool
+	Alert        Alert
+	Acknowledged bool
+	// Snoozed is whether alerts are snoozed, and SnoozedUntil until when.
+	Snoozed      bool
+	SnoozedUntil time.Time
+}
+
+// State returns what the Alerter is up to.
+func (a *Alerter) State() AlertState {
+	a.Lock()
+	defer a.Unlock()
+
+	return AlertState{
+		Who:          a.Who,
+		Device:       a.Device,
+		Person:       a.Person,
+		Active:       a.active,
+		Alert:        a.alert,
+		Acknowledged: a.acknowledged,
+		Snoozed:      a.now.Before(a.snoozedUntil),
+		SnoozedUntil: a.snoozedUntil,
+	}
+}
+
+// Active returns the kind of alert going, and whether one is going at all.
+func (a *Alerter) Active() (AlertKind, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.alert.Kind, a.active
+}
+
+// CloseWait is the longest Close waits for the Notifiers.
+const CloseWait = 10 * time.Second
+
+// Close waits for the Notifiers to finish with anything they've been told
+// about, for up to CloseWait; a Notifier still stuck after that is left
+// to get on with it. The Alerter must not be used afterwards.
+func (a *Alerter) Close() {
+	a.Lock()
+	if !a.closed {
+		a.closed = true
+		for _, queue := range a.queues {
+			queue.close()
+		}
+	}
+	a.Unlock()
+
+	// Not locked, so the controls don't wait on the Notifiers too.
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CloseWait):
+		fmt.Fprintln(a.logstream,
+			"Gave up waiting for the notifiers to finish")
+	}
+}
@@ -0,0 +1,481 @@
+package heartmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// To look at what happened at 3:12 in the morning, I used to have to read
+// the night's file from the start until I got there. An ArchiveReader
+// reads a .hrt file with an index next to it, in the file's name with
+// ".idx" on the end, saying where the TimestampRecords are in the file, at
+// least IndexInterval apart, so Seek can go more or less straight there.
+//
+// The index is built the first time the file is opened, and saved if it
+// can be. If the file has grown since, as the one being written tonight
+// will have, the rest of it is indexed when it's opened and when Seek is
+// called. If the file has been replaced, as by cmd/recompress, the index
+// no longer matches and is built again; the index keeps a checksum of the
+// end of what it's read, and where its last entry is, to tell.
+//
+// The index is only for finding the way; everything else still comes
+// from reading the file.
+
+// IndexInterval is how far apart in time the entries in an index are, at
+// the least.
+const IndexInterval = time.Minute
+
+// IndexSuffix is added to the name of a .hrt file to get the name of its
+// index.
+const IndexSuffix = ".idx"
+
+// indexMagic is what an index file starts with, followed by its version.
+var indexMagic = []byte("\x00HRI")
+
+const indexVersion = uint8(2)
+
+// indexCheckSize is how much of the end of what's been indexed the index
+// keeps a checksum of.
+const indexCheckSize = 4096
+
+// An IndexEntry says where a TimestampRecord is in a .hrt file, and what's
+// needed to read on from there.
+type IndexEntry struct {
+	Time time.Time
+	// Offset is where the TimestampRecord starts.
+	Offset int64
+	// Header is where the header of the file it's in starts, or -1 if
+	// it doesn't have one. It isn't always 0, if files have been run
+	// together.
+	Header int64
+	// StreamInfo is the last StreamInfoRecord before it, if there's been
+	// one.
+	StreamInfo *StreamInfoRecord
+}
+
+// An Index is where the TimestampRecords in a .hrt file are.
+type Index struct {
+	// Size is how much of the file has been indexed. It's always where
+	// a record starts, not in the middle of one.
+	Size int64
+	// Scanned is how much of the file has been read to index it. It's
+	// past Size if the file ends in a record that's cut off or corrupt,
+	// which isn't read again unless the file grows.
+	Scanned int64
+	// Entries are in the order they're in the file. A timestamp earlier
+	// than the one before it doesn't get an entry, so they're in order
+	// of time too.
+	Entries []IndexEntry
+
+	// the header and StreamInfoRecord in effect at Size, to carry on
+	// indexing from there
+	header     int64
+	streamInfo *StreamInfoRecord
+	// the CRC-32 of the indexCheckSize bytes up to Scanned
+	check uint32
+}
+
+func newIndex() *Index {
+	return &Index{header: -1}
+}
+
+// The index is encoded as indexMagic and indexVersion, then Size, the
+// header and StreamInfoRecord at Size, Scanned and the checksum up to it,
+// and each entry as its time in nanoseconds, Offset, Header and
+// StreamInfo. A StreamInfoRecord is always nine bytes; all zeros if there
+// isn't one.
+const indexEntrySize = 8 + 8 + 8 + 9
+
+const indexHeaderSize = 8 + 8 + 9 + 8 + 4
+
+func (idx *Index) MarshalBinary() ([]byte, error) {
+	b := append([]byte{}, indexMagic...)
+	b = append(b, indexVersion)
+	b = appendInt64(b, idx.Size)
+	b = appendInt64(b, idx.header)
+	b = appendStreamInfo(b, idx.streamInfo)
+	b = appendInt64(b, idx.Scanned)
+	var check [4]byte
+	binary.BigEndian.PutUint32(check[:], idx.check)
+	b = append(b, check[:]...)
+	for _, entry := range idx.Entries {
+		b = appendInt64(b, entry.Time.UnixNano())
+		b = appendInt64(b, entry.Offset)
+		b = appendInt64(b, entry.Header)
+		b = appendStreamInfo(b, entry.StreamInfo)
+	}
+	return b, nil
+}
+
+func (idx *Index) UnmarshalBinary(b []byte) error {
+	start := len(indexMagic) + 1 + indexHeaderSize
+	if len(b) < start || !bytes.Equal(b[:len(indexMagic)], indexMagic) {
+		return errors.New("not a .hrt index")
+	}
+	if b[len(indexMagic)] != indexVersion {
+		return errors.New("unknown .hrt index version")
+	}
+	if (len(b)-start)%indexEntrySize != 0 {
+		return errors.New("Illegal size .hrt index")
+	}
+
+	var err error
+	b = b[len(indexMagic)+1:]
+	idx.Size = int64(binary.BigEndian.Uint64(b))
+	idx.header = int64(binary.BigEndian.Uint64(b[8:]))
+	idx.streamInfo, err = streamInfoFrom(b[16:25])
+	if err != nil {
+		return err
+	}
+	idx.Scanned = int64(binary.BigEndian.Uint64(b[25:]))
+	idx.check = binary.BigEndian.Uint32(b[33:])
+	if idx.Size < 0 || idx.Scanned < idx.Size {
+		return errors.New("Illegal sizes in .hrt index")
+	}
+	idx.Entries = nil
+	for b = b[indexHeaderSize:]; len(b) > 0; b = b[indexEntrySize:] {
+		entry := IndexEntry{
+			Time:   time.Unix(0, int64(binary.BigEndian.Uint64(b))),
+			Offset: int64(binary.BigEndian.Uint64(b[8:])),
+			Header: int64(binary.BigEndian.Uint64(b[16:])),
+		}
+		entry.StreamInfo, err = streamInfoFrom(b[24:indexEntrySize])
+		if err != nil {
+			return err
+		}
+		idx.Entries = append(idx.Entries, entry)
+	}
+	return nil
+}
+
+func appendInt64(b []byte, i int64) []byte {
+	var eight [8]byte
+	binary.BigEndian.PutUint64(eight[:], uint64(i))
+	return append(b, eight[:]...)
+}
+
+func appendStreamInfo(b []byte, info *StreamInfoRecord) []byte {
+	if info == nil {
+		return append(b, make([]byte, 9)...)
+	}
+	infoBytes, _ := info.MarshalBinary()
+	return append(b, infoBytes...)
+}
+
+func streamInfoFrom(b []byte) (*StreamInfoRecord, error) {
+	if bytes.Equal(b, make([]byte, 9)) {
+		return nil, nil
+	}
+	info := &StreamInfoRecord{}
+	err := info.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// An ArchiveReader reads a .hrt file, and can Seek to a time in it. It's a
+// RecordSource, so a SampleReader can read from it. Corruption in the
+// file is skipped, as with a RecordReader with Recover set.
+type ArchiveReader struct {
+	filename string
+	f        *os.File
+	index    *Index
+
+	rr *RecordReader
+	// the StreamInfoRecord to return first after a Seek
+	streamInfo *StreamInfoRecord
+}
+
+// OpenArchive opens the given .hrt file, reading its index, or building
+// it if it has to. It starts at the start of the file.
+func OpenArchive(filename string) (*ArchiveReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	ar := &ArchiveReader{filename: filename, f: f}
+	ar.loadIndex()
+	err = ar.updateIndex()
+	if err == nil {
+		err = ar.seekTo(IndexEntry{Header: -1})
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ar, nil
+}
+
+// Close closes the file.
+func (ar *ArchiveReader) Close() error {
+	return ar.f.Close()
+}
+
+// Index returns the index of the file, as far as it's got.
+func (ar *ArchiveReader) Index() *Index {
+	return ar.index
+}
+
+// Header returns the header of the file being read, or nil if it doesn't
+// have one.
+func (ar *ArchiveReader) Header() (*FileHeader, error) {
+	return ar.rr.Header()
+}
+
+// NextRecord returns the next record.
+func (ar *ArchiveReader) NextRecord() (Record, error) {
+	if ar.streamInfo != nil {
+		info := *ar.streamInfo
+		ar.streamInfo = nil
+		return info, nil
+	}
+	return ar.rr.NextRecord()
+}
+
+// Seek goes to the last TimestampRecord at or before the given time, so
+// the heart data after it covers that time. A StreamInfoRecord from before
+// it is returned first, if there was one, so the heart data is read
+// right. If the time is before the first timestamp, it goes to the start
+// of the file.
+func (ar *ArchiveReader) Seek(t time.Time) error {
+	err := ar.updateIndex()
+	if err != nil {
+		return err
+	}
+	entries := ar.index.Entries
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Time.After(t)
+	})
+	if i == 0 {
+		return ar.seekTo(IndexEntry{Header: -1})
+	}
+
+	// The entry is up to IndexInterval before the time; read on from it
+	// for the last timestamp that isn't after it.
+	best := entries[i-1]
+	rr, err := ar.readerAt(best.Header, best.Offset)
+	if err != nil {
+		return err
+	}
+	rr.Recover = true
+	streamInfo := best.StreamInfo
+	for {
+		record, err := rr.NextRecord()
+		if err != nil {
+			break
+		}
+		if info, isInfo := record.(StreamInfoRecord); isInfo {
+			streamInfo = &info
+		}
+		if ts, isTimestamp := record.(TimestampRecord); isTimestamp {
+			if ts.Time.After(t) {
+				break
+			}
+			best = IndexEntry{ts.Time, rr.recordAt, headerAt(rr),
+				streamInfo}
+		}
+	}
+	return ar.seekTo(best)
+}
+
+// seekTo goes to the given entry.
+func (ar *ArchiveReader) seekTo(entry IndexEntry) error {
+	rr, err := ar.readerAt(entry.Header, entry.Offset)
+	if err != nil {
+		return err
+	}
+	rr.Recover = true
+	ar.rr = rr
+	ar.streamInfo = entry.StreamInfo
+	return nil
+}
+
+// readerAt returns a RecordReader reading the file from offset, which is
+// after the header at header, or in a file with no header if it's -1.
+func (ar *ArchiveReader) readerAt(header, offset int64) (*RecordReader, error) {
+	rr := NewRecordReader(ar.section(offset))
+	if offset == 0 {
+		return rr, nil
+	}
+	rr.started = true
+	rr.offset = offset
+	if header >= 0 {
+		// A damaged header is read as it was when it was indexed.
+		hr := NewRecordReader(ar.section(header))
+		hr.Recover = true
+		fh, err := hr.Header()
+		if err != nil {
+			return nil, err
+		}
+		if fh == nil {
+			return nil, errors.New("index doesn't match the file")
+		}
+		rr.header = fh
+		rr.headerAt = header
+		rr.checksums = fh.Version >= 2
+	}
+	return rr, nil
+}
+
+// section returns a reader reading the file from offset, without moving
+// anything else reading it.
+func (ar *ArchiveReader) section(offset int64) io.Reader {
+	return io.NewSectionReader(ar.f, offset, math.MaxInt64-offset)
+}
+
+// headerAt returns where the header rr is reading after starts, or -1 if
+// there isn't one.
+func headerAt(rr *RecordReader) int64 {
+	if rr.header == nil {
+		return -1
+	}
+	return rr.headerAt
+}
+
+// loadIndex reads the index for the file. If there isn't one, or it
+// doesn't match the file, it starts a new one.
+func (ar *ArchiveReader) loadIndex() {
+	ar.index = newIndex()
+	b, err := ioutil.ReadFile(ar.filename + IndexSuffix)
+	if err != nil {
+		return
+	}
+	idx := newIndex()
+	if idx.UnmarshalBinary(b) != nil || !ar.matches(idx) {
+		return
+	}
+	ar.index = idx
+}
+
+// matches returns whether the index is of the file as it is, by checking
+// the end of what was indexed is the same, and the last entry is where it
+// says it is.
+func (ar *ArchiveReader) matches(idx *Index) bool {
+	info, err := ar.f.Stat()
+	if err != nil || info.Size() < idx.Scanned {
+		return false
+	}
+	check, err := ar.checksum(idx.Scanned)
+	if err != nil || check != idx.check {
+		return false
+	}
+	if len(idx.Entries) == 0 {
+		return true
+	}
+	last := idx.Entries[len(idx.Entries)-1]
+	rr, err := ar.readerAt(last.Header, last.Offset)
+	if err != nil {
+		return false
+	}
+	record, err := rr.NextRecord()
+	if err != nil {
+		return false
+	}
+	ts, isTimestamp := record.(TimestampRecord)
+	return isTimestamp && ts.Time.Equal(last.Time) && rr.recordAt == last.Offset
+}
+
+// updateIndex indexes whatever has been added to the file since it was
+// last indexed, and saves the index if it changed. If it can't be saved,
+// as when the file is in a directory that can't be written to, it's just
+// built again next time.
+func (ar *ArchiveReader) updateIndex() error {
+	info, err := ar.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < ar.index.Scanned {
+		// It's been cut short since.
+		ar.index = newIndex()
+	}
+	idx := ar.index
+	if info.Size() == idx.Scanned {
+		return nil
+	}
+
+	rr, err := ar.readerAt(idx.header, idx.Size)
+	if err != nil {
+		return err
+	}
+	// Corruption is skipped, so one bad byte doesn't leave the rest of
+	// the night unindexed.
+	rr.Recover = true
+	for {
+		skipped := rr.Skipped()
+		record, err := rr.NextRecord()
+		if err != nil {
+			break
+		}
+		if rr.Skipped() != skipped {
+			// It's only corruption if there's a record after it.
+			// At the end of the file it's more likely the half a
+			// record of a file that's still being written, so the
+			// index isn't taken past it.
+			continue
+		}
+		switch r := record.(type) {
+		case StreamInfoRecord:
+			idx.streamInfo = &r
+		case TimestampRecord:
+			n := len(idx.Entries)
+			if n == 0 || !r.Time.Before(idx.Entries[n-1].Time.Add(IndexInterval)) {
+				idx.Entries = append(idx.Entries, IndexEntry{r.Time,
+					rr.recordAt, headerAt(rr), idx.streamInfo})
+			}
+		}
+		idx.Size = rr.Offset()
+		idx.header = headerAt(rr)
+	}
+
+	// Anything written while that was being read is left for next
+	// time, since it may not all have been read, unless it was whole
+	// records that made it into the index.
+	idx.Scanned = info.Size()
+	if idx.Size > idx.Scanned {
+		idx.Scanned = idx.Size
+	}
+	idx.check, err = ar.checksum(idx.Scanned)
+	if err != nil {
+		return err
+	}
+	ar.saveIndex()
+	return nil
+}
+
+// checksum returns the CRC-32 of the indexCheckSize bytes of the file up to
+// end, or as many as there are.
+func (ar *ArchiveReader) checksum(end int64) (uint32, error) {
+	start := end - indexCheckSize
+	if start < 0 {
+		start = 0
+	}
+	b := make([]byte, end-start)
+	_, err := ar.f.ReadAt(b, start)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(b), nil
+}
+
+// saveIndex writes the index next to the file.
+func (ar *ArchiveReader) saveIndex() {
+	b, _ := ar.index.MarshalBinary()
+	filename := ar.filename + IndexSuffix
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+}
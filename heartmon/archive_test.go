@@ -0,0 +1,258 @@
+package heartmon
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var archiveStart = time.Unix(1556595000, 0)
+
+// nightRecords returns a StreamInfoRecord, then a timestamp and some heart
+// data every 10 seconds for the given number of minutes, from the given
+// minute.
+func nightRecords(from, minutes int) []Record {
+	records := []Record{StreamInfoRecord{SampleRate: 50, ADCBits: 10}}
+	for i := from * 6; i < (from+minutes)*6; i++ {
+		records = append(records,
+			TimestampRecord{archiveStart.Add(time.Duration(i) * 10 * time.Second)},
+			data(uint16(i), uint16(i)+1))
+	}
+	return records
+}
+
+// archiveFile writes the bytes to a file in a new directory, and returns
+// its name. The directory is for the caller to remove.
+func archiveFile(t *testing.T, b []byte) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "night.hrt")
+	err = ioutil.WriteFile(filename, b, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// indexOf opens the file, indexing it, and returns the index.
+func indexOf(t *testing.T, filename string) *Index {
+	t.Helper()
+
+	ar, err := OpenArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.Close()
+	return ar.Index()
+}
+
+// savedIndex returns the index saved next to the file, as loadIndex reads
+// it.
+func savedIndex(t *testing.T, filename string) *Index {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ar := &ArchiveReader{filename: filename, f: f}
+	ar.loadIndex()
+	return ar.index
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	filename := archiveFile(t, writeFile(t, 3, nightRecords(0, 5)))
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := indexOf(t, filename)
+	if len(idx.Entries) != 5 || idx.Size == 0 || idx.Scanned != idx.Size {
+		t.Fatalf("got the index %+v", idx)
+	}
+
+	b, err := idx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := newIndex()
+	err = got.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, idx) {
+		t.Fatalf("got %+v back from %+v", got, idx)
+	}
+	if !reflect.DeepEqual(savedIndex(t, filename), idx) {
+		t.Fatal("the saved index isn't the same")
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		[]byte("\x00HRT\x03"),
+		b[:len(b)-1],
+		append(append([]byte{}, b[:len(indexMagic)]...), 1),
+	} {
+		if newIndex().UnmarshalBinary(bad) == nil {
+			t.Fatalf("took %x as an index", bad)
+		}
+	}
+}
+
+func TestArchiveSeek(t *testing.T) {
+	records := nightRecords(0, 5)
+	filename := archiveFile(t, writeFile(t, 3, records))
+	defer os.RemoveAll(filepath.Dir(filename))
+	ar, err := OpenArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	for _, test := range []struct {
+		name string
+		t    time.Time
+		// the index into records of what's read after the seek, if
+		// it's a TimestampRecord; it's preceded by the StreamInfo
+		at int
+	}{
+		{"before", archiveStart.Add(-time.Hour), 0},
+		{"at the start", archiveStart, 1},
+		{"inside", archiveStart.Add(2*time.Minute + 35*time.Second), 31},
+		{"on a timestamp", archiveStart.Add(2 * time.Minute), 25},
+		{"just before an entry", archiveStart.Add(time.Minute - time.Nanosecond), 11},
+		{"after", archiveStart.Add(time.Hour), len(records) - 2},
+	} {
+		err := ar.Seek(test.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Record
+		for len(got) < 3 {
+			r, err := ar.NextRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, r)
+		}
+
+		var expected []Record
+		if test.at == 0 {
+			expected = records[:3]
+		} else {
+			expected = append([]Record{records[0]},
+				records[test.at:test.at+2]...)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%s: got %v, expected %v", test.name, got, expected)
+		}
+	}
+}
+
+func TestArchiveAppended(t *testing.T) {
+	first := writeFile(t, 3, nightRecords(0, 3))
+	filename := archiveFile(t, first)
+	defer os.RemoveAll(filepath.Dir(filename))
+	indexOf(t, filename)
+
+	// The monitor is restarted, and carries on in the same file.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(writeFile(t, 3, nightRecords(3, 3)))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := indexOf(t, filename)
+	os.Remove(filename + IndexSuffix)
+	fresh := indexOf(t, filename)
+	if !reflect.DeepEqual(idx, fresh) || len(idx.Entries) != 6 {
+		t.Fatalf("got %+v, not %+v", idx, fresh)
+	}
+	if idx.Entries[3].Header != int64(len(first)) {
+		t.Fatalf("the entries after the append don't have its header: %+v",
+			idx.Entries[3])
+	}
+
+	// Seeking into what was appended reads the second file right.
+	ar, err := OpenArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	err = ar.Seek(archiveStart.Add(4 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar.NextRecord()
+	r, err := ar.NextRecord()
+	if err != nil || !reflect.DeepEqual(r,
+		TimestampRecord{archiveStart.Add(4 * time.Minute)}) {
+		t.Fatalf("got %v, %v", r, err)
+	}
+}
+
+func TestArchiveReplaced(t *testing.T) {
+	filename := archiveFile(t, writeFile(t, 2, nightRecords(0, 3)))
+	defer os.RemoveAll(filepath.Dir(filename))
+	indexOf(t, filename)
+
+	// As cmd/recompress would, with the same records.
+	err := ioutil.WriteFile(filename, writeFile(t, 3, nightRecords(0, 3)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx := savedIndex(t, filename); idx.Scanned != 0 {
+		t.Fatalf("the index for the old file was kept: %+v", idx)
+	}
+	idx := indexOf(t, filename)
+	info, _ := os.Stat(filename)
+	if idx.Size != info.Size() || len(idx.Entries) != 3 {
+		t.Fatalf("got %+v", idx)
+	}
+}
+
+func TestIndexWithoutEntries(t *testing.T) {
+	// Only a header and a StreamInfoRecord so far.
+	filename := archiveFile(t, writeFile(t, 3, nightRecords(0, 0)))
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := indexOf(t, filename)
+	if idx.Size == 0 || len(idx.Entries) != 0 {
+		t.Fatalf("got %+v", idx)
+	}
+	if !reflect.DeepEqual(savedIndex(t, filename), idx) {
+		t.Fatal("an index without entries wasn't kept")
+	}
+}
+
+func TestIndexCorruptTail(t *testing.T) {
+	b := writeFile(t, 3, nightRecords(0, 2))
+	last := len(b)
+	// the start of a record that never got finished
+	b = append(b, writeFile(t, 0, []Record{data(1, 2, 3)})[:4]...)
+	filename := archiveFile(t, b)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	idx := indexOf(t, filename)
+	if idx.Size != int64(last) || idx.Scanned != int64(len(b)) {
+		t.Fatalf("indexed %d and scanned %d of %d bytes, expected %d",
+			idx.Size, idx.Scanned, len(b), last)
+	}
+	// Next time, it isn't read again.
+	if !reflect.DeepEqual(savedIndex(t, filename), idx) {
+		t.Fatal("the index of a file with a corrupt tail wasn't kept")
+	}
+}
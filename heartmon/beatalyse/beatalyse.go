@@ -29,13 +29,10 @@ import (
 	"gonum.org/v1/gonum/fourier"
 )
 
-// SampleRate is how many times per second we get a sample from the EKG
-// device.
-const SampleRate = float64(30.0)
-
 type BeatAnalyzer struct {
-	size int
-	fft  *fourier.FFT
+	size       int
+	sampleRate float64
+	fft        *fourier.FFT
 }
 
 type FFT struct {
@@ -105,12 +102,13 @@ func (b Buckets) Normalized() []float64 {
 	return ret
 }
 
-// New returns a new heartbeat analyzer. It should probably be called only
-// with powers of two, though the fourier function doesn't say anything
-// about that.
-func New(i int) *BeatAnalyzer {
+// New returns a new heartbeat analyzer for EKG data sampled sampleRate
+// times per second. It should probably be called only with powers of two,
+// though the fourier function doesn't say anything about that.
+func New(i int, sampleRate float64) *BeatAnalyzer {
 	return &BeatAnalyzer{
 		i,
+		sampleRate,
 		fourier.NewFFT(i),
 	}
 }
@@ -139,8 +137,8 @@ func (ba *BeatAnalyzer) FFT(ekg []uint16) FFT {
 		} else {
 			reals[idx] = real(coeff)
 		}
-		frequencies[idx] = ba.fft.Freq(idx) * SampleRate
+		frequencies[idx] = ba.fft.Freq(idx) * ba.sampleRate
 	}
 
-	return FFT{SampleRate, reals, frequencies}
+	return FFT{ba.sampleRate, reals, frequencies}
 }
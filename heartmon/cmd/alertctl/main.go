@@ -0,0 +1,57 @@
+package main
+
+// alertctl sends a command to a running heartserver or monitor over its
+// control socket, so an alert can be dealt with from a terminal:
+//
+//	alertctl ack
+//	alertctl snooze 30m
+//	alertctl unsnooze
+//	alertctl status
+//
+// ack, snooze and unsnooze act on everybody's alerts, unless they're given
+// a device or a person, as in "alertctl snooze 30m chest-1" or "alertctl
+// ack Jeremy".
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/thejerf/afibmon/heartmon"
+)
+
+var socket = flag.String("control", heartmon.DefaultControlSocket,
+	"the control socket of the heartserver or monitor")
+
+func main() {
+	flag.Parse()
+	command := strings.Join(flag.Args(), " ")
+	if command == "" {
+		command = "status"
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Printf("Can't connect to %s: %v\n", *socket, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, command)
+	if err != nil {
+		fmt.Printf("Can't send the command: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The response ends with a blank line.
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		if lines.Text() == "" {
+			return
+		}
+		fmt.Println(lines.Text())
+	}
+}
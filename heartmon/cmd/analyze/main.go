@@ -10,30 +10,48 @@ import (
 
 	"github.com/thejerf/afibmon/heartmon"
 	"github.com/thejerf/afibmon/heartmon/beatalyse"
+	"github.com/thejerf/afibmon/heartmon/qrs"
 )
 
 var chunkSize = flag.Int("chunksize", 512, "size of chunks to process")
 var analysis = flag.String("analysis",
 	"freq_and_amp", "analysis to perform")
+var from = flag.String("from", "",
+	"time to start at, such as 2019-04-30T03:12:00-04:00, rather than the start of the file")
+var length = flag.Duration("for", 0,
+	"how much of the file to analyze, if not all of it")
 
 func main() {
 	flag.Parse()
 	filename := flag.Arg(0)
 
-	f, err := os.Open(filename)
+	archive, err := heartmon.OpenArchive(filename)
 	if err != nil {
 		fmt.Printf("Can't open file %s: %v\n", filename, err)
 		os.Exit(1)
 	}
-
-	records := heartmon.NewRecordReader(f)
+	var start time.Time
+	if *from != "" {
+		start, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			fmt.Printf("Can't understand -from: %v\n", err)
+			os.Exit(1)
+		}
+		err = archive.Seek(start)
+		if err != nil {
+			fmt.Printf("Can't seek in %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+	}
+	samples := heartmon.NewSampleReader(archive)
 
 	data := []uint16{}
+	// the time of data[0]
+	var dataStart time.Time
 
 	frame := 0
-	var startishTime *time.Time
 	for {
-		record, err := records.NextRecord()
+		block, err := samples.NextBlock()
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -42,50 +60,62 @@ func main() {
 			os.Exit(1)
 		}
 
-		switch r := record.(type) {
-		case heartmon.TimestampRecord:
-			if startishTime == nil {
-				startishTime = &r.Time
-			}
-		case heartmon.HeartDataRecord:
-			data = append(data, r.Data...)
+		if start.IsZero() {
+			start = block.Start
 		}
-
-		if len(data) < *chunkSize {
-			continue
+		if *length > 0 && block.Start.After(start.Add(*length)) {
+			return
 		}
 
-		// Have enough data now
-		chunk := data[:*chunkSize]
-		data = data[*chunkSize:]
-
-		switch *analysis {
-		case "freq_and_amp":
-			err = plotFreqAndAmp(frame, chunk, *startishTime)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't render frame: %v",
-					err)
-				os.Exit(1)
+		// Don't let a chunk span a gap, or the FFT sees a spliced
+		// waveform and sprays high frequencies everywhere.
+		if block.Reset {
+			if block.Gap > 0 && len(data) > 0 {
+				fmt.Printf("Discarding %d samples before a %s gap\n",
+					len(data), block.Gap)
 			}
-
-		case "amp_buckets":
-			err = plotAmpBuckets(frame, chunk, *startishTime)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't render frame: %v",
-					err)
+			data = data[:0]
+		}
+		if len(data) == 0 {
+			dataStart = block.Start
+		}
+		data = append(data, block.Data...)
+
+		for len(data) >= *chunkSize {
+			chunk := data[:*chunkSize]
+			data = data[*chunkSize:]
+
+			switch *analysis {
+			case "freq_and_amp":
+				err = plotFreqAndAmp(frame, chunk, dataStart,
+					block.StreamInfo.SampleRate)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't render frame: %v",
+						err)
+					os.Exit(1)
+				}
+
+			case "amp_buckets":
+				err = plotAmpBuckets(frame, chunk, dataStart,
+					block.StreamInfo.SampleRate)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't render frame: %v",
+						err)
+					os.Exit(1)
+				}
+
+			default:
+				fmt.Fprintf(os.Stderr, "Unknown analysis %q\n",
+					*analysis)
 				os.Exit(1)
 			}
 
-		default:
-			fmt.Fprint(os.Stderr, "Unknown analysis %q\n",
-				*analysis)
-			os.Exit(1)
-		}
-
-		startishTime = nil
-		frame++
-		if frame%25 == 0 {
-			fmt.Println("Frame", frame)
+			dataStart = dataStart.Add(
+				time.Duration(*chunkSize) * block.Interval)
+			frame++
+			if frame%25 == 0 {
+				fmt.Println("Frame", frame)
+			}
 		}
 	}
 }
@@ -94,10 +124,11 @@ func plotAmpBuckets(
 	frame int,
 	chunk []uint16,
 	startishTime time.Time,
+	sampleRate float64,
 ) error {
 	var err error
 
-	analyzer := beatalyse.New(*chunkSize)
+	analyzer := beatalyse.New(*chunkSize, sampleRate)
 
 	f, err := os.Create("plotdata_amp.tmp")
 	if err != nil {
@@ -165,10 +196,11 @@ func plotFreqAndAmp(
 	frame int,
 	chunk []uint16,
 	startishTime time.Time,
+	sampleRate float64,
 ) error {
 	var err error
 
-	analyzer := beatalyse.New(*chunkSize)
+	analyzer := beatalyse.New(*chunkSize, sampleRate)
 
 	f, err := os.Create("plotdata.tmp")
 	if err != nil {
@@ -211,23 +243,36 @@ plot 'plotdata.tmp' with lines
 	}
 	f.Close()
 
+	// Mark where the detector thinks the R peaks are, so we can eyeball
+	// whether it's getting them right.
+	detector := qrs.New(sampleRate)
+	peaks := detector.Peaks(chunk)
+	f, err = os.Create("beats.tmp")
+	if err != nil {
+		return fmt.Errorf("Can't open beats.tmp: %v\n", err)
+	}
+	for _, peak := range peaks {
+		fmt.Fprintf(f, "%v 250\n", peak)
+	}
+	f.Close()
+
 	cmd = exec.Command("gnuplot",
 		"-e",
 		fmt.Sprintf(`
 set yr [-300:300]; set terminal png size 3000,1500;
 set output "amp_frames/frame%05d.png";
-set title "BPM %d - amp - frame %05d - %s";
-plot 'ampplotdata.tmp' with lines
+set title "BPM %.0f - amp - frame %05d - %s";
+plot 'ampplotdata.tmp' with lines, 'beats.tmp' with impulses
 `,
 			frame,
-			heartmon.DetectHeartbeats(chunk),
+			detector.BPM(peaks),
 			frame,
 			startishTime.Format(time.RFC1123),
 		),
 	)
 	err = cmd.Run()
 	if err != nil {
-		fmt.Errorf("Couldn't call gnuplot: %v\n",
+		return fmt.Errorf("Couldn't call gnuplot: %v\n",
 			err)
 	}
 	return nil
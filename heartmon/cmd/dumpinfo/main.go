@@ -18,6 +18,7 @@ func main() {
 	}
 
 	records := heartmon.NewRecordReader(f)
+	records.Recover = true
 
 	data := []uint16{}
 
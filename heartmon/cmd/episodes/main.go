@@ -0,0 +1,167 @@
+package main
+
+// episodes lists the episodes journaled in .hrt files, night by night, so
+// in the morning I can see what happened without reading the whole log.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/thejerf/afibmon/heartmon"
+)
+
+var alerts = flag.Bool("alerts", false,
+	"list what the alerts did too, under each night")
+
+// A night runs from noon to noon, so an episode at 2am goes under the
+// evening before, which is when I went to bed.
+const nightStartsAt = 12 * time.Hour
+
+// episode is an episode read back out of the journal. If it hasn't ended,
+// because the file was cut off in the middle of it, end is nil.
+type episode struct {
+	start heartmon.EpisodeStartRecord
+	end   *heartmon.EpisodeEndRecord
+}
+
+type night struct {
+	date     string
+	episodes []*episode
+	alerts   []heartmon.AlertRecord
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: episodes [-alerts] file.hrt ...")
+		os.Exit(1)
+	}
+
+	nights := map[string]*night{}
+	nightOf := func(t time.Time) *night {
+		date := t.Add(-nightStartsAt).Format("2006-01-02")
+		n := nights[date]
+		if n == nil {
+			n = &night{date: date}
+			nights[date] = n
+		}
+		return n
+	}
+
+	for _, filename := range flag.Args() {
+		err := readJournal(filename, nightOf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while reading %s: %v\n",
+				filename, err)
+			os.Exit(1)
+		}
+	}
+
+	dates := []string{}
+	for date := range nights {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	for _, date := range dates {
+		n := nights[date]
+		sort.Slice(n.episodes, func(i, j int) bool {
+			return n.episodes[i].start.Start.Before(n.episodes[j].start.Start)
+		})
+
+		fmt.Printf("Night of %s: %d episodes\n", date, len(n.episodes))
+		for _, e := range n.episodes {
+			printEpisode(e)
+		}
+		if *alerts {
+			sort.Slice(n.alerts, func(i, j int) bool {
+				return n.alerts[i].Time.Before(n.alerts[j].Time)
+			})
+			for _, a := range n.alerts {
+				line := fmt.Sprintf("    %s %s alert %s, level %d",
+					a.Time.Format("15:04:05"), a.Kind, a.Action, a.Level)
+				if a.Detail != "" {
+					line += ": " + a.Detail
+				}
+				fmt.Println(line)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// readJournal reads the journal records out of the given file, and files
+// them under the right night.
+func readJournal(filename string, nightOf func(time.Time) *night) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the episodes started and not yet ended, by kind
+	open := map[heartmon.AlertKind]*episode{}
+
+	records := heartmon.NewRecordReader(f)
+	records.Recover = true
+	for {
+		record, err := records.NextRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch r := record.(type) {
+		case heartmon.EpisodeStartRecord:
+			e := &episode{start: r}
+			open[r.Kind] = e
+			n := nightOf(r.Start)
+			n.episodes = append(n.episodes, e)
+
+		case heartmon.EpisodeEndRecord:
+			e := open[r.Kind]
+			delete(open, r.Kind)
+			if e == nil || !e.start.Start.Equal(r.Start) {
+				// The start was in another file, or went missing;
+				// the end has everything needed anyhow.
+				e = &episode{start: heartmon.EpisodeStartRecord{
+					Start:    r.Start,
+					Kind:     r.Kind,
+					Detector: r.Detector,
+				}}
+				n := nightOf(r.Start)
+				n.episodes = append(n.episodes, e)
+			}
+			end := r
+			e.end = &end
+
+		case heartmon.AlertRecord:
+			n := nightOf(r.Time)
+			n.alerts = append(n.alerts, r)
+		}
+	}
+}
+
+func printEpisode(e *episode) {
+	start := e.start.Start.Format("15:04:05")
+	if e.end == nil {
+		fmt.Printf("  %s - (unfinished) %s, detected by %s: %s\n",
+			start, e.start.Kind, e.start.Detector, e.start.Detail)
+		return
+	}
+
+	peak := "no signal"
+	if e.end.PeakBPM > 0 {
+		peak = fmt.Sprintf("peak %.0f bpm", e.end.PeakBPM)
+	}
+	fmt.Printf("  %s - %s (%s) %s, %s, detected by %s\n",
+		start, e.end.End.Format("15:04:05"),
+		e.end.Duration().Round(time.Second), e.start.Kind, peak,
+		e.start.Detector)
+}
@@ -3,15 +3,45 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/thejerf/afibmon/heartmon"
 	"github.com/thejerf/suture"
 )
 
 var address = flag.String("address", ":18498", "the address to bind the server to")
+var httpAddress = flag.String("http", "127.0.0.1:18499",
+	"the address to serve the live events and alert controls on; empty to not serve them")
+var token = flag.String("token", "",
+	"the token the alert controls, live events and connections over HTTP take; if it's empty and -http isn't only this machine, one is made up")
+var controlSocket = flag.String("control", heartmon.DefaultControlSocket,
+	"the Unix socket to take alert controls on; empty to not")
+var notifierConfig = flag.String("notifiers", "",
+	"a JSON file configuring who to notify of alerts; the default logs and plays a sound")
+var snapshotDir = flag.String("snapshots", heartmon.DefaultSnapshotDir,
+	"the directory to write snapshots of the ECG around each alert to; empty to not")
+var silence = flag.Duration("silence", heartmon.DefaultWatchdogSilence,
+	"how long a device can go without sending data before the monitor disconnected alert; 0 to never")
+var reconnectGrace = flag.Duration("reconnect", heartmon.DefaultReconnectGrace,
+	"how long to wait for a device to reconnect and carry on its session; 0 to start a new one every connection")
+var devicesConfig = flag.String("devices", "",
+	"a JSON file configuring the devices and the people wearing them")
+var sampleRate = flag.Float64("samplerate", heartmon.DefaultSampleRate,
+	"the rate in Hz at which the devices sample, if their handshake doesn't say")
+var adcBits = flag.Uint("adcbits", uint(heartmon.DefaultADCBits),
+	"the resolution in bits of the devices' samples, if their handshake doesn't say")
 
 func main() {
 	flag.Parse()
+	streamInfo, err := heartmon.NewStreamInfo(*sampleRate, *adcBits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad -samplerate or -adcbits: %v\n", err)
+		os.Exit(1)
+	}
 
 	supervisor := suture.NewSimple("heartmon supervisor")
 
@@ -19,9 +49,73 @@ func main() {
 	if err != nil {
 		panic("Can't bind: " + err.Error())
 	}
+	server.StreamInfo = streamInfo
+	server.SnapshotDir = *snapshotDir
+	server.ReconnectGrace = *reconnectGrace
+	if *notifierConfig != "" {
+		server.Notifiers, err = heartmon.LoadNotifierConfigs(*notifierConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *devicesConfig != "" {
+		server.Devices, err = heartmon.LoadDevicesConfig(*devicesConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
 	supervisor.Add(server)
+	if *silence > 0 {
+		server.Watchdog.Silence = *silence
+		supervisor.Add(server.Watchdog)
+	} else {
+		server.Watchdog = nil
+	}
+
+	if *controlSocket != "" {
+		control, err := heartmon.NewControlSocket(*controlSocket,
+			server.Control)
+		if err != nil {
+			panic("Can't listen on the control socket: " + err.Error())
+		}
+		supervisor.Add(control)
+	}
+
+	var httpServer *http.Server
+	if *httpAddress != "" {
+		server.Control.Token = heartmon.ControlToken(*httpAddress, *token)
+		if server.Control.Token != "" {
+			fmt.Printf("Alert controls are at http://%s/alerts/?token=%s\n",
+				*httpAddress, server.Control.Token)
+		}
+		http.Handle("/alerts/", server.Control)
+		http.Handle("/events", heartmon.RequireToken(server.Control.Token,
+			heartmon.NewLiveHeartEvents(server.Events)))
+		http.Handle("/connections", heartmon.RequireToken(
+			server.Control.Token, server))
+		httpServer = &http.Server{Addr: *httpAddress}
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	fmt.Println("Beginning serving")
 
-	supervisor.Serve()
+	supervisor.ServeBackground()
+
+	// Shut down properly on SIGTERM or ^C, so the files are complete
+	// and the alarms don't go on sounding.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	fmt.Printf("Got %s, shutting down\n", sig)
+	supervisor.Stop()
+	if httpServer != nil {
+		// Nothing over HTTP has anything to finish; the event streams
+		// would just hold a graceful shutdown up.
+		httpServer.Close()
+	}
 }
@@ -4,17 +4,69 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
 	"strconv"
+
+	"github.com/thejerf/afibmon/heartmon"
+	"github.com/thejerf/suture"
 )
 
 var port = flag.String("serial", "/dev/ttyACM0", "The serial port for the arduino")
 var outfile = flag.String("outfile", "", "output file to write to")
+var notifierConfig = flag.String("notifiers", "",
+	"a JSON file configuring who to notify of alerts; the default logs and plays a sound")
+var httpAddress = flag.String("http", "127.0.0.1:18499",
+	"the address to serve the live events and alert controls on; empty to not serve them")
+var token = flag.String("token", "",
+	"the token the alert controls and live events over HTTP take; if it's empty and -http isn't only this machine, one is made up")
+var controlSocket = flag.String("control", heartmon.DefaultControlSocket,
+	"the Unix socket to take alert controls on; empty to not")
+var snapshotDir = flag.String("snapshots", heartmon.DefaultSnapshotDir,
+	"the directory to write snapshots of the ECG around each alert to; empty to not")
+var sampleRate = flag.Float64("samplerate", heartmon.DefaultSampleRate,
+	"the rate in Hz at which the arduino samples")
+var adcBits = flag.Uint("adcbits", uint(heartmon.DefaultADCBits),
+	"the resolution in bits of the arduino's samples")
 
 func main() {
 	flag.Parse()
 
-	readings := make(chan uint16)
+	streamInfo, err := heartmon.NewStreamInfo(*sampleRate, *adcBits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad -samplerate or -adcbits: %v\n", err)
+		os.Exit(1)
+	}
+	monitor := heartmon.NewMonitorReader(*outfile)
+	monitor.StreamInfo = streamInfo
+	maxSample := int(monitor.StreamInfo.MaxSample())
+
+	// Run the rate detector live on a copy of the records, the same as
+	// the heartserver does.
+	rateDetect := monitor.Fanout.Subscribe("rate detector",
+		heartmon.DefaultFanoutBuffer)
+	rateDetector := heartmon.NewRecordRateDetector(rateDetect, os.Stderr)
+	if *notifierConfig != "" {
+		configs, err := heartmon.LoadNotifierConfigs(*notifierConfig)
+		if err != nil {
+			panic(err)
+		}
+		rateDetector.Alerter.Notifiers, err = configs.Notifiers(os.Stderr)
+		if err != nil {
+			panic(err)
+		}
+	}
+	rateDetector.Journal = monitor
+	if *snapshotDir != "" {
+		rateDetector.Snapshots = heartmon.NewSnapshotter(*snapshotDir,
+			os.Stderr)
+	}
+	events := heartmon.NewEventHub()
+	rateDetector.Events = events
+	control := heartmon.NewAlertControl()
+	control.Add(rateDetector.Alerter)
+	go rateDetector.Run()
 
 	port, err := os.Open(*port)
 	if err != nil {
@@ -40,23 +92,52 @@ func main() {
 			// or the heart thing gets confused and sends invalid
 			// inputs that appear to be two numbers mixed together.
 			// While I'd love to fix that on the Arduino side, in the
-			// meantime we need to handle it. 1024 is the top end of
-			// what it is supposed to emit:
+			// meantime we need to handle it. MaxSample is the top end
+			// of what it is supposed to emit:
 			// https://www.arduino.cc/en/Reference/AnalogRead
 			// and most such distortions appear to result in numbers larger
 			// than that.
 			// Also, as far as FFTs are concerned I'm pretty sure it's much
 			// better to drop a sample than to put a spurious transient in
-			// it, which will spray high frequencies everywhere.
-			if err == nil && i < 1024 {
-				readings <- uint16(i)
-			} else {
-				if i >= 65535 {
-					continue
-				}
+			// it, which will spray high frequencies everywhere. The
+			// MonitorReader marks the dropped sample as a gap.
+			if err == nil && i >= 0 && i <= maxSample {
+				monitor.Reading(uint16(i))
+				continue
+			}
+			monitor.Drop()
+			if err != nil && i < 65535 {
 				fmt.Println(err)
 			}
 		}
 	}()
 
+	supervisor := suture.NewSimple("heartmon monitor")
+	supervisor.Add(monitor)
+
+	if *controlSocket != "" {
+		socket, err := heartmon.NewControlSocket(*controlSocket, control)
+		if err != nil {
+			panic("Can't listen on the control socket: " + err.Error())
+		}
+		supervisor.Add(socket)
+	}
+
+	if *httpAddress != "" {
+		control.Token = heartmon.ControlToken(*httpAddress, *token)
+		if control.Token != "" {
+			fmt.Printf("Alert controls are at http://%s/alerts/?token=%s\n",
+				*httpAddress, control.Token)
+		}
+		http.Handle("/alerts/", control)
+		http.Handle("/events", heartmon.RequireToken(control.Token,
+			heartmon.NewLiveHeartEvents(events)))
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddress, nil))
+		}()
+	}
+
+	fmt.Println("Beginning monitoring")
+
+	supervisor.Serve()
 }
@@ -0,0 +1,212 @@
+package main
+
+// recompress rewrites .hrt files in the current version of the format,
+// which compresses the heart data; see heartmon/compress.go. Each file is
+// written to a temporary file next to it, read back and checked against
+// the original record by record, and only then moved over it, so a file
+// that can't be converted without losing something is left as it was.
+//
+// Files with corruption in them are left alone too; run repair on them
+// first. So are files still being written, which the heartserver and the
+// monitor hold a lock on (see heartmon/lock.go), and, in case they were
+// written by something that doesn't, files that have been written to in
+// the last few minutes.
+//
+// The files it writes can't be read by anything from before version 3 of
+// the format, which skips the compressed heart data as a record type it
+// doesn't know and is left with nothing but the timestamps. Don't
+// recompress files anything that old still has to read.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/thejerf/afibmon/heartmon"
+)
+
+var dryRun = flag.Bool("n", false,
+	"just say how big the files would be, without replacing them")
+
+// settled is how long a file has to have gone unwritten to be taken to be
+// finished with.
+const settled = 5 * time.Minute
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: recompress [-n] file.hrt ...")
+		fmt.Fprintln(os.Stderr, "The files written can't be read by "+
+			"anything from before version 3 of the format, which would lose the heart data.")
+		os.Exit(1)
+	}
+
+	failed := false
+	var before, after int64
+	for _, filename := range flag.Args() {
+		oldSize, newSize, err := recompress(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't recompress %s: %v\n", filename, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d bytes to %d (%.0f%%)\n", filename, oldSize, newSize,
+			100*float64(newSize)/float64(oldSize))
+		before += oldSize
+		after += newSize
+	}
+	if flag.NArg() > 1 && before > 0 {
+		fmt.Printf("total: %d bytes to %d (%.0f%%)\n", before, after,
+			100*float64(after)/float64(before))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// recompress rewrites the file, returning its size before and after.
+func recompress(filename string) (int64, int64, error) {
+	// The lock is held until the file's been replaced.
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	err = heartmon.LockFile(f)
+	if err == heartmon.ErrFileInUse {
+		return 0, 0, errors.New("it's still being written")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if age := time.Since(info.ModTime()); age < settled {
+		return 0, 0, fmt.Errorf("it was written to %s ago, and may still be being written",
+			age.Round(time.Second))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename)+".*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = convert(filename, tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	err = compare(filename, tmp.Name())
+	if err != nil {
+		return 0, 0, fmt.Errorf("the copy doesn't match: %v", err)
+	}
+
+	newInfo, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	if !*dryRun {
+		err = os.Chmod(tmp.Name(), info.Mode())
+		if err == nil {
+			err = os.Rename(tmp.Name(), filename)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		// The index is of the old file; see heartmon/archive.go.
+		os.Remove(filename + heartmon.IndexSuffix)
+	}
+	return info.Size(), newInfo.Size(), nil
+}
+
+// convert copies the records in the file to w in the current format.
+func convert(filename string, w io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := heartmon.NewRecordReader(f)
+	records.KeepUnknown = true
+	header, err := records.Header()
+	if err != nil {
+		return err
+	}
+	fh := heartmon.FileHeader{}
+	if header != nil {
+		fh = *header
+		fh.Version = 0
+	}
+
+	out := heartmon.NewRecordWriter(w)
+	err = out.WriteHeader(fh)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := records.NextRecord()
+		if err == io.EOF {
+			return out.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		err = out.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compare checks that the two files have the same records in them.
+func compare(original, copied string) error {
+	f1, err := os.Open(original)
+	if err != nil {
+		return err
+	}
+	defer f1.Close()
+	f2, err := os.Open(copied)
+	if err != nil {
+		return err
+	}
+	defer f2.Close()
+
+	r1 := heartmon.NewRecordReader(f1)
+	r1.KeepUnknown = true
+	r2 := heartmon.NewRecordReader(f2)
+	r2.KeepUnknown = true
+	for idx := 0; ; idx++ {
+		record1, err1 := r1.NextRecord()
+		record2, err2 := r2.NextRecord()
+		if err1 == io.EOF && err2 == io.EOF {
+			return nil
+		}
+		if err1 == io.EOF || err2 == io.EOF {
+			return errors.New("they have different numbers of records")
+		}
+		if err1 != nil {
+			return err1
+		}
+		if err2 != nil {
+			return err2
+		}
+		if !reflect.DeepEqual(record1, record2) {
+			return fmt.Errorf("record %d is %v, not %v", idx, record2, record1)
+		}
+	}
+}
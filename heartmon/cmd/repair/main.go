@@ -0,0 +1,74 @@
+package main
+
+// repair checks a .hrt file for problems, such as the half a record left on
+// the end when the server loses power, and with -o writes a copy with them
+// taken out; see heartmon/repair.go.
+//
+// It exits with 2 if the file has problems, so a script can check a
+// directory of files with it.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/thejerf/afibmon/heartmon"
+)
+
+var output = flag.String("o", "",
+	"write a repaired copy of the file here")
+var gaps = flag.Bool("gaps", false,
+	"mark where samples are missing in the repaired copy with gap records")
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: repair [-o repaired.hrt [-gaps]] file.hrt")
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+	if *output == filename {
+		fmt.Fprintln(os.Stderr, "The repaired copy can't be written over the file.")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open file %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	repairer := heartmon.NewRepairer(f)
+	repairer.Gaps = *gaps
+
+	var problems []heartmon.Problem
+	if *output == "" {
+		problems, err = repairer.Repair(nil)
+	} else {
+		var out *os.File
+		out, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't create %s: %v\n", *output, err)
+			os.Exit(1)
+		}
+		problems, err = repairer.Repair(out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", filename, problem)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while repairing %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: no problems\n", filename)
+		return
+	}
+	fmt.Printf("%s: %d problems\n", filename, len(problems))
+	os.Exit(2)
+}
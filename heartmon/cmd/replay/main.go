@@ -0,0 +1,146 @@
+package main
+
+// replay plays a recorded .hrt file back as if it were coming off the
+// hardware. By default it connects to a heartserver and acts as the
+// Arduino; with -outfile it runs it through a MonitorReader and the rate
+// detector instead, as the USB monitor would.
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/thejerf/afibmon/heartmon"
+)
+
+var address = flag.String("address", "localhost:18498",
+	"the heartserver to send the recording to")
+var speed = flag.Float64("speed", 1,
+	"how many times faster than real time to play the recording")
+var maxWait = flag.Duration("maxwait", heartmon.DefaultMaxReplayWait,
+	"the longest pause in the recording to sit through")
+var outfile = flag.String("outfile", "",
+	"replay into a MonitorReader writing to this file, rather than to a heartserver")
+var device = flag.String("device", "",
+	"start with a handshake as the device with this ID, as newer firmware does")
+var protocol = flag.Uint("protocol", uint(heartmon.ProtocolV1),
+	"the protocol version to ask the heartserver for; needs -device for anything but 1")
+
+// how long to wait for the heartserver to answer the handshake, and for it
+// to acknowledge the last frames at the end
+const ackTimeout = 5 * time.Second
+
+func main() {
+	flag.Parse()
+	if !(*speed > 0) || math.IsInf(*speed, 1) {
+		fmt.Fprintf(os.Stderr, "-speed has to be a positive number, not %v\n", *speed)
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Can't open file %q: %v\n", filename, err)
+		os.Exit(1)
+	}
+
+	replayer := heartmon.NewReplayer(f)
+	replayer.Speed = *speed
+	replayer.MaxWait = *maxWait
+
+	if *outfile != "" {
+		err = replayMonitor(replayer)
+	} else {
+		err = replayServer(replayer)
+	}
+	if err != nil {
+		fmt.Printf("Can't replay %q: %v\n", filename, err)
+		os.Exit(1)
+	}
+}
+
+func replayServer(replayer *heartmon.Replayer) error {
+	conn, err := net.Dial("tcp", *address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *device == "" {
+		return replayer.Records(conn)
+	}
+
+	handshake := heartmon.HandshakeRecord{
+		DeviceID: *device,
+		Firmware: "replay",
+	}
+	if *protocol >= uint(heartmon.ProtocolV2) {
+		handshake.Protocol = uint8(*protocol)
+		handshake.Boot = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	}
+	rw := heartmon.NewRecordWriter(conn)
+	err = rw.Write(handshake)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if handshake.Protocol < heartmon.ProtocolV2 {
+		return replayer.Records(conn)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ackTimeout))
+	ack, err := heartmon.ReadAck(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("No answer to the handshake (%v); carrying on in protocol %d\n",
+			err, heartmon.ProtocolV1)
+		return replayer.Records(conn)
+	}
+	fmt.Printf("Speaking protocol %d\n", ack.Protocol)
+
+	fw := heartmon.NewFrameWriter(conn)
+	fw.Acknowledge(ack)
+	go fw.ReadAcks(conn)
+	err = replayer.Frames(fw)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(ackTimeout)
+	for fw.Unacknowledged() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if unacked := fw.Unacknowledged(); unacked > 0 {
+		return fmt.Errorf("%d frames were never acknowledged", unacked)
+	}
+	return nil
+}
+
+func replayMonitor(replayer *heartmon.Replayer) error {
+	monitor := heartmon.NewMonitorReader(*outfile)
+
+	rateDetect := monitor.Fanout.Subscribe("rate detector",
+		heartmon.DefaultFanoutBuffer)
+	rateDetector := heartmon.NewRecordRateDetector(rateDetect, os.Stderr)
+	rateDetector.Journal = monitor
+	go rateDetector.Run()
+
+	done := make(chan struct{})
+	go func() {
+		monitor.Serve()
+		// If it couldn't open the file, this stops the replay too.
+		monitor.Stop()
+		close(done)
+	}()
+
+	err := replayer.Samples(monitor)
+	monitor.Stop()
+	<-done
+	return err
+}
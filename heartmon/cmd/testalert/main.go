@@ -1,14 +1,27 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/thejerf/afibmon/heartmon"
 )
 
+var detectors = flag.String("detectors", "rr",
+	"comma-separated detectors to run: bpm, rr, buckets")
+var policy = flag.String("policy", "any",
+	"how to combine the detectors: any, majority, unanimous")
+var notifierConfig = flag.String("notifiers", "",
+	"a JSON file configuring who to notify of alerts; the default logs and plays a sound")
+var journal = flag.String("journal", "",
+	"a .hrt file to write the alert and episode records to, for cmd/episodes")
+var snapshotDir = flag.String("snapshots", "",
+	"a directory to write snapshots of the ECG around each alert to")
+
 func main() {
-	filename := os.Args[1]
+	flag.Parse()
+	filename := flag.Arg(0)
 
 	f, err := os.Open(filename)
 	if err != nil {
@@ -16,6 +29,49 @@ func main() {
 		os.Exit(1)
 	}
 
-	rr := heartmon.NewRateDetector(f, os.Stdout)
+	records := heartmon.NewRecordReader(f)
+	records.Recover = true
+	rr := heartmon.NewRecordRateDetector(records, os.Stdout)
+	rr.Detectors, err = heartmon.ParseDetectors(*detectors)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	rr.Policy, err = heartmon.ParsePolicy(*policy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *notifierConfig != "" {
+		configs, err := heartmon.LoadNotifierConfigs(*notifierConfig)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		rr.Alerter.Notifiers, err = configs.Notifiers(os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *snapshotDir != "" {
+		rr.Snapshots = heartmon.NewSnapshotter(*snapshotDir, os.Stdout)
+	}
+	if *journal != "" {
+		journalF, err := os.Create(*journal)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer journalF.Close()
+		journalW := heartmon.NewRecordWriter(journalF)
+		defer journalW.Flush()
+		err = journalW.WriteHeader(heartmon.FileHeader{})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		rr.Journal = journalW
+	}
 	rr.Run()
 }
@@ -0,0 +1,87 @@
+package heartmon
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A HeartDataRecord spends two bytes on each sample, and at 50 samples a
+// second that's most of a .hrt file; a night is several megabytes. But
+// an ECG doesn't move much from one sample to the next, so most of the
+// difference between one and the next fits in a byte.
+//
+// So from version 3 of the format, a RecordWriter writes heart data as
+// CompressedHeartdata records: the first sample as a varint, then the
+// difference between each sample and the one before it as a zigzag varint,
+// as encoding/binary does them. If that comes out no smaller, as it won't
+// for noise, it writes the HeartDataRecord as it is. A RecordReader reads
+// either as a HeartDataRecord, so nothing else has to know.
+//
+// Streams without a header, such as from the device, aren't compressed;
+// the firmware doesn't have the cycles to spare. cmd/recompress rewrites
+// older files in the current format.
+//
+// Code from before version 3 doesn't know CompressedHeartdata records,
+// and skips them, so it reads a version 3 file as having no heart data at
+// all, without saying anything's wrong. Anything that has to read the
+// files had better be newer than that.
+
+// compressSamples returns the samples as the contents of a
+// CompressedHeartdata record.
+func compressSamples(data []uint16) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	b := make([]byte, 0, len(data)+binary.MaxVarintLen16)
+	varint := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(varint, uint64(data[0]))
+	b = append(b, varint[:n]...)
+	for i := 1; i < len(data); i++ {
+		n = binary.PutVarint(varint, int64(data[i])-int64(data[i-1]))
+		b = append(b, varint[:n]...)
+	}
+	return b
+}
+
+var errBadCompressedData = errors.New("Illegal compressed heart record")
+
+// decompressSamples returns the samples in the contents of a
+// CompressedHeartdata record.
+func decompressSamples(b []byte) ([]uint16, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	first, n := binary.Uvarint(b)
+	if n <= 0 || first > 0xffff {
+		return nil, errBadCompressedData
+	}
+	b = b[n:]
+	// Most samples take a byte, so this is about right.
+	data := make([]uint16, 1, 1+len(b))
+	data[0] = uint16(first)
+	sample := int64(first)
+	for len(b) > 0 {
+		delta, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, errBadCompressedData
+		}
+		b = b[n:]
+		sample += delta
+		if sample < 0 || sample > 0xffff {
+			return nil, errBadCompressedData
+		}
+		data = append(data, uint16(sample))
+	}
+	return data, nil
+}
+
+// writeHeartData writes the heart data compressed, if that makes it
+// smaller.
+func (rw *RecordWriter) writeHeartData(hdr HeartDataRecord) error {
+	b := compressSamples(hdr.Data)
+	if len(b) >= 2*len(hdr.Data) {
+		return rw.WriteRecord(Heartdata, hdr)
+	}
+	return rw.WriteRecord(CompressedHeartdata,
+		UnknownRecord{Type: CompressedHeartdata, Data: b})
+}
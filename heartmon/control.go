@@ -0,0 +1,438 @@
+package heartmon
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When an alert goes off at 3am, I need to be able to shut it up without
+// getting out of bed and without killing the monitor, which would stop it
+// noticing anything else. AlertControl lets me do that from my phone, over
+// HTTP, or from a terminal, over a Unix socket; see cmd/alertctl. The socket
+// is in control_unix.go, since it's only there on Unix.
+//
+// Anything that can shut up the alarm had better be something only I can
+// do, though. The HTTP controls are only served to this machine by
+// default; to reach them from my phone they have to be served to the
+// network, and then they take a token, which has to come with every
+// request. Either way a POST from a page on some other site is turned
+// away, so a web page can't silence the alarm through my browser.
+
+// AlertControl acknowledges and snoozes the alerts of any number of
+// Alerters at once. Each connection to the heartserver has its own
+// RateDetector and so its own Alerter, and I don't want to have to care
+// which one is making the noise. But if more than one person is being
+// monitored, snoozing my own alarm mustn't snooze theirs, so each command
+// can be given a device or a person, and then only touches the Alerters
+// for it.
+type AlertControl struct {
+	// Token, if it's set, has to be given as the "token" parameter of
+	// every HTTP request. NewAlertControl leaves it empty; see
+	// ControlToken.
+	Token string
+
+	sync.Mutex
+	alerters map[*Alerter]struct{}
+	// the wall clock time each snooze ends, by who it was for, so
+	// Alerters that turn up during one can be snoozed too
+	snoozedUntil map[string]time.Time
+}
+
+// NewAlertControl returns an AlertControl with no Alerters.
+func NewAlertControl() *AlertControl {
+	return &AlertControl{
+		alerters:     map[*Alerter]struct{}{},
+		snoozedUntil: map[string]time.Time{},
+	}
+}
+
+// Add adds the Alerter to those being controlled. If a snooze that covers
+// it is going, the Alerter is snoozed for the rest of it.
+func (ac *AlertControl) Add(a *Alerter) {
+	ac.Lock()
+	defer ac.Unlock()
+
+	ac.alerters[a] = struct{}{}
+	for who, until := range ac.snoozedUntil {
+		remaining := time.Until(until)
+		if remaining > 0 && isFor(a, who) {
+			a.Snooze(remaining)
+		}
+	}
+}
+
+// isFor returns whether a command for who, a device or a person, is for
+// the Alerter. A command for nobody in particular is for everybody.
+func isFor(a *Alerter, who string) bool {
+	return who == "" || who == a.Device || who == a.Person
+}
+
+// matching returns the Alerters a command for who is for, or an error if
+// there aren't any. The lock must be held.
+func (ac *AlertControl) matching(who string) ([]*Alerter, error) {
+	alerters := []*Alerter{}
+	for alerter := range ac.alerters {
+		if isFor(alerter, who) {
+			alerters = append(alerters, alerter)
+		}
+	}
+	if who != "" && len(alerters) == 0 {
+		return nil, fmt.Errorf("nothing is monitoring %q", who)
+	}
+	return alerters, nil
+}
+
+// Remove removes the Alerter from those being controlled.
+func (ac *AlertControl) Remove(a *Alerter) {
+	ac.Lock()
+	defer ac.Unlock()
+
+	delete(ac.alerters, a)
+}
+
+// Acknowledge acknowledges any alerts going for who, a device or a
+// person, or for everybody if who is empty, and returns how many there
+// were.
+func (ac *AlertControl) Acknowledge(who string) (int, error) {
+	ac.Lock()
+	defer ac.Unlock()
+
+	alerters, err := ac.matching(who)
+	if err != nil {
+		return 0, err
+	}
+	acknowledged := 0
+	for _, alerter := range alerters {
+		if alerter.Acknowledge() {
+			acknowledged++
+		}
+	}
+	return acknowledged, nil
+}
+
+// Snooze snoozes the alerts for who, a device or a person, or for
+// everybody if who is empty, for the given duration. Snoozing for 0
+// cancels a snooze; cancelling everybody's cancels them all.
+func (ac *AlertControl) Snooze(who string, d time.Duration) error {
+	ac.Lock()
+	defer ac.Unlock()
+
+	alerters, err := ac.matching(who)
+	if err != nil {
+		return err
+	}
+	if who == "" && d <= 0 {
+		ac.snoozedUntil = map[string]time.Time{}
+	} else {
+		ac.snoozedUntil[who] = time.Now().Add(d)
+	}
+	for _, alerter := range alerters {
+		alerter.Snooze(d)
+	}
+	return nil
+}
+
+// States returns the states of all the Alerters.
+func (ac *AlertControl) States() []AlertState {
+	ac.Lock()
+	defer ac.Unlock()
+
+	states := []AlertState{}
+	for alerter := range ac.alerters {
+		states = append(states, alerter.State())
+	}
+	return states
+}
+
+// command runs a text command, as used by the control socket, and returns
+// the response. Whatever's after the command, and the duration for a
+// snooze, is the device or person it's for.
+func (ac *AlertControl) command(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	args := fields[1:]
+
+	switch fields[0] {
+	case "ack", "acknowledge":
+		acknowledged, err := ac.Acknowledge(strings.Join(args, " "))
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return fmt.Sprintf("acknowledged %d alerts", acknowledged)
+
+	case "snooze":
+		d := DefaultSnooze
+		if len(args) > 0 {
+			parsed, err := time.ParseDuration(args[0])
+			if err == nil {
+				d = parsed
+				args = args[1:]
+			}
+		}
+		if d <= 0 {
+			return "error: a snooze has to be for some time; " +
+				"unsnooze cancels one"
+		}
+		if d > MaxSnooze {
+			return fmt.Sprintf("error: can't snooze for more than %s",
+				MaxSnooze)
+		}
+		err := ac.Snooze(strings.Join(args, " "), d)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return fmt.Sprintf("snoozed for %s", d)
+
+	case "unsnooze":
+		err := ac.Snooze(strings.Join(args, " "), 0)
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return "snooze cancelled"
+
+	case "status":
+		lines := []string{}
+		for _, state := range ac.States() {
+			lines = append(lines, state.String())
+		}
+		if len(lines) == 0 {
+			return "no monitors running"
+		}
+		return strings.Join(lines, "\n")
+
+	default:
+		return fmt.Sprintf(
+			"error: unknown command %q; try ack [who], "+
+				"snooze [duration] [who], unsnooze [who] or status",
+			fields[0])
+	}
+}
+
+func (as AlertState) String() string {
+	var status string
+	switch {
+	case !as.Active:
+		status = "no alert"
+	case as.Acknowledged:
+		status = fmt.Sprintf("%s alert since %s, acknowledged",
+			as.Alert.Kind, as.Alert.Started.Format(time.RFC1123))
+	default:
+		status = fmt.Sprintf("%s alert since %s, level %d",
+			as.Alert.Kind, as.Alert.Started.Format(time.RFC1123),
+			as.Alert.Level)
+	}
+	if as.Who != "" {
+		status = as.Who + ": " + status
+	}
+	if as.Snoozed {
+		status += fmt.Sprintf(", snoozed until %s",
+			as.SnoozedUntil.Format(time.RFC1123))
+	}
+	return status
+}
+
+// ServeHTTP serves the alert controls. Mount it at a path ending in a
+// slash, such as "/alerts/". A GET of the path itself is a page with
+// buttons on it, suitable for stabbing at with one eye open. Below it:
+//
+//	GET  status         the state of each Alerter, as JSON
+//	POST ack            acknowledge the alerts going
+//	POST snooze         snooze; the "for" parameter is a duration, 15m by
+//	                    default and MaxSnooze at most
+//	POST unsnooze       cancel a snooze
+//
+// The POSTs act on everybody's alerts, or, given a "who" parameter naming
+// a device or a person, only on theirs. If there's a Token, each request
+// needs it as its "token" parameter.
+func (ac *AlertControl) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	action := path.Base(req.URL.Path)
+	if strings.HasSuffix(req.URL.Path, "/") {
+		action = ""
+	}
+
+	if !goodToken(req, ac.Token) {
+		http.Error(rw, "wrong or missing token", http.StatusForbidden)
+		return
+	}
+
+	if action == "" || action == "status" {
+		if req.Method != http.MethodGet {
+			http.Error(rw, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if action == "" {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			ac.controlPage(rw)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(ac.States())
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(rw, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(req) {
+		http.Error(rw, "not from another site", http.StatusForbidden)
+		return
+	}
+
+	// The duration goes first, so a who that looks like one isn't
+	// taken as one.
+	who := req.FormValue("who")
+	var response string
+	switch action {
+	case "ack":
+		response = ac.command("ack " + who)
+	case "snooze":
+		d := req.FormValue("for")
+		if d == "" {
+			d = DefaultSnooze.String()
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response = ac.command("snooze " + d + " " + who)
+	case "unsnooze":
+		response = ac.command("unsnooze " + who)
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+	if strings.HasPrefix(response, "error") {
+		http.Error(rw, response, http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(rw, response)
+}
+
+// controlPage writes the page of buttons: one set for everybody, and if
+// more than one device is being monitored, a set for each.
+func (ac *AlertControl) controlPage(w io.Writer) {
+	token := html.EscapeString(url.QueryEscape(ac.Token))
+	buttons := func(who string) string {
+		return strings.Replace(strings.Replace(controlButtons,
+			"TOKEN", token, -1), "WHO", html.EscapeString(who), -1)
+	}
+
+	// A device can have more than one Alerter, such as its
+	// RateDetector's and the Watchdog's.
+	who := map[string]string{}
+	devices := []string{}
+	for _, state := range ac.States() {
+		if _, seen := who[state.Device]; state.Device != "" && !seen {
+			who[state.Device] = state.Who
+			devices = append(devices, state.Device)
+		}
+	}
+	sort.Strings(devices)
+
+	fmt.Fprint(w, controlPageHead)
+	fmt.Fprint(w, buttons(""))
+	if len(devices) > 1 {
+		for _, device := range devices {
+			fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(who[device]))
+			fmt.Fprint(w, buttons(device))
+		}
+	}
+	fmt.Fprint(w, strings.Replace(controlPageFoot, "TOKEN", token, -1))
+}
+
+const controlPageHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>afibmon</title>
+<style>
+body { font-family: sans-serif; background: black; color: #888; }
+button { width: 100%; font-size: 2em; margin: 0.5em 0; padding: 1em; }
+</style>
+</head>
+<body>
+`
+
+const controlButtons = `<form method="post" action="ack?token=TOKEN"><input type="hidden" name="who" value="WHO"><button>Acknowledge</button></form>
+<form method="post" action="snooze?token=TOKEN"><input type="hidden" name="who" value="WHO"><button>Snooze 15 minutes</button></form>
+<form method="post" action="unsnooze?token=TOKEN"><input type="hidden" name="who" value="WHO"><button>Cancel snooze</button></form>
+`
+
+const controlPageFoot = `<p><a href="status?token=TOKEN">status</a></p>
+</body>
+</html>
+`
+
+// RequireToken returns a handler that only passes a request on to the
+// given one if it has the token as its "token" parameter, the same as the
+// alert controls take it. If the token is empty, every request is passed
+// on. The live ECG and the connections give away as much about somebody as
+// the controls do, so they're served with the same token.
+func RequireToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !goodToken(req, token) {
+			http.Error(rw, "wrong or missing token", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// goodToken returns whether the request has the token, or there's no token
+// to have.
+func goodToken(req *http.Request, token string) bool {
+	return token == "" || subtle.ConstantTimeCompare(
+		[]byte(req.FormValue("token")), []byte(token)) == 1
+}
+
+// sameOrigin returns whether the request came from a page served from
+// here, or from something that isn't a browser. Browsers say where a
+// cross-site POST came from in its Origin header.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return req.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// ControlToken returns the token the alert controls served over HTTP on the
+// given address should take: the given one if there is one, and if not,
+// none if the address is only reachable from this machine, and a random one
+// if it isn't.
+func ControlToken(address, token string) string {
+	if token != "" {
+		return token
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		ip := net.ParseIP(host)
+		if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return ""
+		}
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		panic("can't make a control token: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
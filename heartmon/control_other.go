@@ -0,0 +1,22 @@
+//go:build !unix
+
+package heartmon
+
+import "errors"
+
+// DefaultControlSocket is empty, since there's no control socket on this
+// system; see control_unix.go.
+var DefaultControlSocket = ""
+
+// ControlSocket would serve an AlertControl on a Unix socket, but there
+// isn't one on this system. The HTTP controls still work.
+type ControlSocket struct{}
+
+// NewControlSocket always returns an error on this system.
+func NewControlSocket(socketPath string, control *AlertControl) (*ControlSocket, error) {
+	return nil, errors.New("there's no control socket on this system")
+}
+
+func (cs *ControlSocket) Serve() {}
+
+func (cs *ControlSocket) Stop() {}
@@ -0,0 +1,189 @@
+//go:build unix
+
+package heartmon
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// DefaultControlSocket is where the control socket goes by default: in the
+// user's runtime directory, or a directory of their own in the temporary
+// directory if there isn't one, where nobody else can get at it.
+var DefaultControlSocket = filepath.Join(runtimeDir(), "afibmon.sock")
+
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("afibmon-%d", os.Getuid()))
+}
+
+// ControlSocket serves an AlertControl on a Unix socket, one text command
+// per line: "ack [who]", "snooze [duration] [who]", "unsnooze [who]" or
+// "status", where who is a device or a person. Each command gets a
+// response terminated by a blank line.
+//
+// The socket is there while it's being served: Serve makes it, and Stop
+// removes it, so a supervisor can restart it.
+type ControlSocket struct {
+	path    string
+	control *AlertControl
+
+	sync.Mutex
+	l net.Listener
+	// set by a Stop that came before Serve was listening, so Serve knows
+	// not to start
+	stopped bool
+}
+
+// NewControlSocket returns a ControlSocket for the Unix socket at the given
+// path, which only this user can use. The directory it's in is made if it
+// has to be, and has to be this user's and nobody else's. A socket left
+// lying around by a previous run is removed when it's served, but if
+// something is still listening on it, that's an error, rather than
+// quietly taking the controls away from it.
+func NewControlSocket(socketPath string, control *AlertControl) (*ControlSocket, error) {
+	err := privateDir(filepath.Dir(socketPath))
+	if err != nil {
+		return nil, err
+	}
+	if listening(socketPath) {
+		return nil, fmt.Errorf("something is already listening on %s",
+			socketPath)
+	}
+	return &ControlSocket{path: socketPath, control: control}, nil
+}
+
+// listening returns whether something is listening on the socket.
+func listening(socketPath string) bool {
+	fi, err := os.Lstat(socketPath)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (cs *ControlSocket) listen() (net.Listener, error) {
+	if listening(cs.path) {
+		return nil, fmt.Errorf("something is already listening on %s",
+			cs.path)
+	}
+	// anything left is from a run that's gone
+	os.Remove(cs.path)
+
+	l, err := net.Listen("unix", cs.path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(cs.path, 0600)
+	if err != nil {
+		l.Close()
+		os.Remove(cs.path)
+		return nil, err
+	}
+	return l, nil
+}
+
+// privateDir makes sure the directory exists, belongs to this user, and
+// can't be written to by anyone else.
+func privateDir(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to someone else", dir)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s can be written to by other users", dir)
+	}
+	return nil
+}
+
+func (cs *ControlSocket) Serve() {
+	cs.Lock()
+	if cs.stopped {
+		cs.stopped = false
+		cs.Unlock()
+		return
+	}
+	l, err := cs.listen()
+	if err != nil {
+		cs.Unlock()
+		log.Printf("Can't listen on the control socket: %v", err)
+		return
+	}
+	cs.l = l
+	cs.Unlock()
+	defer cs.close(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go cs.handle(conn)
+	}
+}
+
+func (cs *ControlSocket) Stop() {
+	cs.Lock()
+	l := cs.l
+	if l == nil {
+		cs.stopped = true
+	}
+	cs.Unlock()
+	if l != nil {
+		cs.close(l)
+	}
+}
+
+// close closes the listener and removes the socket, unless that's already
+// been done.
+func (cs *ControlSocket) close(l net.Listener) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.l != l {
+		return
+	}
+	l.Close()
+	os.Remove(cs.path)
+	cs.l = nil
+}
+
+func (cs *ControlSocket) handle(conn net.Conn) {
+	defer conn.Close()
+
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		response := cs.control.command(lines.Text())
+		if response == "" {
+			continue
+		}
+		_, err := fmt.Fprintf(conn, "%s\n\n", response)
+		if err != nil {
+			log.Printf("Can't write to control socket: %v", err)
+			return
+		}
+	}
+}
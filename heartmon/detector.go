@@ -0,0 +1,377 @@
+package heartmon
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/thejerf/afibmon/heartmon/afib"
+	"github.com/thejerf/afibmon/heartmon/beatalyse"
+	"github.com/thejerf/afibmon/heartmon/qrs"
+)
+
+// Verdict is what a Detector thinks of a window of heart data.
+type Verdict int
+
+const (
+	VerdictNormal = Verdict(iota)
+	VerdictTachycardia
+	VerdictIrregular
+	VerdictSignalLost
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictNormal:
+		return "normal"
+	case VerdictTachycardia:
+		return "tachycardia"
+	case VerdictIrregular:
+		return "irregular"
+	case VerdictSignalLost:
+		return "signal lost"
+	default:
+		return fmt.Sprintf("unknown verdict %d", int(v))
+	}
+}
+
+// Abnormal returns true if this verdict is something that should count
+// towards raising an alert.
+func (v Verdict) Abnormal() bool {
+	return v == VerdictTachycardia || v == VerdictIrregular
+}
+
+// severity orders verdicts for the purpose of picking the one to report
+// when several detectors disagree. Losing the signal trumps everything,
+// because then none of the other verdicts mean anything.
+func (v Verdict) severity() int {
+	switch v {
+	case VerdictSignalLost:
+		return 3
+	case VerdictIrregular:
+		return 2
+	case VerdictTachycardia:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Window is the chunk of heart data a Detector is asked to look at. The
+// RateDetector hands every detector the same Window, so the beat detection
+// is done at most once no matter how many detectors want it.
+type Window struct {
+	// Samples is the heart data, oldest first.
+	Samples []uint16
+	// Start is the time of Samples[0].
+	Start time.Time
+	// SampleRate is the sample rate in Hz.
+	SampleRate float64
+
+	qrs   *qrs.Detector
+	beats []qrs.Beat
+}
+
+// NewWindow returns a Window over the given samples.
+func NewWindow(samples []uint16, start time.Time, sampleRate float64) *Window {
+	return &Window{
+		Samples:    samples,
+		Start:      start,
+		SampleRate: sampleRate,
+	}
+}
+
+// QRS returns the QRS detector for this window's sample rate.
+func (w *Window) QRS() *qrs.Detector {
+	if w.qrs == nil {
+		w.qrs = qrs.New(w.SampleRate)
+	}
+	return w.qrs
+}
+
+// Beats returns the beats detected in the window.
+func (w *Window) Beats() []qrs.Beat {
+	if w.beats == nil {
+		w.beats = w.QRS().Beats(w.Samples, w.Start)
+	}
+	return w.beats
+}
+
+// Duration returns how long the window is.
+func (w *Window) Duration() time.Duration {
+	return w.QRS().SampleDuration(len(w.Samples))
+}
+
+// Finding is a Detector's verdict on a Window, with a human-readable
+// explanation.
+type Finding struct {
+	Detector string
+	Verdict  Verdict
+	Detail   string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", f.Detector, f.Verdict, f.Detail)
+}
+
+// A Detector looks at a window of heart data and decides what it thinks of
+// it.
+//
+// Detectors may keep state between calls, but should not assume that
+// consecutive windows overlap in any particular way; a RateDetector will
+// usually hand it the last minute of data once per incoming record, but
+// that's not a promise.
+type Detector interface {
+	Name() string
+	Detect(w *Window) Finding
+}
+
+// A Policy combines the findings of several detectors into one verdict.
+type Policy func(findings []Finding) Verdict
+
+// AnyAbnormal is a Policy that returns the most severe verdict any
+// detector came up with.
+func AnyAbnormal(findings []Finding) Verdict {
+	verdict := VerdictNormal
+	for _, finding := range findings {
+		if finding.Verdict.severity() > verdict.severity() {
+			verdict = finding.Verdict
+		}
+	}
+	return verdict
+}
+
+// Majority is a Policy that returns the most severe verdict that more than
+// half of the detectors agree is abnormal, counting any abnormal verdict
+// as agreement. Signal loss is always reported, since nobody can vote
+// sensibly without a signal.
+func Majority(findings []Finding) Verdict {
+	abnormal := 0
+	verdict := VerdictNormal
+	for _, finding := range findings {
+		if finding.Verdict == VerdictSignalLost {
+			return VerdictSignalLost
+		}
+		if finding.Verdict.Abnormal() {
+			abnormal++
+			if finding.Verdict.severity() > verdict.severity() {
+				verdict = finding.Verdict
+			}
+		}
+	}
+	if abnormal*2 > len(findings) {
+		return verdict
+	}
+	return VerdictNormal
+}
+
+// Unanimous is a Policy that only returns an abnormal verdict if every
+// detector thinks the window is abnormal.
+func Unanimous(findings []Finding) Verdict {
+	verdict := VerdictNormal
+	for _, finding := range findings {
+		if finding.Verdict == VerdictSignalLost {
+			return VerdictSignalLost
+		}
+		if !finding.Verdict.Abnormal() {
+			return VerdictNormal
+		}
+		if finding.Verdict.severity() > verdict.severity() {
+			verdict = finding.Verdict
+		}
+	}
+	return verdict
+}
+
+// ParsePolicy returns the policy with the given name, one of "any",
+// "majority" or "unanimous".
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "any":
+		return AnyAbnormal, nil
+	case "majority":
+		return Majority, nil
+	case "unanimous":
+		return Unanimous, nil
+	default:
+		return nil, fmt.Errorf("unknown policy %q", name)
+	}
+}
+
+// DefaultDetectors returns the detectors a RateDetector uses if it isn't
+// told otherwise.
+func DefaultDetectors() []Detector {
+	return []Detector{NewRRIrregularityDetector()}
+}
+
+// ParseDetectors takes a comma-separated list of detector names and
+// returns the detectors with their default settings. The names are "bpm",
+// "rr" and "buckets".
+func ParseDetectors(spec string) ([]Detector, error) {
+	detectors := []Detector{}
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "bpm":
+			detectors = append(detectors, NewBPMDetector())
+		case "rr":
+			detectors = append(detectors, NewRRIrregularityDetector())
+		case "buckets":
+			detectors = append(detectors, NewBucketRatioDetector())
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+	}
+	if len(detectors) == 0 {
+		return nil, fmt.Errorf("no detectors in %q", spec)
+	}
+	return detectors, nil
+}
+
+// BPMDetector is the original heuristic: if the heart is going faster than
+// the Limit, something's wrong. It's not good at AF, since it misses rate
+// controlled AF entirely and fires on any old tachycardia, but it's simple
+// and it's useful to run alongside the others.
+type BPMDetector struct {
+	Limit int
+}
+
+// NewBPMDetector returns a BPMDetector with the original limit of 90.
+func NewBPMDetector() *BPMDetector {
+	return &BPMDetector{Limit: 90}
+}
+
+func (bd *BPMDetector) Name() string {
+	return "bpm"
+}
+
+func (bd *BPMDetector) Detect(w *Window) Finding {
+	beats := w.Beats()
+	peaks := make([]int, len(beats))
+	for idx, beat := range beats {
+		peaks[idx] = beat.Sample
+	}
+	bpm := int(math.Round(w.QRS().BPM(peaks)))
+
+	finding := Finding{
+		Detector: bd.Name(),
+		Detail:   fmt.Sprintf("%d beats per minute", bpm),
+	}
+	switch {
+	// No beats at all in a decent chunk of data means there's no heart
+	// signal to speak of.
+	case len(beats) < 2 && w.Duration() >= 10*time.Second:
+		finding.Verdict = VerdictSignalLost
+	case bpm > bd.Limit:
+		finding.Verdict = VerdictTachycardia
+	}
+	return finding
+}
+
+// AFThreshold is the AF probability above which the RRIrregularityDetector
+// considers a window to be irregular.
+const AFThreshold = 0.5
+
+// RRIrregularityDetector uses the afib package to look at how irregular
+// the beats are.
+type RRIrregularityDetector struct {
+	Threshold float64
+}
+
+// NewRRIrregularityDetector returns an RRIrregularityDetector using the
+// AFThreshold.
+func NewRRIrregularityDetector() *RRIrregularityDetector {
+	return &RRIrregularityDetector{Threshold: AFThreshold}
+}
+
+func (rd *RRIrregularityDetector) Name() string {
+	return "rr"
+}
+
+func (rd *RRIrregularityDetector) Detect(w *Window) Finding {
+	beats := w.Beats()
+	times := make([]time.Time, len(beats))
+	for idx, beat := range beats {
+		times[idx] = beat.Time
+	}
+	af := afib.Classify(times)
+
+	finding := Finding{
+		Detector: rd.Name(),
+		Detail:   fmt.Sprintf("AF probability %.2f", af.Probability),
+	}
+	if af.Sufficient && af.Probability > rd.Threshold {
+		finding.Verdict = VerdictIrregular
+	}
+	return finding
+}
+
+// BucketRatioDetector uses the beatalyse FFT buckets, comparing the energy
+// in the top half of the 5-15Hz band to the bottom half. This is
+// experimental: nothing says the ratio separates AF from anything else,
+// and the Limit is an arbitrary guess, which is why it isn't one of the
+// DefaultDetectors.
+type BucketRatioDetector struct {
+	// Size is the number of samples to run the FFT over, taken from the
+	// end of the window.
+	Size int
+	// Buckets is the number of buckets to split the band into.
+	Buckets int
+	// Limit is the high/low ratio above which the window is considered
+	// irregular.
+	Limit float64
+
+	analyzer   *beatalyse.BeatAnalyzer
+	sampleRate float64
+}
+
+// NewBucketRatioDetector returns a BucketRatioDetector with the same
+// settings cmd/analyze defaults to.
+func NewBucketRatioDetector() *BucketRatioDetector {
+	return &BucketRatioDetector{
+		Size:    512,
+		Buckets: 10,
+		Limit:   1.5,
+	}
+}
+
+func (bd *BucketRatioDetector) Name() string {
+	return "buckets"
+}
+
+func (bd *BucketRatioDetector) Detect(w *Window) Finding {
+	finding := Finding{Detector: bd.Name()}
+	if len(w.Samples) < bd.Size {
+		finding.Detail = "not enough data"
+		return finding
+	}
+	if bd.analyzer == nil || bd.sampleRate != w.SampleRate {
+		bd.analyzer = beatalyse.New(bd.Size, w.SampleRate)
+		bd.sampleRate = w.SampleRate
+	}
+
+	fft := bd.analyzer.FFT(w.Samples[len(w.Samples)-bd.Size:])
+	normalized := fft.Buckets(bd.Buckets).Normalized()
+
+	low, high := float64(0), float64(0)
+	for idx, value := range normalized {
+		if idx < len(normalized)/2 {
+			low += value
+		} else {
+			high += value
+		}
+	}
+	if low == 0 || math.IsNaN(low) {
+		finding.Verdict = VerdictSignalLost
+		finding.Detail = "no energy in band"
+		return finding
+	}
+
+	ratio := high / low
+	finding.Detail = fmt.Sprintf("high/low ratio %.2f", ratio)
+	if ratio > bd.Limit {
+		finding.Verdict = VerdictIrregular
+	}
+	return finding
+}
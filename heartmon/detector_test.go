@@ -0,0 +1,107 @@
+package heartmon
+
+import (
+	"reflect"
+	"testing"
+)
+
+// findings returns a Finding for each of the verdicts.
+func findings(verdicts ...Verdict) []Finding {
+	var findings []Finding
+	for _, verdict := range verdicts {
+		findings = append(findings, Finding{Verdict: verdict})
+	}
+	return findings
+}
+
+func TestPolicies(t *testing.T) {
+	normal, fast, irregular, lost := VerdictNormal, VerdictTachycardia,
+		VerdictIrregular, VerdictSignalLost
+
+	for _, test := range []struct {
+		verdicts  []Verdict
+		any       Verdict
+		majority  Verdict
+		unanimous Verdict
+	}{
+		{nil, normal, normal, normal},
+		{[]Verdict{normal}, normal, normal, normal},
+		{[]Verdict{irregular}, irregular, irregular, irregular},
+		{[]Verdict{normal, normal, normal}, normal, normal, normal},
+		{[]Verdict{irregular, normal, normal}, irregular, normal, normal},
+		{[]Verdict{irregular, normal}, irregular, normal, normal},
+		// Both abnormal counts as agreement; the worse one is reported.
+		{[]Verdict{fast, irregular, normal}, irregular, irregular, normal},
+		{[]Verdict{fast, fast, normal}, fast, fast, normal},
+		{[]Verdict{fast, irregular, fast}, irregular, irregular, irregular},
+		// Losing the signal beats everything, however few say so.
+		{[]Verdict{lost, normal, normal}, lost, lost, lost},
+		{[]Verdict{irregular, irregular, lost}, lost, lost, lost},
+	} {
+		for _, policy := range []struct {
+			name     string
+			policy   Policy
+			expected Verdict
+		}{
+			{"any", AnyAbnormal, test.any},
+			{"majority", Majority, test.majority},
+			{"unanimous", Unanimous, test.unanimous},
+		} {
+			got := policy.policy(findings(test.verdicts...))
+			if got != policy.expected {
+				t.Fatalf("%s of %v: got %v, expected %v", policy.name,
+					test.verdicts, got, policy.expected)
+			}
+
+			parsed, err := ParsePolicy(policy.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed(findings(test.verdicts...)); got != policy.expected {
+				t.Fatalf("parsed %s of %v: got %v", policy.name,
+					test.verdicts, got)
+			}
+		}
+	}
+}
+
+func TestParsePolicyRejects(t *testing.T) {
+	for _, name := range []string{"", "all", "Majority", " any"} {
+		policy, err := ParsePolicy(name)
+		if err == nil || policy != nil {
+			t.Fatalf("took the policy %q", name)
+		}
+	}
+}
+
+func TestParseDetectors(t *testing.T) {
+	for _, test := range []struct {
+		spec  string
+		names []string
+	}{
+		{"rr", []string{"rr"}},
+		{"bpm,rr,buckets", []string{"bpm", "rr", "buckets"}},
+		{" bpm , rr ", []string{"bpm", "rr"}},
+		{"rr,,bpm,", []string{"rr", "bpm"}},
+		{"rr,rr", []string{"rr", "rr"}},
+	} {
+		detectors, err := ParseDetectors(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		var names []string
+		for _, detector := range detectors {
+			names = append(names, detector.Name())
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Fatalf("%q: got %v", test.spec, names)
+		}
+	}
+
+	for _, spec := range []string{"", ",", " , ", "rr,afib", "RR", "bpm;rr"} {
+		detectors, err := ParseDetectors(spec)
+		if err == nil || detectors != nil {
+			t.Fatalf("took %q as %v", spec, detectors)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package heartmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The heartserver started out with one monitor, on me. Now there can be
+// several, on several people, and it needs to know which is which: whose
+// files are whose, which detectors suit whom, and who to wake up. So the
+// firmware says who it is with a HandshakeRecord when it connects, and a
+// DevicesConfig says what to do about each device and each person.
+//
+// Firmware from before the handshake is still handled; the device is named
+// by its IP address, and the Server's defaults are used for it.
+
+// HandshakeRecord is the first record a device sends when it connects.
+//
+// It is encoded as the sample rate in millihertz as four bytes, the ADC
+// bits as one, the length of the device ID as one, the device ID, and then
+// the firmware version, so the firmware doesn't have to do any floating
+// point. Firmware that speaks a later protocol than ProtocolV1 follows the
+// firmware version with a zero byte, the protocol as one byte and the boot
+// as four; see protocol.go.
+type HandshakeRecord struct {
+	DeviceID string
+	Firmware string
+	// SampleRate is the rate in Hz the device samples at, or 0 if it
+	// doesn't say.
+	SampleRate float64
+	// ADCBits is the resolution of its samples, or 0 if it doesn't say.
+	ADCBits uint8
+	// Protocol is the latest protocol version it speaks, or 0 if it
+	// doesn't say, which means ProtocolV1.
+	Protocol uint8
+	// Boot identifies this boot of the device, so the server can tell
+	// whether its sequence numbers carry on from an earlier connection.
+	// 0 means it doesn't say.
+	Boot uint32
+}
+
+func (hr HandshakeRecord) MarshalBinary() ([]byte, error) {
+	if len(hr.DeviceID) > math.MaxUint8 {
+		return nil, errors.New("device ID too long")
+	}
+	millihertz := math.Round(hr.SampleRate * 1000)
+	if millihertz < 0 || millihertz > math.MaxUint32 {
+		return nil, fmt.Errorf("sample rate %v out of range", hr.SampleRate)
+	}
+	b := make([]byte, 6, 6+len(hr.DeviceID)+len(hr.Firmware))
+	binary.BigEndian.PutUint32(b, uint32(millihertz))
+	b[4] = hr.ADCBits
+	b[5] = uint8(len(hr.DeviceID))
+	b = append(b, hr.DeviceID...)
+	b = append(b, hr.Firmware...)
+	if hr.Protocol > ProtocolV1 {
+		if strings.IndexByte(hr.Firmware, 0) != -1 {
+			return nil, errors.New("firmware version can't contain a zero byte")
+		}
+		b = append(b, 0, hr.Protocol, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], hr.Boot)
+	}
+	return b, nil
+}
+
+func (hr *HandshakeRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 6 || len(b) < 6+int(b[5]) {
+		return errors.New("Illegal size handshake record")
+	}
+	hr.SampleRate = float64(binary.BigEndian.Uint32(b)) / 1000
+	hr.ADCBits = b[4]
+	idEnd := 6 + int(b[5])
+	hr.DeviceID = string(b[6:idEnd])
+	firmware := b[idEnd:]
+	hr.Protocol = 0
+	hr.Boot = 0
+	if zero := bytes.IndexByte(firmware, 0); zero != -1 {
+		if len(firmware) != zero+6 {
+			return errors.New("Illegal size handshake record")
+		}
+		hr.Protocol = firmware[zero+1]
+		hr.Boot = binary.BigEndian.Uint32(firmware[zero+2:])
+		firmware = firmware[:zero]
+	}
+	hr.Firmware = string(firmware)
+	return nil
+}
+
+func (hr HandshakeRecord) isRecord() {}
+
+// StreamInfo returns the stream info the handshake describes, taking
+// anything it doesn't say from the given default.
+func (hr HandshakeRecord) StreamInfo(def StreamInfoRecord) StreamInfoRecord {
+	if hr.SampleRate > 0 {
+		def.SampleRate = hr.SampleRate
+	}
+	if hr.ADCBits > 0 {
+		def.ADCBits = hr.ADCBits
+	}
+	return def
+}
+
+// DevicesConfig configures the devices and the people wearing them. It's
+// loaded from a JSON file like:
+//
+//	{"people": {
+//	     "jerf": {"notifiers": [{"type": "command",
+//	                             "command": ["mplayer", "alarm.m4a"]}]},
+//	     "mom": {"notifiers": [{"type": "smtp", ...}]}},
+//	 "devices": {
+//	     "chest-1": {"person": "jerf", "detectors": "rr,bpm"},
+//	     "chest-2": {"person": "mom", "dir": "/data/mom",
+//	                 "policy": "majority"}}}
+//
+// Anything not configured gets the Server's defaults.
+type DevicesConfig struct {
+	People  map[string]PersonConfig `json:"people,omitempty"`
+	Devices map[string]DeviceConfig `json:"devices,omitempty"`
+}
+
+// PersonConfig configures what's done about one person's alerts.
+type PersonConfig struct {
+	// Notifiers says who to tell about their alerts. Empty means the
+	// Server's Notifiers.
+	Notifiers NotifierConfigs `json:"notifiers,omitempty"`
+}
+
+// DeviceConfig configures one device.
+type DeviceConfig struct {
+	// Person is who wears it.
+	Person string `json:"person,omitempty"`
+	// Dir is where its files go. Empty means a directory named after
+	// the person and the device, under the current one.
+	Dir string `json:"dir,omitempty"`
+	// Detectors and Policy are as taken by ParseDetectors and
+	// ParsePolicy. Empty means the RateDetector's defaults.
+	Detectors string `json:"detectors,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+}
+
+// LoadDevicesConfig loads and checks the DevicesConfig in the given file.
+func LoadDevicesConfig(filename string) (*DevicesConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &DevicesConfig{}
+	err = json.NewDecoder(f).Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse device config %s: %v",
+			filename, err)
+	}
+
+	err = config.check()
+	if err != nil {
+		return nil, fmt.Errorf("in device config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+func (dc *DevicesConfig) check() error {
+	for name, person := range dc.People {
+		_, err := person.Notifiers.Notifiers(ioutil.Discard)
+		if err != nil {
+			return fmt.Errorf("person %s: %v", name, err)
+		}
+	}
+	for id, device := range dc.Devices {
+		if _, known := dc.People[device.Person]; device.Person != "" &&
+			!known {
+			return fmt.Errorf("device %s: unknown person %q", id,
+				device.Person)
+		}
+		if device.Detectors != "" {
+			_, err := ParseDetectors(device.Detectors)
+			if err != nil {
+				return fmt.Errorf("device %s: %v", id, err)
+			}
+		}
+		if device.Policy != "" {
+			_, err := ParsePolicy(device.Policy)
+			if err != nil {
+				return fmt.Errorf("device %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// device returns the configuration for the given device, with the blanks
+// filled in. It is safe to call on a nil DevicesConfig.
+func (dc *DevicesConfig) device(id string) DeviceConfig {
+	var device DeviceConfig
+	if dc != nil {
+		device = dc.Devices[id]
+	}
+	if device.Dir == "" {
+		device.Dir = filepath.Join(safeFilename(device.Person),
+			safeFilename(id))
+	}
+	return device
+}
+
+// notifiers returns the notifier configuration for the given person; nil
+// if there isn't one. It is safe to call on a nil DevicesConfig.
+func (dc *DevicesConfig) notifiers(person string) NotifierConfigs {
+	if dc == nil {
+		return nil
+	}
+	return dc.People[person].Notifiers
+}
+
+// who returns how alerts name the wearer of the given device.
+func (device DeviceConfig) who(id string) string {
+	if device.Person == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", device.Person, id)
+}
+
+// safeFilename makes the name safe to use as one element of a path; a
+// device can call itself anything.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return strings.Repeat("_", len(name))
+	}
+	return name
+}
@@ -1,58 +1,232 @@
 package heartmon
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 )
 
-// LiveHeartEvents receives the incoming live heart events. This is
-// intended for local use, as it will push a single packet for every
-// incoming heart event, which is not a great plan unless you're on
-// a local network.
+// The RateDetector publishes what it sees to an EventHub: the samples as
+// they come in, and once per heart data record a status with the BPM, the
+// detectors' verdicts and whether an alert is going. LiveHeartEvents
+// serves those out over HTTP as server-sent events, so a browser on the
+// local network can watch the trace and the status live.
+
+// SampleEvent is a run of samples.
+type SampleEvent struct {
+	// Device is the device they're from, if the RateDetector was told.
+	Device string `json:"device,omitempty"`
+	// Start is the time of Samples[0].
+	Start time.Time `json:"start"`
+	// SampleRate is the rate of the samples in Hz.
+	SampleRate float64  `json:"sample_rate"`
+	Samples    []uint16 `json:"samples"`
+	// Reset is true if these samples don't carry on from the last ones.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// StatusEvent is what the RateDetector thought of the last window.
+type StatusEvent struct {
+	// Device is the device it's about, if the RateDetector was told.
+	Device   string    `json:"device,omitempty"`
+	Time     time.Time `json:"time"`
+	BPM      float64   `json:"bpm"`
+	Quality  float64   `json:"quality"`
+	Problems []string  `json:"problems,omitempty"`
+	Findings []string  `json:"findings,omitempty"`
+	Verdict  string    `json:"verdict"`
+	// Alert is the kind of alert going, or empty if none is.
+	Alert        string `json:"alert,omitempty"`
+	AlertLevel   int    `json:"alert_level,omitempty"`
+	Acknowledged bool   `json:"acknowledged,omitempty"`
+	// SnoozedUntil is set if the alerts are snoozed.
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+}
+
+// HeartEvent is one event published to an EventHub. Exactly one of the
+// fields is set.
+type HeartEvent struct {
+	Samples *SampleEvent
+	Status  *StatusEvent
+}
+
+func (he HeartEvent) device() string {
+	if he.Samples != nil {
+		return he.Samples.Device
+	}
+	return he.Status.Device
+}
+
+// EventHub hands the events published to it out to any number of
+// subscribers. Publishing never blocks; a subscriber that falls too far
+// behind is dropped, and its channel closed.
+type EventHub struct {
+	sync.Mutex
+	subscriptions map[chan HeartEvent]struct{}
+}
+
+// NewEventHub returns a new EventHub with no subscribers.
+func NewEventHub() *EventHub {
+	return &EventHub{subscriptions: map[chan HeartEvent]struct{}{}}
+}
+
+// Subscribe returns a channel that will receive the events published from
+// now on. The channel has room for about a minute of events; a subscriber
+// that falls further behind than that will find it closed.
+func (eh *EventHub) Subscribe() chan HeartEvent {
+	eh.Lock()
+	defer eh.Unlock()
+
+	subscription := make(chan HeartEvent, 64)
+	eh.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+// Unsubscribe stops sending events to the given channel and closes it. It
+// is safe to call on a channel that has already been dropped.
+func (eh *EventHub) Unsubscribe(c chan HeartEvent) {
+	eh.Lock()
+	defer eh.Unlock()
+
+	eh.unsubscribe(c)
+}
+
+func (eh *EventHub) unsubscribe(c chan HeartEvent) {
+	if _, subscribed := eh.subscriptions[c]; subscribed {
+		delete(eh.subscriptions, c)
+		close(c)
+	}
+}
+
+// Publish sends the event to all the subscribers. It is safe to call on a
+// nil EventHub, which does nothing.
+func (eh *EventHub) Publish(event HeartEvent) {
+	if eh == nil {
+		return
+	}
+
+	eh.Lock()
+	defer eh.Unlock()
+
+	for subscriber := range eh.subscriptions {
+		select {
+		case subscriber <- event:
+		default:
+			eh.unsubscribe(subscriber)
+		}
+	}
+}
+
+// DefaultEventInterval is how often LiveHeartEvents sends batched samples
+// out.
+const DefaultEventInterval = 250 * time.Millisecond
+
+// LiveHeartEvents serves the events from an EventHub as server-sent
+// events. The samples are batched up and sent every Interval, as a
+// "samples" event; the statuses are sent as they come in, as a "status"
+// event. Both are JSON. The "device" parameter, if given, limits them to
+// the one device.
+//
+// This is intended for local use. Nothing is authenticated, and anyone who
+// can reach it can watch your heart.
 type LiveHeartEvents struct {
-	rp *MonitorReader
+	// Interval is how often to send samples. NewLiveHeartEvents sets it
+	// to DefaultEventInterval.
+	Interval time.Duration
+
+	hub *EventHub
+}
+
+// NewLiveHeartEvents returns a LiveHeartEvents serving the events from the
+// given hub.
+func NewLiveHeartEvents(hub *EventHub) *LiveHeartEvents {
+	return &LiveHeartEvents{
+		Interval: DefaultEventInterval,
+		hub:      hub,
+	}
 }
 
-func (lhe *LiveHeartEvents) ServeHttp(rw http.ResponseWriter, req *http.Request) {
+func (lhe *LiveHeartEvents) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	flusher, isFlusher := rw.(http.Flusher)
+	if !isFlusher {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
 	rw.Header().Set("Content-Type", "text/event-stream")
-	rw.WriteHeader(200)
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	events := lhe.rp.Subscribe()
+	device := req.FormValue("device")
+	events := lhe.hub.Subscribe()
+	defer lhe.hub.Unsubscribe(events)
 
-	flusher, isFlusher := rw.(http.Flusher)
+	ticker := time.NewTicker(lhe.Interval)
+	defer ticker.Stop()
 
-	inputs := make([]uint16, 0, 32)
+	// The samples since the last send. Consecutive runs are merged as
+	// long as they carry on from each other.
+	var pending []*SampleEvent
 
 	for {
-		inputs = inputs[:0]
-
-		// drain the channel, so that even if we do get a bit behind
-		// we do our best to not block the monitor goroutine. This
-		// technically is probably too fragile to deploy to a high-load
-		// cloud server or something but in this application is probably
-		// fine.
-		for {
-			select {
-			case result, ok := <-events:
-				if !ok {
-					log.Printf("LiveHeartEvents forcibly unsubscribed")
+		select {
+		case <-req.Context().Done():
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				log.Printf("LiveHeartEvents forcibly unsubscribed")
+				return
+			}
+			if device != "" && event.device() != device {
+				continue
+			}
+			if event.Samples != nil {
+				last := len(pending) - 1
+				if last >= 0 && !event.Samples.Reset &&
+					pending[last].Device == event.Samples.Device &&
+					pending[last].SampleRate == event.Samples.SampleRate {
+					pending[last].Samples = append(pending[last].Samples,
+						event.Samples.Samples...)
+				} else {
+					samples := *event.Samples
+					samples.Samples = append([]uint16(nil), samples.Samples...)
+					pending = append(pending, &samples)
+				}
+			}
+			if event.Status != nil {
+				err := writeEvent(rw, "status", event.Status)
+				if err != nil {
 					return
 				}
-				inputs = append(inputs, result)
-			default:
-				break
+				flusher.Flush()
 			}
-		}
 
-		// "lazily" use the default Go fmt.Printf format for slices
-		// of integers
-		_, err := rw.Write([]byte(fmt.Sprintf("data: %v\n\n", inputs)))
-		if err != nil {
-			return
-		}
-		if isFlusher {
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+			for _, samples := range pending {
+				err := writeEvent(rw, "samples", samples)
+				if err != nil {
+					return
+				}
+			}
 			flusher.Flush()
+			pending = pending[:0]
 		}
 	}
 }
+
+func writeEvent(rw http.ResponseWriter, name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", name, payload)
+	return err
+}
@@ -0,0 +1,216 @@
+package heartmon
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Each connection to the heartserver used to be copied byte for byte
+// through pipes to everything that wanted it. A pipe blocks until it's
+// read, so if any of them stalled, or gave up on a read error, everything
+// stopped, including writing the .hrt file, which is the one thing that
+// must never stop. Now the connection is parsed once and the records are
+// handed out through a RecordFanout, which never waits for anybody. A
+// consumer that falls behind loses records, and is told so, and the
+// losses are counted.
+
+// A RecordSource is somewhere records can be read from. A RecordReader is
+// one, and so is a RecordSubscription.
+type RecordSource interface {
+	NextRecord() (Record, error)
+}
+
+// DefaultFanoutBuffer is how many records a RecordSubscription holds by
+// default. Records come in every second or so, so that's a few minutes.
+const DefaultFanoutBuffer = 256
+
+// RecordFanout hands each record written to it to all of its
+// subscriptions. Writing never blocks; a subscription with no room left
+// drops the record.
+type RecordFanout struct {
+	sync.Mutex
+	subscriptions []*RecordSubscription
+	closed        bool
+}
+
+// NewRecordFanout returns a RecordFanout with no subscriptions.
+func NewRecordFanout() *RecordFanout {
+	return &RecordFanout{}
+}
+
+// Subscribe returns a subscription to the records written from now on,
+// holding up to the given number not yet read. The name is used to report
+// on it.
+func (rf *RecordFanout) Subscribe(name string, buffer int) *RecordSubscription {
+	rf.Lock()
+	defer rf.Unlock()
+
+	sub := &RecordSubscription{
+		name:    name,
+		fanout:  rf,
+		records: make(chan Record, buffer),
+	}
+	if rf.closed {
+		close(sub.records)
+	} else {
+		rf.subscriptions = append(rf.subscriptions, sub)
+	}
+	return sub
+}
+
+// Write hands the record to every subscription with room for it. It never
+// blocks, and never fails; it's a RecordSink so it can be written to like
+// any other. Writing to a closed RecordFanout does nothing.
+func (rf *RecordFanout) Write(r Record) error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.closed {
+		return nil
+	}
+	for _, sub := range rf.subscriptions {
+		sub.offer(r)
+	}
+	return nil
+}
+
+// Close tells the subscriptions there's nothing more coming. They get
+// io.EOF once they've read what's left.
+func (rf *RecordFanout) Close() {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.closed {
+		return
+	}
+	rf.closed = true
+	for _, sub := range rf.subscriptions {
+		close(sub.records)
+	}
+	rf.subscriptions = nil
+}
+
+// Stats returns the stats of the current subscriptions.
+func (rf *RecordFanout) Stats() []SubscriptionStats {
+	rf.Lock()
+	defer rf.Unlock()
+
+	stats := make([]SubscriptionStats, len(rf.subscriptions))
+	for idx, sub := range rf.subscriptions {
+		stats[idx] = sub.stats()
+	}
+	return stats
+}
+
+func (rf *RecordFanout) unsubscribe(sub *RecordSubscription) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	for idx, s := range rf.subscriptions {
+		if s == sub {
+			rf.subscriptions = append(rf.subscriptions[:idx],
+				rf.subscriptions[idx+1:]...)
+			close(sub.records)
+			return
+		}
+	}
+}
+
+// RecordSubscription is a RecordSource reading the records written to a
+// RecordFanout.
+//
+// If records had to be dropped because it fell behind, the next thing it
+// reads is an ErrorRecord saying so, which also tells a SampleReader the
+// samples don't carry on.
+type RecordSubscription struct {
+	name    string
+	fanout  *RecordFanout
+	records chan Record
+
+	// These are guarded by the fanout's lock.
+	delivered int64
+	dropped   int64
+	// dropped and not yet owned up to in an ErrorRecord
+	unreported int64
+}
+
+// SubscriptionStats describes how a RecordSubscription is keeping up.
+type SubscriptionStats struct {
+	Name string `json:"name"`
+	// Delivered is how many records were queued for it, including the
+	// ErrorRecords about dropped ones.
+	Delivered int64 `json:"delivered"`
+	// Dropped is how many records it lost through falling behind.
+	Dropped int64 `json:"dropped"`
+	// Queued is how many records are waiting to be read; how far behind
+	// it is right now.
+	Queued int `json:"queued"`
+}
+
+func (ss SubscriptionStats) String() string {
+	return fmt.Sprintf("%s: %d records delivered, %d dropped, %d queued",
+		ss.Name, ss.Delivered, ss.Dropped, ss.Queued)
+}
+
+// offer queues the record if there's room, owning up to any dropped
+// before it first. The fanout's lock must be held.
+func (sub *RecordSubscription) offer(r Record) {
+	if sub.unreported > 0 {
+		notice := ErrorRecord{fmt.Sprintf(
+			"%s fell behind and dropped %d records", sub.name,
+			sub.unreported)}
+		select {
+		case sub.records <- notice:
+			sub.delivered++
+			sub.unreported = 0
+		default:
+		}
+	}
+
+	if sub.unreported == 0 {
+		select {
+		case sub.records <- r:
+			sub.delivered++
+			return
+		default:
+		}
+	}
+	sub.dropped++
+	sub.unreported++
+}
+
+func (sub *RecordSubscription) stats() SubscriptionStats {
+	return SubscriptionStats{
+		Name:      sub.name,
+		Delivered: sub.delivered,
+		Dropped:   sub.dropped,
+		Queued:    len(sub.records),
+	}
+}
+
+// NextRecord returns the next record, waiting for one if need be. It
+// returns io.EOF once the fanout is closed and everything before that has
+// been read.
+func (sub *RecordSubscription) NextRecord() (Record, error) {
+	r, ok := <-sub.records
+	if !ok {
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+// Stats returns how the subscription is keeping up.
+func (sub *RecordSubscription) Stats() SubscriptionStats {
+	sub.fanout.Lock()
+	defer sub.fanout.Unlock()
+
+	return sub.stats()
+}
+
+// Close unsubscribes. A consumer that stops reading before the end should
+// call it, so the fanout doesn't go on queuing records for it, though
+// nothing waits on it if it doesn't.
+func (sub *RecordSubscription) Close() {
+	sub.fanout.unsubscribe(sub)
+}
@@ -0,0 +1,217 @@
+package heartmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The .hrt files started out as nothing but records, one after another,
+// with nothing to say what they were. Any file at all would be read as
+// records until something didn't make sense, and there was no way to
+// change the format without old code choking on it.
+//
+// Now a file starts with a header: FileMagic, then the length of the rest
+// of the header as two bytes, then the rest of it. No record has type 0,
+// so a file with a header can't be mistaken for one without, and files
+// from before the header are still read. The header says which version of
+// the format the file is in, and a little about where it came from.
+//
+// Later versions of the format may add to the end of the header, and add
+// record types. Readers ignore what they don't know of the header, and
+// skip records of types they don't know, so a newer file can still be read
+// by older code, as far as it goes, as long as all the newer version does
+// is add things. Version 3 doesn't: it keeps the heart data in a record
+// type of its own, which code from before it skips, so to that a version
+// 3 file is timestamps with no heart data in between. See compress.go.
+
+// FileMagic is what a .hrt file with a header starts with.
+var FileMagic = []byte("\x00HRT")
+
+// FileVersion is the version of the format written. In version 1, the
+// records are the same as they always were; from version 2, each record is
+// followed by its CRC-32 (IEEE), of its type, length and contents, as four
+// bytes; from version 3, heart data is compressed, as described in
+// compress.go.
+const FileVersion = uint8(3)
+
+// FileHeader is the header at the start of a .hrt file.
+//
+// It is encoded as the version as one byte, the time it was created in
+// nanoseconds as eight, and then the device ID, person and firmware, each
+// as a length byte and the string.
+type FileHeader struct {
+	// Version is the version of the format the file's in.
+	// RecordWriter.WriteHeader sets it to FileVersion if it's 0.
+	Version uint8
+	// Created is when the file was created. RecordWriter.WriteHeader
+	// sets it to now if it's zero.
+	Created time.Time
+	// DeviceID, Person and Firmware say where the records came from, if
+	// that's known.
+	DeviceID string
+	Person   string
+	Firmware string
+}
+
+func (fh FileHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 9)
+	b[0] = fh.Version
+	binary.BigEndian.PutUint64(b[1:], uint64(fh.Created.UnixNano()))
+	for _, s := range []string{fh.DeviceID, fh.Person, fh.Firmware} {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("%q too long for a file header", s)
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+func (fh *FileHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 9 {
+		return errors.New("Illegal size file header")
+	}
+	fh.Version = b[0]
+	fh.Created = time.Unix(0, int64(binary.BigEndian.Uint64(b[1:])))
+	b = b[9:]
+	for _, s := range []*string{&fh.DeviceID, &fh.Person, &fh.Firmware} {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return errors.New("Illegal size file header")
+		}
+		*s = string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	// Anything left is from a later version.
+	return nil
+}
+
+func (fh FileHeader) String() string {
+	s := fmt.Sprintf("version %d, created %s", fh.Version,
+		fh.Created.Format(time.RFC3339))
+	if fh.DeviceID != "" {
+		s += ", device " + fh.DeviceID
+	}
+	if fh.Person != "" {
+		s += ", worn by " + fh.Person
+	}
+	if fh.Firmware != "" {
+		s += ", firmware " + fh.Firmware
+	}
+	return s
+}
+
+// WriteHeader writes the file header. It must be the first thing written
+// to a file; it isn't for streams that aren't going to a file, such as a
+// connection to a heartserver.
+func (rw *RecordWriter) WriteHeader(fh FileHeader) error {
+	if fh.Version == 0 {
+		fh.Version = FileVersion
+	}
+	if fh.Created.IsZero() {
+		fh.Created = time.Now()
+	}
+	b, err := fh.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, _ = rw.buf.Write(FileMagic)
+	_ = binary.Write(rw.buf, binary.BigEndian, uint16(len(b)))
+	_, err = rw.buf.Write(b)
+	rw.checksums = fh.Version >= 2
+	rw.compress = fh.Version >= 3
+	return err
+}
+
+// Header returns the file header, or nil if the stream doesn't start with
+// one, as files from before the header don't. It can be called at any
+// time; the header is read, if it hasn't been already, before any
+// records. If files have been run together, it's the header of the one
+// being read.
+func (rr *RecordReader) Header() (*FileHeader, error) {
+	if !rr.started {
+		_, err := rr.readHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rr.header, nil
+}
+
+// readHeader reads the header, if the stream is at one, returning whether
+// it was. If there's anything wrong with it, it's left unread, unless
+// Recover is set; see damagedHeader.
+func (rr *RecordReader) readHeader() (bool, error) {
+	rr.started = true
+	magic, err := rr.buf.Peek(len(FileMagic))
+	if err == io.EOF && len(magic) < len(FileMagic) {
+		// Too short to have a header, so leave what there is to be
+		// read as records.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(magic, FileMagic) {
+		return false, nil
+	}
+
+	start := len(FileMagic) + 2
+	b, err := rr.buf.Peek(start)
+	if err != nil {
+		return rr.damagedHeader(unexpectedEOF(err))
+	}
+	size := start + int(binary.BigEndian.Uint16(b[len(FileMagic):]))
+	b, err = rr.buf.Peek(size)
+	if err != nil {
+		return rr.damagedHeader(unexpectedEOF(err))
+	}
+	header := &FileHeader{}
+	err = header.UnmarshalBinary(b[start:])
+	if err != nil {
+		return rr.damagedHeader(err)
+	}
+	rr.buf.Discard(size)
+	rr.headerAt = rr.offset
+	rr.offset += int64(size)
+	rr.header = header
+	rr.checksums = header.Version >= 2
+	return true, nil
+}
+
+// damagedHeader deals with a header that starts with FileMagic but can't be
+// read, returning the error if Recover isn't set. If it is, then without
+// the header there's no knowing the version, and reading the records as if
+// they had no CRCs would lose all of them if they do. It's most likely to
+// be a file of the current version, so that's what's assumed: the magic is
+// skipped, and the rest of the header, whatever length it is, is skipped
+// as corruption until a record turns up whose CRC matches. Header returns
+// a header with nothing but the version in it.
+func (rr *RecordReader) damagedHeader(err error) (bool, error) {
+	if !rr.Recover {
+		return false, err
+	}
+	rr.buf.Discard(len(FileMagic))
+	rr.headerAt = rr.offset
+	rr.offset += int64(len(FileMagic))
+	rr.header = &FileHeader{Version: FileVersion}
+	rr.checksums = true
+	return true, nil
+}
+
+// UnknownRecord is a record of a type this code doesn't know, from a later
+// version of the format. A RecordReader only returns them if KeepUnknown
+// is set; writing one writes it back as it was.
+type UnknownRecord struct {
+	Type byte
+	Data []byte
+}
+
+func (ur UnknownRecord) MarshalBinary() ([]byte, error) {
+	return ur.Data, nil
+}
+
+func (ur UnknownRecord) isRecord() {}
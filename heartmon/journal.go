@@ -0,0 +1,256 @@
+package heartmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Next morning I want to know what happened in the night, not just that
+// the log said "Starting alert" at some point. So the RateDetector and
+// the Alerter write what they decided into the record stream, next to the
+// heart data it was decided on: EpisodeStartRecords and EpisodeEndRecords
+// for the episodes themselves, and AlertRecords for everything the alert
+// did about them. cmd/episodes reads them back out.
+
+// A RecordSink is somewhere records can be written. A RecordWriter is
+// one.
+type RecordSink interface {
+	Write(r Record) error
+}
+
+// AlertAction is what happened to an alert.
+type AlertAction uint8
+
+const (
+	AlertStarted = AlertAction(iota)
+	AlertEscalated
+	AlertStopped
+	AlertAcknowledged
+	AlertSnoozed
+)
+
+func (aa AlertAction) String() string {
+	switch aa {
+	case AlertStarted:
+		return "started"
+	case AlertEscalated:
+		return "escalated"
+	case AlertStopped:
+		return "stopped"
+	case AlertAcknowledged:
+		return "acknowledged"
+	case AlertSnoozed:
+		return "snoozed"
+	default:
+		return fmt.Sprintf("unknown alert action %d", uint8(aa))
+	}
+}
+
+// AlertRecord records something happening to an alert.
+type AlertRecord struct {
+	Time   time.Time
+	Kind   AlertKind
+	Action AlertAction
+	Level  int
+	Detail string
+}
+
+func (ar AlertRecord) MarshalBinary() ([]byte, error) {
+	if ar.Level < 0 || ar.Level > math.MaxUint8 {
+		return nil, fmt.Errorf("alert level %d out of range", ar.Level)
+	}
+	b := make([]byte, 11, 11+len(ar.Detail))
+	binary.BigEndian.PutUint64(b, uint64(ar.Time.UnixNano()))
+	b[8] = uint8(ar.Kind)
+	b[9] = uint8(ar.Action)
+	b[10] = uint8(ar.Level)
+	return append(b, ar.Detail...), nil
+}
+
+func (ar *AlertRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 11 {
+		return errors.New("Illegal size alert record")
+	}
+	ar.Time = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	ar.Kind = AlertKind(b[8])
+	ar.Action = AlertAction(b[9])
+	ar.Level = int(b[10])
+	ar.Detail = string(b[11:])
+	return nil
+}
+
+func (ar AlertRecord) isRecord() {}
+
+// EpisodeStartRecord marks the start of an episode: a stretch of time the
+// RateDetector decided something was wrong, for long enough to raise an
+// alert about it.
+type EpisodeStartRecord struct {
+	// Start is when the episode started, which is the first of the
+	// abnormal records that led to the alert, not when the alert went
+	// off.
+	Start time.Time
+	Kind  AlertKind
+	// Detector is the detector or detectors that found it, or "quality"
+	// for a lost signal.
+	Detector string
+	// Detail is what they found.
+	Detail string
+}
+
+func (esr EpisodeStartRecord) MarshalBinary() ([]byte, error) {
+	if len(esr.Detector) > math.MaxUint8 {
+		return nil, errors.New("detector name too long")
+	}
+	b := make([]byte, 10, 10+len(esr.Detector)+len(esr.Detail))
+	binary.BigEndian.PutUint64(b, uint64(esr.Start.UnixNano()))
+	b[8] = uint8(esr.Kind)
+	b[9] = uint8(len(esr.Detector))
+	b = append(b, esr.Detector...)
+	return append(b, esr.Detail...), nil
+}
+
+func (esr *EpisodeStartRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 10 || len(b) < 10+int(b[9]) {
+		return errors.New("Illegal size episode start record")
+	}
+	esr.Start = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	esr.Kind = AlertKind(b[8])
+	detectorEnd := 10 + int(b[9])
+	esr.Detector = string(b[10:detectorEnd])
+	esr.Detail = string(b[detectorEnd:])
+	return nil
+}
+
+func (esr EpisodeStartRecord) isRecord() {}
+
+// EpisodeEndRecord marks the end of an episode. It carries everything the
+// EpisodeStartRecord did, so a summary can be had from it alone.
+type EpisodeEndRecord struct {
+	Start time.Time
+	// End is the time of the last record that backed the episode up,
+	// not when the alert stopped.
+	End  time.Time
+	Kind AlertKind
+	// PeakBPM is the highest heart rate seen during the episode, or 0
+	// if there was no usable signal.
+	PeakBPM  float64
+	Detector string
+}
+
+// Duration returns how long the episode lasted.
+func (eer EpisodeEndRecord) Duration() time.Duration {
+	return eer.End.Sub(eer.Start)
+}
+
+func (eer EpisodeEndRecord) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 25, 25+len(eer.Detector))
+	binary.BigEndian.PutUint64(b, uint64(eer.Start.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(eer.End.UnixNano()))
+	b[16] = uint8(eer.Kind)
+	binary.BigEndian.PutUint64(b[17:], math.Float64bits(eer.PeakBPM))
+	return append(b, eer.Detector...), nil
+}
+
+func (eer *EpisodeEndRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 25 {
+		return errors.New("Illegal size episode end record")
+	}
+	eer.Start = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	eer.End = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	eer.Kind = AlertKind(b[16])
+	eer.PeakBPM = math.Float64frombits(binary.BigEndian.Uint64(b[17:]))
+	eer.Detector = string(b[25:])
+	return nil
+}
+
+func (eer EpisodeEndRecord) isRecord() {}
+
+// journal writes records to a RecordSink from a goroutine of its own.
+//
+// The RateDetector usually reads the same stream its journal is being
+// written into, so if it waited for the write it could end up waiting
+// for itself to read it. Instead the records queue up, without limit;
+// there are only ever a handful.
+type journal struct {
+	sink RecordSink
+	// where errors go
+	onError func(error)
+
+	sync.Mutex
+	cond    *sync.Cond
+	pending []Record
+	closed  bool
+	done    chan struct{}
+}
+
+// newJournal returns a journal writing to the given sink. If the sink is
+// nil, the journal throws everything away.
+func newJournal(sink RecordSink, onError func(error)) *journal {
+	j := &journal{
+		sink:    sink,
+		onError: onError,
+		done:    make(chan struct{}),
+	}
+	j.cond = sync.NewCond(&j.Mutex)
+	go j.run()
+	return j
+}
+
+func (j *journal) run() {
+	defer close(j.done)
+
+	j.Lock()
+	defer j.Unlock()
+	for {
+		for len(j.pending) == 0 && !j.closed {
+			j.cond.Wait()
+		}
+		if len(j.pending) == 0 {
+			return
+		}
+
+		records := j.pending
+		j.pending = nil
+		j.Unlock()
+		for _, record := range records {
+			err := j.sink.Write(record)
+			if err != nil && j.onError != nil {
+				j.onError(err)
+			}
+		}
+		j.Lock()
+	}
+}
+
+// write queues the record to be written. It is safe to call on a nil
+// journal, which does nothing.
+func (j *journal) write(r Record) {
+	if j == nil || j.sink == nil {
+		return
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return
+	}
+	j.pending = append(j.pending, r)
+	j.cond.Signal()
+}
+
+// close writes out anything still queued and stops the journal.
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+
+	j.Lock()
+	j.closed = true
+	j.cond.Signal()
+	j.Unlock()
+	<-j.done
+}
@@ -0,0 +1,17 @@
+package heartmon
+
+import "errors"
+
+// A .hrt file mustn't be replaced while it's still being written, as
+// cmd/recompress would otherwise do; whatever's writing it carries on
+// writing to the old file, which is no longer there, and the rest of the
+// night goes with it. So the heartserver and a MonitorReader hold an
+// advisory lock on the file they're writing for as long as it's open, and
+// anything that replaces a .hrt file takes the lock first.
+//
+// LockFile itself is in lock_unix.go; elsewhere there's no lock, and
+// it's up to you not to recompress a file that's still being written.
+
+// ErrFileInUse is returned by LockFile if something else has the file
+// locked.
+var ErrFileInUse = errors.New("file is in use")
@@ -0,0 +1,19 @@
+//go:build unix
+
+package heartmon
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an advisory lock on the file, which is let go of when the
+// file is closed. It doesn't wait; if something else has the lock, it
+// returns ErrFileInUse.
+func LockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrFileInUse
+	}
+	return err
+}
@@ -1,20 +1,41 @@
 package heartmon
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // NOTE: I'm not 100% sure this first sample is perfectly normal.
 
+// MonitorReader takes the readings from a heart monitor tethered over USB,
+// one at a time, and writes them out as records once a second, the same as
+// the Wi-Fi firmware would send them.
 type MonitorReader struct {
+	// StreamInfo describes the readings. It is written at the start of
+	// the records. NewMonitorReader sets it to DefaultStreamInfo.
+	StreamInfo StreamInfoRecord
+	// Fanout gets each record once it's been written to the file, for
+	// a RateDetector and the like to subscribe to. It never waits for
+	// them, so one that stalls can't stop the file being written; see
+	// fanout.go. NewMonitorReader makes it, and it's closed when the
+	// MonitorReader is stopped.
+	Fanout *RecordFanout
+
 	outfile  string
 	incoming chan uint16
+	// records to be written in among the readings; see Write
+	records chan Record
+
+	stop     chan struct{}
+	stopOnce sync.Once
 
-	stop chan struct{}
+	// how many readings have been dropped since the last write; see Drop
+	dropped int64
 
 	sync.Mutex
 	// There's a bit of dodginess here, since if any of these block
@@ -23,6 +44,45 @@ type MonitorReader struct {
 	subscriptions []chan uint16
 }
 
+// NewMonitorReader returns a MonitorReader writing to the given file. If
+// the filename is empty, one is made up from the time the MonitorReader
+// starts serving.
+func NewMonitorReader(outfile string) *MonitorReader {
+	return &MonitorReader{
+		StreamInfo: DefaultStreamInfo(),
+		outfile:    outfile,
+		// about ten seconds' worth, so a slow write doesn't cost us
+		// readings
+		incoming: make(chan uint16, 512),
+		records:  make(chan Record),
+		stop:     make(chan struct{}),
+		Fanout:   NewRecordFanout(),
+	}
+}
+
+// Reading hands the MonitorReader a reading from the heart monitor. It
+// blocks if the MonitorReader is falling behind, and drops the reading
+// if the MonitorReader has been stopped.
+func (mr *MonitorReader) Reading(r uint16) {
+	select {
+	case mr.incoming <- r:
+	case <-mr.stop:
+	}
+}
+
+// Write writes the record into the MonitorReader's output, in among the
+// readings, which makes the MonitorReader a RecordSink suitable for a
+// RateDetector's Journal. It returns an error if the MonitorReader has
+// been stopped.
+func (mr *MonitorReader) Write(r Record) error {
+	select {
+	case mr.records <- r:
+		return nil
+	case <-mr.stop:
+		return errors.New("monitor stopped")
+	}
+}
+
 // Subscribe hands out channels that will echo the results coming back from
 // the heart monitor.
 //
@@ -62,21 +122,45 @@ func (mr *MonitorReader) Unsubscribe(c chan uint16) {
 	}
 }
 
+// Drop tells the MonitorReader that a reading was dropped on the floor
+// because it was garbled, so it can mark the gap in the output. It is safe
+// to call from any goroutine.
+func (mr *MonitorReader) Drop() {
+	atomic.AddInt64(&mr.dropped, 1)
+}
+
+// Serve collects the readings and writes them out. If it's restarted, it
+// carries on at the end of the same file, after a new header, rather than
+// starting it again.
 func (mr *MonitorReader) Serve() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	out := mr.outfile
-	if out == "" {
+	mr.Lock()
+	if mr.outfile == "" {
 		now := time.Now()
-		out = fmt.Sprintf("heart_data_starting_%s", now.Format(time.RFC3339))
+		mr.outfile = fmt.Sprintf("heart_data_starting_%s.hrt",
+			now.Format(time.RFC3339))
 	}
+	out := mr.outfile
+	mr.Unlock()
 
-	outF, err := os.Create(out)
+	outF, err := os.OpenFile(out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		panic(err)
+		log.Printf("Can't open %s: %v", out, err)
+		return
+	}
+	defer outF.Close()
+	// so it isn't recompressed out from under us; see lock.go
+	err = LockFile(outF)
+	if err != nil {
+		log.Printf("Can't lock %s: %v", out, err)
 	}
 	writer := NewRecordWriter(outF)
+	defer writer.Flush()
+	writer.WriteHeader(FileHeader{})
+	tracker := NewGapTracker(&connectionSink{archive: writer, fanout: mr.Fanout})
+	tracker.Write(mr.StreamInfo)
 
 	// if append ends up growing this, it's not a catastrophe; 210 is just
 	// a sizing guess. The grown buffer would end up reused anyhow.
@@ -103,23 +187,35 @@ func (mr *MonitorReader) Serve() {
 				}
 			}
 
+		case r := <-mr.records:
+			err := tracker.Write(r)
+			if err != nil {
+				log.Printf("Error writing: %v", err)
+			}
+
 		case _, _ = <-mr.stop:
+			mr.Fanout.Close()
 			return
 
 		case <-ticker.C:
 			if len(heartReadings) > 0 {
-				writer.WriteTimestamp()
-				writer.WriteRecord(Heartdata, HeartDataRecord{heartReadings})
-				err := writer.buf.Flush()
+				tracker.Write(TimestampRecord{time.Now()})
+				dropped := atomic.SwapInt64(&mr.dropped, 0)
+				if dropped > 0 {
+					tracker.Drop(int(dropped),
+						"garbled serial readings")
+				}
+				err := tracker.Write(HeartDataRecord{heartReadings})
 				if err != nil {
 					log.Printf("Error writing: %v", err)
 				}
-				heartReadings = heartReadings[:0]
+				heartReadings = make([]uint16, 0, 210)
 			}
 		}
 	}
 }
 
+// Stop stops the MonitorReader for good. It can be called more than once.
 func (mr *MonitorReader) Stop() {
-	close(mr.stop)
+	mr.stopOnce.Do(func() { close(mr.stop) })
 }
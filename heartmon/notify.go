@@ -0,0 +1,591 @@
+package heartmon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Notifier is something that gets told about alerts: a sound, a
+// message to somebody's phone, an email, a line in a log.
+//
+// Start is called when an alert starts, Escalate each time it escalates,
+// and Stop when it stops. Each Notifier is called from its own goroutine,
+// one call at a time, in order, so it needn't worry about locking, but
+// it should still get on with it, as the calls queue up behind it.
+type Notifier interface {
+	Name() string
+	Start(alert Alert) error
+	Escalate(alert Alert) error
+	Stop(alert Alert) error
+}
+
+// DefaultAlertSound is the sound played by the DefaultNotifiers: the one
+// named by $AFIBMON_ALERT_SOUND, or if that isn't set, the alarm clock
+// sound most Linux desktops come with.
+var DefaultAlertSound = defaultAlertSound()
+
+func defaultAlertSound() string {
+	if sound := os.Getenv("AFIBMON_ALERT_SOUND"); sound != "" {
+		return sound
+	}
+	return "/usr/share/sounds/freedesktop/stereo/alarm-clock-elapsed.oga"
+}
+
+// DefaultNotifiers are what an Alerter uses if it isn't configured
+// otherwise: log the alerts to the given writer, and play the
+// DefaultAlertSound with mplayer.
+func DefaultNotifiers(out io.Writer) []Notifier {
+	return []Notifier{
+		NewLogNotifier(out),
+		NewCommandNotifier("mplayer", DefaultAlertSound),
+	}
+}
+
+// LogNotifier writes the alerts out as lines of text.
+type LogNotifier struct {
+	out io.Writer
+}
+
+// NewLogNotifier returns a LogNotifier writing to the given writer.
+func NewLogNotifier(out io.Writer) *LogNotifier {
+	return &LogNotifier{out: out}
+}
+
+func (ln *LogNotifier) Name() string {
+	return "log"
+}
+
+func (ln *LogNotifier) Start(alert Alert) error {
+	_, err := fmt.Fprintf(ln.out, "Starting %s at %s: %s\n",
+		alert.title(), alert.Time, alert.Detail)
+	return err
+}
+
+func (ln *LogNotifier) Escalate(alert Alert) error {
+	_, err := fmt.Fprintf(ln.out, "Escalating %s to level %d at %s\n",
+		alert.title(), alert.Level, alert.Time)
+	return err
+}
+
+func (ln *LogNotifier) Stop(alert Alert) error {
+	_, err := fmt.Fprintf(ln.out, "Stopping %s at %s\n",
+		alert.title(), alert.Time)
+	return err
+}
+
+// CommandNotifier runs a command for as long as the alert is going, and
+// kills it when the alert stops. This is how the sound gets played.
+//
+// The command gets the alert in its environment, as AFIBMON_ALERT (the
+// kind), AFIBMON_LEVEL, AFIBMON_STARTED, AFIBMON_DETAIL and AFIBMON_WHO,
+// so a script can decide what to do about it.
+type CommandNotifier struct {
+	// Levels are the commands to run for each level of the alert, as the
+	// program followed by its arguments. Levels past the end run the
+	// last one. On escalation the command for the previous level is
+	// killed and the one for the new level started, so a louder sound
+	// can take over from a gentle one.
+	Levels [][]string
+
+	cmd *exec.Cmd
+}
+
+// NewCommandNotifier returns a CommandNotifier running the given command
+// at every level.
+func NewCommandNotifier(command string, args ...string) *CommandNotifier {
+	return &CommandNotifier{
+		Levels: [][]string{append([]string{command}, args...)},
+	}
+}
+
+func (cn *CommandNotifier) Name() string {
+	if len(cn.Levels) == 0 || len(cn.Levels[0]) == 0 {
+		return "command"
+	}
+	return "command " + cn.Levels[0][0]
+}
+
+func (cn *CommandNotifier) Start(alert Alert) error {
+	cn.kill()
+	return cn.run(alert)
+}
+
+func (cn *CommandNotifier) Escalate(alert Alert) error {
+	// Don't interrupt the sound for nothing if the level doesn't change
+	// what's being run.
+	if cn.cmd != nil && alert.Level >= len(cn.Levels) {
+		return nil
+	}
+	err := cn.kill()
+	if err != nil {
+		return err
+	}
+	return cn.run(alert)
+}
+
+func (cn *CommandNotifier) Stop(alert Alert) error {
+	return cn.kill()
+}
+
+func (cn *CommandNotifier) run(alert Alert) error {
+	if len(cn.Levels) == 0 {
+		return nil
+	}
+	level := alert.Level
+	if level >= len(cn.Levels) {
+		level = len(cn.Levels) - 1
+	}
+	command := cn.Levels[level]
+	if len(command) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"AFIBMON_ALERT="+alert.Kind.String(),
+		"AFIBMON_LEVEL="+strconv.Itoa(alert.Level),
+		"AFIBMON_STARTED="+alert.Started.Format(time.RFC3339),
+		"AFIBMON_DETAIL="+alert.Detail,
+		"AFIBMON_WHO="+alert.Who,
+	)
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("couldn't start %s: %v", command[0], err)
+	}
+	cn.cmd = cmd
+	return nil
+}
+
+func (cn *CommandNotifier) kill() error {
+	if cn.cmd == nil {
+		return nil
+	}
+	cmd := cn.cmd
+	cn.cmd = nil
+
+	// It may well have finished on its own by now, which is fine.
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	return nil
+}
+
+// WebhookNotifier POSTs the alerts to a URL as JSON, for pushing them on
+// to a phone or a home automation system or whatever else.
+//
+// The body is an object with "event" ("start", "escalate" or "stop"),
+// "kind", "level", "started", "time", "detail" and "who".
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier returns a WebhookNotifier posting to the given URL,
+// giving up after ten seconds.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (wn *WebhookNotifier) Name() string {
+	return "webhook " + wn.URL
+}
+
+func (wn *WebhookNotifier) Start(alert Alert) error {
+	return wn.post("start", alert)
+}
+
+func (wn *WebhookNotifier) Escalate(alert Alert) error {
+	return wn.post("escalate", alert)
+}
+
+func (wn *WebhookNotifier) Stop(alert Alert) error {
+	return wn.post("stop", alert)
+}
+
+func (wn *WebhookNotifier) post(event string, alert Alert) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event":   event,
+		"kind":    alert.Kind.String(),
+		"level":   alert.Level,
+		"started": alert.Started,
+		"time":    alert.Time,
+		"detail":  alert.Detail,
+		"who":     alert.Who,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := wn.Client.Post(wn.URL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier emails the alerts.
+type SMTPNotifier struct {
+	// Server is the host:port of the mail server.
+	Server string
+	// Username and Password, if set, are used to log in to the server.
+	Username string
+	Password string
+
+	From string
+	To   []string
+
+	// Timeout is how long sending an email may take before it's given
+	// up on; DefaultSMTPTimeout if it's 0.
+	Timeout time.Duration
+}
+
+// DefaultSMTPTimeout is how long an SMTPNotifier gives a mail server by
+// default.
+const DefaultSMTPTimeout = 30 * time.Second
+
+func (sn *SMTPNotifier) Name() string {
+	return "smtp " + strings.Join(sn.To, ",")
+}
+
+func (sn *SMTPNotifier) Start(alert Alert) error {
+	return sn.send(alert.title(),
+		fmt.Sprintf("A %s started at %s.\r\n\r\n%s\r\n",
+			alert.title(), alert.Time.Format(time.RFC1123), alert.Detail))
+}
+
+func (sn *SMTPNotifier) Escalate(alert Alert) error {
+	return sn.send(fmt.Sprintf("%s, level %d", alert.title(), alert.Level),
+		fmt.Sprintf("The %s that started at %s is still going, and "+
+			"went to level %d at %s.\r\n",
+			alert.title(), alert.Started.Format(time.RFC1123), alert.Level,
+			alert.Time.Format(time.RFC1123)))
+}
+
+func (sn *SMTPNotifier) Stop(alert Alert) error {
+	return sn.send(fmt.Sprintf("%s over", alert.title()),
+		fmt.Sprintf("The %s that started at %s stopped at %s.\r\n",
+			alert.title(), alert.Started.Format(time.RFC1123),
+			alert.Time.Format(time.RFC1123)))
+}
+
+func (sn *SMTPNotifier) send(subject, body string) error {
+	var auth smtp.Auth
+	if sn.Username != "" {
+		host, _, err := net.SplitHostPort(sn.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", sn.Username, sn.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: afibmon: %s\r\n"+
+		"Date: %s\r\n\r\n%s",
+		sn.From, strings.Join(sn.To, ", "), subject,
+		time.Now().Format(time.RFC1123Z), body)
+	return sn.sendMail(auth, []byte(msg))
+}
+
+// sendMail is smtp.SendMail, but giving up after the Timeout, which
+// smtp.SendMail never does.
+func (sn *SMTPNotifier) sendMail(auth smtp.Auth, msg []byte) error {
+	timeout := sn.Timeout
+	if timeout == 0 {
+		timeout = DefaultSMTPTimeout
+	}
+	host, _, err := net.SplitHostPort(sn.Server)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", sn.Server, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		err = c.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(sn.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range sn.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// kindFilter passes on only the alerts of the given kinds.
+type kindFilter struct {
+	Notifier
+	kinds []AlertKind
+}
+
+// ForKinds returns a Notifier that only passes on the given kinds of
+// alert to the given Notifier.
+func ForKinds(n Notifier, kinds ...AlertKind) Notifier {
+	return kindFilter{n, kinds}
+}
+
+func (kf kindFilter) wants(kind AlertKind) bool {
+	for _, k := range kf.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (kf kindFilter) Start(alert Alert) error {
+	if !kf.wants(alert.Kind) {
+		return nil
+	}
+	return kf.Notifier.Start(alert)
+}
+
+func (kf kindFilter) Escalate(alert Alert) error {
+	if !kf.wants(alert.Kind) {
+		return nil
+	}
+	return kf.Notifier.Escalate(alert)
+}
+
+func (kf kindFilter) Stop(alert Alert) error {
+	if !kf.wants(alert.Kind) {
+		return nil
+	}
+	return kf.Notifier.Stop(alert)
+}
+
+// fromLevel only passes on alerts once they've escalated to a given level.
+type fromLevel struct {
+	Notifier
+	level int
+}
+
+// FromLevel returns a Notifier that passes on alerts to the given Notifier
+// only once they have escalated to the given level. The alert starts for
+// it when it gets to that level.
+func FromLevel(n Notifier, level int) Notifier {
+	return fromLevel{n, level}
+}
+
+func (fl fromLevel) Start(alert Alert) error {
+	if alert.Level < fl.level {
+		return nil
+	}
+	return fl.Notifier.Start(alert)
+}
+
+func (fl fromLevel) Escalate(alert Alert) error {
+	switch {
+	case alert.Level < fl.level:
+		return nil
+	case alert.Level == fl.level:
+		return fl.Notifier.Start(alert)
+	default:
+		return fl.Notifier.Escalate(alert)
+	}
+}
+
+func (fl fromLevel) Stop(alert Alert) error {
+	if alert.Level < fl.level {
+		return nil
+	}
+	return fl.Notifier.Stop(alert)
+}
+
+// NotifierConfig is the configuration for one Notifier, as it appears in
+// the JSON configuration file. Which fields matter depends on the Type.
+type NotifierConfig struct {
+	// Type is one of "log", "command", "webhook" or "smtp".
+	Type string `json:"type"`
+	// Kinds, if given, limits the notifier to those kinds of alert:
+	// "af", "electrodes" or "disconnected".
+	Kinds []string `json:"kinds,omitempty"`
+	// Level, if given, holds the notifier back until the alert has
+	// escalated to that level, so someone else can be told only if I
+	// haven't dealt with it.
+	Level int `json:"level,omitempty"`
+
+	// For "command", the command to run, and optionally the commands
+	// for each escalation level after the first.
+	Command  []string   `json:"command,omitempty"`
+	Escalate [][]string `json:"escalate,omitempty"`
+
+	// For "webhook".
+	URL string `json:"url,omitempty"`
+
+	// For "smtp".
+	Server   string   `json:"server,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// Notifier returns the configured Notifier. Log notifiers write to the
+// given writer.
+func (nc NotifierConfig) Notifier(out io.Writer) (Notifier, error) {
+	var n Notifier
+	switch nc.Type {
+	case "log":
+		n = NewLogNotifier(out)
+	case "command":
+		if len(nc.Command) == 0 {
+			return nil, fmt.Errorf("command notifier has no command")
+		}
+		n = &CommandNotifier{
+			Levels: append([][]string{nc.Command}, nc.Escalate...),
+		}
+	case "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("webhook notifier has no url")
+		}
+		n = NewWebhookNotifier(nc.URL)
+	case "smtp":
+		if nc.Server == "" || nc.From == "" || len(nc.To) == 0 {
+			return nil, fmt.Errorf(
+				"smtp notifier needs a server, from and to")
+		}
+		n = &SMTPNotifier{
+			Server:   nc.Server,
+			Username: nc.Username,
+			Password: nc.Password,
+			From:     nc.From,
+			To:       nc.To,
+		}
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", nc.Type)
+	}
+
+	if nc.Level > 0 {
+		n = FromLevel(n, nc.Level)
+	}
+	if len(nc.Kinds) == 0 {
+		return n, nil
+	}
+	kinds := make([]AlertKind, len(nc.Kinds))
+	for idx, name := range nc.Kinds {
+		kind, err := ParseAlertKind(name)
+		if err != nil {
+			return nil, err
+		}
+		kinds[idx] = kind
+	}
+	return ForKinds(n, kinds...), nil
+}
+
+// NotifierConfigs is a list of notifier configurations, as read from a
+// JSON configuration file. For example:
+//
+//	[
+//	    {"type": "log"},
+//	    {"type": "command", "command": ["mplayer", "gentle.m4a"],
+//	     "escalate": [["mplayer", "loud.m4a"]], "kinds": ["af"]},
+//	    {"type": "command", "command": ["mplayer", "beep.m4a"],
+//	     "kinds": ["electrodes"]},
+//	    {"type": "webhook", "url": "http://localhost:8080/alert",
+//	     "level": 2}
+//	]
+//
+// Notifiers hold state about the alert they're working on, so every
+// Alerter needs a set of its own; that's why the configuration is kept
+// around rather than the Notifiers.
+type NotifierConfigs []NotifierConfig
+
+// LoadNotifierConfigs reads the notifier configuration from the named
+// JSON file, and checks that it makes sense.
+func LoadNotifierConfigs(filename string) (NotifierConfigs, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	configs := NotifierConfigs{}
+	err = json.NewDecoder(f).Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse notifier config %s: %v",
+			filename, err)
+	}
+
+	_, err = configs.Notifiers(ioutil.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("in notifier config %s: %v", filename, err)
+	}
+	return configs, nil
+}
+
+// Notifiers returns a new set of the configured Notifiers. Log notifiers
+// write to the given writer. A nil NotifierConfigs returns the
+// DefaultNotifiers.
+func (ncs NotifierConfigs) Notifiers(out io.Writer) ([]Notifier, error) {
+	if ncs == nil {
+		return DefaultNotifiers(out), nil
+	}
+
+	notifiers := make([]Notifier, len(ncs))
+	for idx, config := range ncs {
+		var err error
+		notifiers[idx], err = config.Notifier(out)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: %v", idx+1, err)
+		}
+	}
+	return notifiers, nil
+}
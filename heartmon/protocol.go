@@ -0,0 +1,526 @@
+package heartmon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// The firmware's original protocol, ProtocolV1, just writes records at
+// the socket. Nothing says whether they all arrived, or arrived once, or
+// arrived intact; when the Wi-Fi drops, whatever was in flight is simply
+// gone, and the first anybody knows of it is a gap in the timestamps.
+//
+// In ProtocolV2, each packet of records the device sends goes in a frame:
+//
+//	0xAF 0xF2            marker
+//	sequence number      4 bytes
+//	oldest               4 bytes
+//	length               2 bytes
+//	CRC-32 (IEEE)        4 bytes, of the header before it
+//	records              length bytes, encoded as usual
+//	CRC-32 (IEEE)        4 bytes, of everything before it
+//
+// The header gets a CRC of its own so that a corrupt length is caught
+// before the server waits for that many bytes to arrive. Otherwise, one bad
+// byte could have it sitting on up to 64K of the frames after it, without
+// acknowledging any of them, while the device sends them over and over.
+//
+// Sequence numbers start at 1 each time the device boots, and go up by one
+// a frame. The device keeps each frame until the server acknowledges it,
+// which it only does once the frame's records are safely written away,
+// and if it isn't acknowledged in time, sends it again, along with
+// everything after it. It only keeps so many; if it has to give up on
+// some, oldest tells the server the earliest it still has, so the server
+// knows the ones before that are never coming.
+//
+// The server acknowledges frames with:
+//
+//	0xAF 0xAC            marker
+//	protocol             1 byte
+//	sequence number      4 bytes, of the last frame it has all of up to
+//	CRC-32 (IEEE)        4 bytes, of everything before it
+//
+// The device asks for ProtocolV2 in its HandshakeRecord, which it sends
+// as a bare record, as in ProtocolV1. The server answers straight away with
+// an acknowledgement giving the protocol it's going to use, and the last
+// frame it already has from the same boot of the device, which, if the
+// device has reconnected, is where it should carry on from. A server that
+// doesn't answer only speaks ProtocolV1, and the device should carry on in
+// that.
+
+// The protocol versions.
+const (
+	ProtocolV1 = uint8(1)
+	ProtocolV2 = uint8(2)
+)
+
+// DefaultRetransmitWindow is how many frames a FrameWriter keeps waiting
+// for their acknowledgement by default. Frames go every two seconds or so,
+// so that's a couple of minutes; longer than that and the device may as
+// well have been off.
+const DefaultRetransmitWindow = 64
+
+// DefaultRetransmitAfter is how long a FrameWriter waits for a frame to be
+// acknowledged before sending it again by default.
+const DefaultRetransmitAfter = 10 * time.Second
+
+var (
+	frameMarker = []byte{0xAF, 0xF2}
+	ackMarker   = []byte{0xAF, 0xAC}
+)
+
+const (
+	frameHeaderSize = 2 + 4 + 4 + 2 + 4
+	frameMaxSize    = frameHeaderSize + 65535 + 4
+	ackSize         = 2 + 1 + 4 + 4
+)
+
+var (
+	errCorruptFrame = errors.New("corrupt frame")
+	errNotAFrame    = errors.New("not a frame")
+)
+
+// encodeFrame returns the frame for the given records.
+func encodeFrame(seq, oldest uint32, records []byte) []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(records)+4)
+	copy(b, frameMarker)
+	binary.BigEndian.PutUint32(b[2:], seq)
+	binary.BigEndian.PutUint32(b[6:], oldest)
+	binary.BigEndian.PutUint16(b[10:], uint16(len(records)))
+	binary.BigEndian.PutUint32(b[12:], crc32.ChecksumIEEE(b[:12]))
+	b = append(b, records...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b))
+	return append(b, crc...)
+}
+
+// Ack is an acknowledgement from the server.
+type Ack struct {
+	// Protocol is the protocol the server is using.
+	Protocol uint8
+	// Seq is the sequence number of the last frame the server has all
+	// the frames up to; 0 if it has none.
+	Seq uint32
+}
+
+func (a Ack) encode() []byte {
+	b := make([]byte, ackSize)
+	copy(b, ackMarker)
+	b[2] = a.Protocol
+	binary.BigEndian.PutUint32(b[3:], a.Seq)
+	binary.BigEndian.PutUint32(b[7:], crc32.ChecksumIEEE(b[:7]))
+	return b
+}
+
+// ReadAck reads the next acknowledgement from the server.
+func ReadAck(r io.Reader) (Ack, error) {
+	b := make([]byte, ackSize)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return Ack{}, err
+	}
+	if !bytes.Equal(b[:2], ackMarker) ||
+		binary.BigEndian.Uint32(b[7:]) != crc32.ChecksumIEEE(b[:7]) {
+		return Ack{}, errors.New("corrupt acknowledgement")
+	}
+	return Ack{Protocol: b[2], Seq: binary.BigEndian.Uint32(b[3:])}, nil
+}
+
+// FrameStats counts what a FrameReader has received.
+type FrameStats struct {
+	// Received is how many frames were received and passed on.
+	Received int64 `json:"received"`
+	// Duplicates is how many frames were received again, after they'd
+	// already been passed on.
+	Duplicates int64 `json:"duplicates"`
+	// OutOfOrder is how many frames were thrown away because a frame
+	// before them was missing. The device sends them again.
+	OutOfOrder int64 `json:"out_of_order"`
+	// Corrupt is how many times the CRC was wrong, or there was garbage
+	// where a frame should have been.
+	Corrupt int64 `json:"corrupt"`
+	// Lost is how many frames the device gave up on.
+	Lost int64 `json:"lost"`
+}
+
+func (fs FrameStats) String() string {
+	return fmt.Sprintf("%d frames received, %d duplicates, %d out of order, %d corrupt, %d lost",
+		fs.Received, fs.Duplicates, fs.OutOfOrder, fs.Corrupt, fs.Lost)
+}
+
+// FrameReader is a RecordSource reading a ProtocolV2 stream from a device,
+// acknowledging the frames as it goes. Each frame's records are passed on
+// once, in order. If frames were lost for good, that's passed on as an
+// ErrorRecord at the point they went missing.
+//
+// A frame is only acknowledged once all its records have been returned and
+// NextRecord has been called again, so the caller should have written each
+// record away before asking for the next. Then a frame the server dies
+// holding is sent again, not lost.
+type FrameReader struct {
+	r        *bufio.Reader
+	acks     io.Writer
+	protocol uint8
+
+	// the frame's records not yet returned
+	records []Record
+	// whether the last frame was corrupt, so it's skipping past it
+	resyncing bool
+
+	sync.Mutex
+	// the last frame received, and the last one whose records have all
+	// been read
+	last  uint32
+	done  uint32
+	stats FrameStats
+}
+
+// NewFrameReader returns a FrameReader reading the frames from r, after the
+// handshake, and writing the acknowledgements to acks. last is the
+// sequence number of the last frame already received from this boot of the
+// device, on an earlier connection; 0 if there wasn't one.
+func NewFrameReader(r io.Reader, acks io.Writer, last uint32) *FrameReader {
+	return &FrameReader{
+		r:        bufio.NewReaderSize(r, frameMaxSize),
+		acks:     acks,
+		protocol: ProtocolV2,
+		last:     last,
+		done:     last,
+	}
+}
+
+// Ack acknowledges every frame whose records have all been read. The
+// FrameReader does this as it goes; call it once before reading, to tell
+// the device the server speaks ProtocolV2 and where to carry on from.
+func (fr *FrameReader) Ack() error {
+	fr.Lock()
+	ack := Ack{Protocol: fr.protocol, Seq: fr.done}
+	fr.Unlock()
+
+	_, err := fr.acks.Write(ack.encode())
+	return err
+}
+
+// Last returns the sequence number of the last frame whose records have
+// all been read, which is where a reconnecting device should carry on
+// from.
+func (fr *FrameReader) Last() uint32 {
+	fr.Lock()
+	defer fr.Unlock()
+
+	return fr.done
+}
+
+// Stats returns what's been received so far.
+func (fr *FrameReader) Stats() FrameStats {
+	fr.Lock()
+	defer fr.Unlock()
+
+	return fr.stats
+}
+
+// NextRecord returns the next record, reading frames until there is one.
+// It returns io.EOF if the stream ends between frames, and
+// io.ErrUnexpectedEOF if it ends in the middle of one.
+func (fr *FrameReader) NextRecord() (Record, error) {
+	if len(fr.records) == 0 {
+		// The caller's back for more, so it's done with the frames
+		// it's had.
+		fr.Lock()
+		finished := fr.done != fr.last
+		fr.done = fr.last
+		fr.Unlock()
+		if finished {
+			err := fr.Ack()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for len(fr.records) == 0 {
+		err := fr.nextFrame()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := fr.records[0]
+	fr.records = fr.records[1:]
+	return r, nil
+}
+
+// nextFrame reads the next frame, queuing its records if it's the one
+// that comes next. Frames that aren't are acknowledged straight away, to
+// tell the device where the server's got to; the rest are acknowledged by
+// NextRecord once their records have been read.
+func (fr *FrameReader) nextFrame() error {
+	seq, oldest, payload, err := fr.readFrame()
+	switch err {
+	case nil:
+		fr.resyncing = false
+	case errCorruptFrame, errNotAFrame:
+		// Skipping what's left of a corrupt frame is the same
+		// corruption, not another.
+		if err == errCorruptFrame || !fr.resyncing {
+			fr.Lock()
+			fr.stats.Corrupt++
+			fr.Unlock()
+		}
+		fr.resyncing = err == errCorruptFrame
+		return nil
+	default:
+		return err
+	}
+
+	if oldest == 0 || oldest > seq {
+		// Sequence numbers start at 1, so the device can't still
+		// have frame 0, or one it hasn't sent yet. Taking it at its
+		// word would make everything after look like a duplicate.
+		fr.Lock()
+		fr.stats.Corrupt++
+		fr.Unlock()
+		return nil
+	}
+
+	fr.Lock()
+	switch {
+	case fr.last == 0 && fr.stats.Received == 0:
+		// The first we've heard from this boot of the device. If
+		// it's carrying on from an earlier session, the ones before
+		// oldest went there.
+		fr.last = oldest - 1
+	case oldest > fr.last+1:
+		lost := oldest - fr.last - 1
+		fr.stats.Lost += int64(lost)
+		fr.records = append(fr.records, ErrorRecord{fmt.Sprintf(
+			"frames %d to %d were lost", fr.last+1, oldest-1)})
+		fr.last = oldest - 1
+	}
+
+	switch {
+	case seq <= fr.last:
+		fr.stats.Duplicates++
+		fr.Unlock()
+		return fr.Ack()
+	case seq > fr.last+1:
+		fr.stats.OutOfOrder++
+		fr.Unlock()
+		return fr.Ack()
+	}
+	fr.last = seq
+	fr.stats.Received++
+	fr.Unlock()
+
+	// The CRC was right, so if the records don't make sense, that's
+	// how the device sent them.
+	rr := NewRecordReader(bytes.NewReader(payload))
+	for {
+		r, err := rr.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fr.records = append(fr.records, ErrorRecord{fmt.Sprintf(
+				"bad records in frame %d: %v", seq, err)})
+			break
+		}
+		fr.records = append(fr.records, r)
+	}
+	return nil
+}
+
+// readFrame reads the next frame. If there's something other than a frame
+// first, it skips it and returns errNotAFrame; if the frame isn't intact,
+// it returns errCorruptFrame.
+func (fr *FrameReader) readFrame() (seq, oldest uint32, payload []byte, err error) {
+	// Find the marker, skipping anything that isn't one.
+	skipped := false
+	for {
+		b, err := fr.r.Peek(len(frameMarker))
+		if err == io.EOF && len(b) == 0 {
+			return 0, 0, nil, io.EOF
+		}
+		if err != nil {
+			return 0, 0, nil, io.ErrUnexpectedEOF
+		}
+		if bytes.Equal(b, frameMarker) {
+			break
+		}
+		fr.r.Discard(1)
+		skipped = true
+	}
+	if skipped {
+		return 0, 0, nil, errNotAFrame
+	}
+
+	header, err := fr.r.Peek(frameHeaderSize)
+	if err != nil {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	crc := binary.BigEndian.Uint32(header[12:])
+	if crc != crc32.ChecksumIEEE(header[:12]) {
+		// Not a frame after all, or one with a header that can't be
+		// trusted to say how long it is.
+		fr.r.Discard(1)
+		return 0, 0, nil, errCorruptFrame
+	}
+	size := frameHeaderSize + int(binary.BigEndian.Uint16(header[10:])) + 4
+	frame, err := fr.r.Peek(size)
+	if err != nil {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	crc = binary.BigEndian.Uint32(frame[size-4:])
+	if crc != crc32.ChecksumIEEE(frame[:size-4]) {
+		// The next frame could start anywhere after the marker, if
+		// this one was cut off by the device restarting.
+		fr.r.Discard(1)
+		return 0, 0, nil, errCorruptFrame
+	}
+
+	seq = binary.BigEndian.Uint32(frame[2:])
+	oldest = binary.BigEndian.Uint32(frame[6:])
+	payload = append([]byte(nil), frame[frameHeaderSize:size-4]...)
+	fr.r.Discard(size)
+	return seq, oldest, payload, nil
+}
+
+// FrameWriter sends records to a heartserver in ProtocolV2, as the
+// firmware does. Records written to it are collected into a frame until
+// Flush sends it.
+//
+// The acknowledgements have to be read from the connection and handed to
+// it, which ReadAcks does.
+type FrameWriter struct {
+	// Window is the most frames kept waiting for acknowledgement. Once
+	// it's full, the oldest is given up on to make room. NewFrameWriter
+	// sets it to DefaultRetransmitWindow.
+	Window int
+	// RetransmitAfter is how long a frame waits for acknowledgement
+	// before it's sent again, along with everything after it.
+	// NewFrameWriter sets it to DefaultRetransmitAfter.
+	RetransmitAfter time.Duration
+
+	w      io.Writer
+	buf    bytes.Buffer
+	packet *RecordWriter
+	// held while writing to w, which isn't done under the main lock, so
+	// the acknowledgements can still be taken while it's blocked
+	writing sync.Mutex
+
+	sync.Mutex
+	next    uint32
+	unacked []*sentFrame
+}
+
+type sentFrame struct {
+	seq     uint32
+	records []byte
+	sent    time.Time
+}
+
+// NewFrameWriter returns a FrameWriter writing to w, starting from
+// sequence number 1.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	fw := &FrameWriter{
+		Window:          DefaultRetransmitWindow,
+		RetransmitAfter: DefaultRetransmitAfter,
+		w:               w,
+		next:            1,
+	}
+	fw.packet = NewRecordWriter(&fw.buf)
+	return fw
+}
+
+// Write adds the record to the frame being collected.
+func (fw *FrameWriter) Write(r Record) error {
+	return fw.packet.Write(r)
+}
+
+// Flush sends the records collected as a frame, if there are any, after
+// sending again any frames that have gone unacknowledged too long.
+func (fw *FrameWriter) Flush() error {
+	err := fw.packet.Flush()
+	if err != nil {
+		return err
+	}
+
+	fw.writing.Lock()
+	defer fw.writing.Unlock()
+
+	fw.Lock()
+	var out []byte
+	now := time.Now()
+	if len(fw.unacked) > 0 &&
+		now.Sub(fw.unacked[0].sent) >= fw.RetransmitAfter {
+		for _, frame := range fw.unacked {
+			out = fw.send(out, frame, now)
+		}
+	}
+
+	if fw.buf.Len() > 0 {
+		frame := &sentFrame{
+			seq:     fw.next,
+			records: append([]byte(nil), fw.buf.Bytes()...),
+		}
+		fw.buf.Reset()
+		fw.next++
+		fw.unacked = append(fw.unacked, frame)
+		if len(fw.unacked) > fw.Window {
+			fw.unacked = fw.unacked[len(fw.unacked)-fw.Window:]
+		}
+		out = fw.send(out, frame, now)
+	}
+	fw.Unlock()
+
+	if len(out) == 0 {
+		return nil
+	}
+	_, err = fw.w.Write(out)
+	return err
+}
+
+// send appends the frame to out, telling the server the oldest frame
+// still kept, and marks it as sent. The lock must be held.
+func (fw *FrameWriter) send(out []byte, frame *sentFrame, now time.Time) []byte {
+	frame.sent = now
+	return append(out, encodeFrame(frame.seq, fw.unacked[0].seq,
+		frame.records)...)
+}
+
+// Acknowledge lets go of the frames the acknowledgement covers.
+func (fw *FrameWriter) Acknowledge(ack Ack) {
+	fw.Lock()
+	defer fw.Unlock()
+
+	for len(fw.unacked) > 0 && fw.unacked[0].seq <= ack.Seq {
+		fw.unacked = fw.unacked[1:]
+	}
+}
+
+// Unacknowledged returns how many frames are waiting for acknowledgement.
+func (fw *FrameWriter) Unacknowledged() int {
+	fw.Lock()
+	defer fw.Unlock()
+
+	return len(fw.unacked)
+}
+
+// ReadAcks reads the acknowledgements from r and hands them to the
+// FrameWriter until there's an error, which it returns.
+func (fw *FrameWriter) ReadAcks(r io.Reader) error {
+	for {
+		ack, err := ReadAck(r)
+		if err != nil {
+			return err
+		}
+		fw.Acknowledge(ack)
+	}
+}
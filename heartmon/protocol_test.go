@@ -0,0 +1,356 @@
+package heartmon
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// frameOf returns a frame holding the given heart data, as a FrameWriter
+// would send it.
+func frameOf(seq, oldest uint32, data ...uint16) []byte {
+	var buf bytes.Buffer
+	rw := NewRecordWriter(&buf)
+	rw.Write(HeartDataRecord{data})
+	rw.Flush()
+	return encodeFrame(seq, oldest, buf.Bytes())
+}
+
+// readRecords reads n records from the FrameReader, failing the test if
+// that takes more than a few seconds.
+func readRecords(t *testing.T, fr *FrameReader, n int) []Record {
+	t.Helper()
+
+	records := make(chan Record)
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			r, err := fr.NextRecord()
+			if err != nil {
+				errs <- err
+				return
+			}
+			records <- r
+		}
+	}()
+
+	var got []Record
+	for len(got) < n {
+		select {
+		case r := <-records:
+			got = append(got, r)
+		case err := <-errs:
+			t.Fatalf("after %d records: %v", len(got), err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stuck after %d records: %v", len(got), got)
+		}
+	}
+	return got
+}
+
+func data(samples ...uint16) Record {
+	return HeartDataRecord{samples}
+}
+
+func TestFramesInOrder(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(frameOf(1, 1, 10, 11))
+	stream.Write(frameOf(2, 1, 12))
+	stream.Write(frameOf(3, 1, 13, 14, 15))
+
+	var acks bytes.Buffer
+	fr := NewFrameReader(&stream, &acks, 0)
+	got := readRecords(t, fr, 3)
+	expected := []Record{data(10, 11), data(12), data(13, 14, 15)}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	_, err := fr.NextRecord()
+	if err != io.EOF {
+		t.Fatalf("expected EOF at the end, got %v", err)
+	}
+
+	for seq := uint32(1); seq <= 3; seq++ {
+		ack, err := ReadAck(&acks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack.Seq != seq || ack.Protocol != ProtocolV2 {
+			t.Fatalf("expected an ack of %d, got %#v", seq, ack)
+		}
+	}
+	if acks.Len() != 0 {
+		t.Fatal("expected no more acks")
+	}
+}
+
+func TestFramesAckedOnceRead(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(2, 1, 11))
+
+	var acks bytes.Buffer
+	fr := NewFrameReader(&stream, &acks, 0)
+	readRecords(t, fr, 1)
+	// The first record could still be on its way to the file.
+	if acks.Len() != 0 || fr.Last() != 0 {
+		t.Fatal("frame 1 was acknowledged before its records were written")
+	}
+	readRecords(t, fr, 1)
+	ack, err := ReadAck(&acks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Seq != 1 || fr.Last() != 1 {
+		t.Fatalf("expected frame 1 to be acknowledged, got %#v", ack)
+	}
+}
+
+func TestCorruptFrames(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt int
+	}{
+		{"length", 10},
+		{"header CRC", 13},
+		{"records", frameHeaderSize + 2},
+		{"CRC", -1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bad := frameOf(2, 1, 11)
+			idx := test.corrupt
+			if idx < 0 {
+				idx += len(bad)
+			}
+			// For the length, this makes it big enough to wait
+			// forever for.
+			bad[idx] ^= 0xF0
+
+			// Nothing closes the stream, so a FrameReader
+			// waiting for more than was sent gets stuck.
+			r, w := io.Pipe()
+			defer w.Close()
+			go func() {
+				w.Write(frameOf(1, 1, 10))
+				w.Write(bad)
+				w.Write(frameOf(3, 1, 12))
+				w.Write(frameOf(2, 1, 11))
+				w.Write(frameOf(3, 1, 12))
+			}()
+
+			fr := NewFrameReader(r, ioutil.Discard, 0)
+			got := readRecords(t, fr, 3)
+			expected := []Record{data(10), data(11), data(12)}
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("got %v, expected %v", got, expected)
+			}
+			stats := fr.Stats()
+			if stats.Corrupt != 1 || stats.OutOfOrder != 1 ||
+				stats.Received != 3 {
+				t.Fatalf("unexpected stats: %v", stats)
+			}
+		})
+	}
+}
+
+func TestNonsenseFrames(t *testing.T) {
+	// Intact, but saying the device still has frames that can't exist.
+	var stream bytes.Buffer
+	stream.Write(frameOf(1, 0, 10))
+	stream.Write(frameOf(0, 0, 10))
+	stream.Write(frameOf(1, 2, 10))
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(2, 1, 11))
+
+	fr := NewFrameReader(&stream, ioutil.Discard, 0)
+	got := readRecords(t, fr, 2)
+	expected := []Record{data(10), data(11)}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	if stats := fr.Stats(); stats.Corrupt != 3 || stats.Received != 2 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
+
+func TestDuplicateFrames(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(2, 1, 11))
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(2, 1, 11))
+	stream.Write(frameOf(3, 1, 12))
+
+	fr := NewFrameReader(&stream, ioutil.Discard, 0)
+	got := readRecords(t, fr, 3)
+	expected := []Record{data(10), data(11), data(12)}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	if stats := fr.Stats(); stats.Duplicates != 3 || stats.Received != 3 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
+
+// sentFrames collects what a FrameWriter sends, one Flush at a time.
+type sentFrames struct {
+	bytes.Buffer
+}
+
+func (sf *sentFrames) flush(t *testing.T, fw *FrameWriter) []byte {
+	t.Helper()
+
+	err := fw.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := append([]byte(nil), sf.Bytes()...)
+	sf.Reset()
+	return sent
+}
+
+func TestWindowOverflow(t *testing.T) {
+	sent := &sentFrames{}
+	fw := NewFrameWriter(sent)
+	fw.Window = 2
+	fw.RetransmitAfter = time.Hour
+
+	var frames [][]byte
+	for i := uint16(0); i < 4; i++ {
+		fw.Write(HeartDataRecord{[]uint16{10 + i}})
+		frames = append(frames, sent.flush(t, fw))
+	}
+	if fw.Unacknowledged() != 2 {
+		t.Fatalf("expected the window to hold 2 frames, not %d",
+			fw.Unacknowledged())
+	}
+	// Frames 3 and 4 are still kept, and are sent again.
+	fw.RetransmitAfter = 0
+	retransmitted := sent.flush(t, fw)
+
+	// Frames 2 and 3 never got there the first time.
+	var stream bytes.Buffer
+	stream.Write(frames[0])
+	stream.Write(frames[3])
+	stream.Write(retransmitted)
+
+	var acks bytes.Buffer
+	fr := NewFrameReader(&stream, &acks, 0)
+	got := readRecords(t, fr, 4)
+	expected := []Record{
+		data(10),
+		ErrorRecord{"frames 2 to 2 were lost"},
+		data(12),
+		data(13),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	if stats := fr.Stats(); stats.Lost != 1 || stats.Received != 3 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+
+	var ack Ack
+	for acks.Len() > 0 {
+		var err error
+		ack, err = ReadAck(&acks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Acknowledge(ack)
+	}
+	if ack.Seq != 3 || fw.Unacknowledged() != 1 {
+		t.Fatalf("expected frame 4 to be waiting, after an ack of %d; %d are",
+			ack.Seq, fw.Unacknowledged())
+	}
+}
+
+func TestReconnectResumes(t *testing.T) {
+	// The device reconnects, not having heard that frames 1 and 2 got
+	// there, and sends them again.
+	var stream bytes.Buffer
+	stream.Write(frameOf(1, 1, 10))
+	stream.Write(frameOf(2, 1, 11))
+	stream.Write(frameOf(3, 1, 12))
+
+	var acks bytes.Buffer
+	fr := NewFrameReader(&stream, &acks, 2)
+	err := fr.Ack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := ReadAck(&acks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Seq != 2 {
+		t.Fatalf("expected the device to be told to carry on after 2, not %d",
+			ack.Seq)
+	}
+
+	got := readRecords(t, fr, 1)
+	if !reflect.DeepEqual(got, []Record{data(12)}) {
+		t.Fatalf("expected just frame 3, got %v", got)
+	}
+	if stats := fr.Stats(); stats.Duplicates != 2 || stats.Received != 1 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
+
+func TestFramesOverPipe(t *testing.T) {
+	// net.Pipe has no buffering, so the writer has to take
+	// acknowledgements while it's blocked sending.
+	device, server := net.Pipe()
+	defer device.Close()
+	defer server.Close()
+
+	fw := NewFrameWriter(device)
+	go fw.ReadAcks(device)
+
+	const frames = 200
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < frames; i++ {
+			fw.Write(HeartDataRecord{[]uint16{uint16(i)}})
+			err := fw.Flush()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	fr := NewFrameReader(server, server, 0)
+	got := readRecords(t, fr, frames)
+	for i, r := range got {
+		if !reflect.DeepEqual(r, data(uint16(i))) {
+			t.Fatalf("record %d is %v", i, r)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writer is stuck")
+	}
+
+	// The last frame is acknowledged when the next record is asked
+	// for.
+	go fr.NextRecord()
+	deadline := time.Now().Add(5 * time.Second)
+	for fw.Unacknowledged() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames were never acknowledged",
+				fw.Unacknowledged())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,470 @@
+// Package qrs implements a Pan-Tompkins style QRS detector.
+//
+// This is based on "A Real-Time QRS Detection Algorithm", Pan & Tompkins,
+// IEEE Transactions on Biomedical Engineering, 1985, with the usual
+// modifications that everybody makes: the bandpass is a pair of biquads
+// computed from the actual sample rate rather than the integer filters
+// in the paper, which were designed for 200Hz, and since we always have
+// a whole buffer in hand the filters are run forwards and backwards so
+// they don't introduce any delay we'd have to correct for later.
+//
+// The pipeline is:
+//
+//  1. Bandpass 5-15Hz, which is where most of the QRS energy lives.
+//  2. Take the derivative, to emphasize the steep slopes of the QRS.
+//  3. Square it, which makes everything positive and emphasizes the
+//     large slopes over the small ones.
+//  4. Integrate over a moving window about as wide as a QRS complex.
+//  5. Run the adaptive thresholds over the peaks of that, with a
+//     search-back for beats we missed when the gap gets suspiciously
+//     long.
+//
+// The end result is the sample index of each R peak.
+package qrs
+
+import (
+	"math"
+	"time"
+)
+
+// Beat is a single detected R peak.
+type Beat struct {
+	// Sample is the index into the input slice of the R peak.
+	Sample int
+	// Time is the time of that sample.
+	Time time.Time
+}
+
+// Detector holds the configuration of the QRS detection. It holds no
+// state between calls, so it is safe to use one from multiple goroutines.
+type Detector struct {
+	SampleRate float64
+}
+
+// New returns a new Detector for a signal sampled at the given rate in
+// Hz.
+func New(sampleRate float64) *Detector {
+	return &Detector{sampleRate}
+}
+
+// Beats returns the R peaks found in the ecg, with times computed from
+// the given start time, which is taken to be the time of ecg[0].
+func (d *Detector) Beats(ecg []uint16, start time.Time) []Beat {
+	peaks := d.Peaks(ecg)
+	beats := make([]Beat, len(peaks))
+	for idx, peak := range peaks {
+		beats[idx] = Beat{
+			Sample: peak,
+			Time:   start.Add(d.SampleDuration(peak)),
+		}
+	}
+	return beats
+}
+
+// SampleDuration returns how long the given number of samples takes.
+func (d *Detector) SampleDuration(samples int) time.Duration {
+	return time.Duration(float64(samples) / d.SampleRate * float64(time.Second))
+}
+
+// BPM returns the average heart rate implied by the given peaks, as
+// returned by Peaks. It returns 0 if there aren't at least two peaks.
+func (d *Detector) BPM(peaks []int) float64 {
+	if len(peaks) < 2 {
+		return 0
+	}
+	samples := float64(peaks[len(peaks)-1] - peaks[0])
+	if samples <= 0 {
+		return 0
+	}
+	return float64(len(peaks)-1) * 60 * d.SampleRate / samples
+}
+
+// Peaks returns the sample indices of the R peaks found in the ecg, in
+// ascending order.
+func (d *Detector) Peaks(ecg []uint16) []int {
+	fs := d.SampleRate
+	// Less than two seconds is not enough to learn thresholds from.
+	if fs <= 0 || len(ecg) < int(2*fs) {
+		return nil
+	}
+
+	filtered := d.bandpass(ecg)
+	integrated := movingIntegral(square(derivative(filtered, fs)),
+		d.samples(150*time.Millisecond))
+
+	return d.decide(filtered, integrated)
+}
+
+func (d *Detector) samples(dur time.Duration) int {
+	s := int(math.Round(dur.Seconds() * d.SampleRate))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// bandpass runs a 5Hz highpass and 15Hz lowpass over the ecg, forwards and
+// then backwards to cancel out the phase shift.
+func (d *Detector) bandpass(ecg []uint16) []float64 {
+	fs := d.SampleRate
+
+	signal := make([]float64, len(ecg))
+	mean := float64(0)
+	for _, sample := range ecg {
+		mean += float64(sample)
+	}
+	mean /= float64(len(ecg))
+	for idx, sample := range ecg {
+		signal[idx] = float64(sample) - mean
+	}
+
+	// Keep the lowpass below Nyquist, just in case someone runs this at
+	// a very low sample rate, and the highpass below the lowpass. A
+	// biquad with its cutoff past Nyquist is unstable, and just blows up.
+	low := math.Min(15, fs*0.45)
+	high := math.Min(5, low/3)
+
+	filters := []biquad{highpass(high, fs), lowpass(low, fs)}
+	for _, f := range filters {
+		f.filter(signal)
+		reverse(signal)
+		f.filter(signal)
+		reverse(signal)
+	}
+	return signal
+}
+
+// derivative uses the five-point derivative from the paper, centered on
+// the sample so it doesn't shift anything.
+func derivative(signal []float64, fs float64) []float64 {
+	out := make([]float64, len(signal))
+	at := func(i int) float64 {
+		if i < 0 {
+			return signal[0]
+		}
+		if i >= len(signal) {
+			return signal[len(signal)-1]
+		}
+		return signal[i]
+	}
+	for i := range signal {
+		out[i] = (2*at(i+1) + at(i+2) - at(i-2) - 2*at(i-1)) * fs / 8
+	}
+	return out
+}
+
+func square(signal []float64) []float64 {
+	for i, v := range signal {
+		signal[i] = v * v
+	}
+	return signal
+}
+
+// movingIntegral averages over a centered window of the given width.
+func movingIntegral(signal []float64, width int) []float64 {
+	out := make([]float64, len(signal))
+	half := width / 2
+	sum := float64(0)
+	// running sum over [i-half, i-half+width)
+	for i := 0; i < width-half && i < len(signal); i++ {
+		sum += signal[i]
+	}
+	for i := range signal {
+		out[i] = sum / float64(width)
+		if add := i + width - half; add < len(signal) {
+			sum += signal[add]
+		}
+		if drop := i - half; drop >= 0 {
+			sum -= signal[drop]
+		}
+	}
+	return out
+}
+
+// peakAt is a local maximum in the integrated signal.
+type peakAt struct {
+	idx   int
+	value float64
+	// the corresponding peak in the filtered signal
+	filtered float64
+	// the sample in the filtered signal where that peak is
+	rPeak int
+	// max slope of the filtered signal in the QRS, used to tell T waves
+	// apart from QRS complexes
+	slope float64
+}
+
+// decide runs the adaptive thresholding from the paper. The paper runs two
+// parallel sets of thresholds, one on the integrated signal and one on the
+// filtered signal, and requires a peak to pass both.
+func (d *Detector) decide(filtered, integrated []float64) []int {
+	width := d.samples(150 * time.Millisecond)
+	refractory := d.samples(200 * time.Millisecond)
+	tWaveWindow := d.samples(360 * time.Millisecond)
+	learning := d.samples(2 * time.Second)
+
+	candidates := d.localMaxima(filtered, integrated, width, refractory)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Learning phase: seed the signal peak estimates from the first two
+	// seconds, and the noise estimates from the average levels.
+	var spki, npki, spkf, npkf float64
+	for i := 0; i < learning && i < len(integrated); i++ {
+		spki = math.Max(spki, integrated[i])
+		npki += integrated[i]
+		spkf = math.Max(spkf, math.Abs(filtered[i]))
+		npkf += math.Abs(filtered[i])
+	}
+	spki /= 3
+	npki /= 2 * float64(learning)
+	spkf /= 3
+	npkf /= 2 * float64(learning)
+
+	thresholds := func() (float64, float64) {
+		return npki + 0.25*(spki-npki), npkf + 0.25*(spkf-npkf)
+	}
+
+	var qrs []peakAt
+	// The paper keeps two RR averages; the most recent eight intervals,
+	// and the most recent eight intervals that were "regular". The
+	// search-back uses the regular one, so a run of short intervals
+	// doesn't make us go looking for beats that aren't there.
+	var recentRR, regularRR []int
+	rrAverage := func(rrs []int) float64 {
+		if len(rrs) == 0 {
+			return 0
+		}
+		total := 0
+		for _, rr := range rrs {
+			total += rr
+		}
+		return float64(total) / float64(len(rrs))
+	}
+	pushRR := func(rr int) {
+		recentRR = appendLimited(recentRR, rr, 8)
+		regular := rrAverage(regularRR)
+		if regular == 0 ||
+			(float64(rr) > 0.92*regular && float64(rr) < 1.16*regular) {
+			regularRR = appendLimited(regularRR, rr, 8)
+		}
+		// If the rhythm changed wholesale, follow it.
+		if len(regularRR) == 0 {
+			regularRR = append(regularRR, recentRR...)
+		}
+	}
+
+	accept := func(p peakAt, searchBack bool) {
+		if searchBack {
+			spki = 0.25*p.value + 0.75*spki
+			spkf = 0.25*p.filtered + 0.75*spkf
+		} else {
+			spki = 0.125*p.value + 0.875*spki
+			spkf = 0.125*p.filtered + 0.875*spkf
+		}
+		if len(qrs) > 0 {
+			pushRR(p.idx - qrs[len(qrs)-1].idx)
+		}
+		qrs = append(qrs, p)
+	}
+	noise := func(p peakAt) {
+		npki = 0.125*p.value + 0.875*npki
+		npkf = 0.125*p.filtered + 0.875*npkf
+	}
+
+	// noise peaks since the last QRS, for search-back purposes
+	var noisePeaks []peakAt
+
+	for _, p := range candidates {
+		// Search back: if it's been too long since the last beat,
+		// we probably missed one, so look again at the noise peaks
+		// with half the threshold.
+		if len(qrs) > 0 {
+			avg := rrAverage(regularRR)
+			if avg == 0 {
+				avg = rrAverage(recentRR)
+			}
+			last := qrs[len(qrs)-1]
+			if avg > 0 && float64(p.idx-last.idx) > 1.66*avg {
+				t1, f1 := thresholds()
+				best := -1
+				for idx, n := range noisePeaks {
+					if n.idx-last.idx < refractory {
+						continue
+					}
+					if n.value > t1/2 && n.filtered > f1/2 &&
+						(best == -1 || n.value > noisePeaks[best].value) {
+						best = idx
+					}
+				}
+				if best != -1 {
+					accept(noisePeaks[best], true)
+				}
+				noisePeaks = noisePeaks[:0]
+			}
+		}
+
+		t1, f1 := thresholds()
+		// If the rhythm is irregular, the paper halves the
+		// thresholds to increase sensitivity.
+		if len(recentRR) > 0 && len(regularRR) > 0 {
+			rr := float64(recentRR[len(recentRR)-1])
+			regular := rrAverage(regularRR)
+			if rr < 0.92*regular || rr > 1.16*regular {
+				t1 /= 2
+				f1 /= 2
+			}
+		}
+
+		if p.value <= t1 || p.filtered <= f1 {
+			noise(p)
+			noisePeaks = append(noisePeaks, p)
+			continue
+		}
+
+		if len(qrs) > 0 {
+			last := qrs[len(qrs)-1]
+			since := p.idx - last.idx
+			if since < refractory {
+				noise(p)
+				continue
+			}
+			// Within 360ms, a peak with less than half the slope
+			// of the previous QRS is taken to be a T wave.
+			if since < tWaveWindow && p.slope < last.slope/2 {
+				noise(p)
+				noisePeaks = append(noisePeaks, p)
+				continue
+			}
+		}
+
+		accept(p, false)
+		noisePeaks = noisePeaks[:0]
+	}
+
+	peaks := make([]int, 0, len(qrs))
+	for _, p := range qrs {
+		if len(peaks) > 0 && p.rPeak <= peaks[len(peaks)-1] {
+			continue
+		}
+		peaks = append(peaks, p.rPeak)
+	}
+	return peaks
+}
+
+// localMaxima finds the peaks of the integrated signal, at least the
+// refractory period apart, and annotates them with the matching
+// features in the filtered signal.
+func (d *Detector) localMaxima(
+	filtered, integrated []float64,
+	width, refractory int,
+) []peakAt {
+	peaks := []peakAt{}
+	for i := 1; i < len(integrated)-1; i++ {
+		if integrated[i] <= integrated[i-1] ||
+			integrated[i] < integrated[i+1] {
+			continue
+		}
+		if len(peaks) > 0 && i-peaks[len(peaks)-1].idx < refractory {
+			if integrated[i] > peaks[len(peaks)-1].value {
+				peaks[len(peaks)-1] = d.annotate(filtered, i,
+					integrated[i], width)
+			}
+			continue
+		}
+		peaks = append(peaks, d.annotate(filtered, i, integrated[i], width))
+	}
+	return peaks
+}
+
+// annotate looks for the R peak in the filtered signal around the
+// integrated peak. Since everything upstream is zero-phase the QRS is
+// centered on the integrated peak, so we look a window's width either
+// side of it.
+func (d *Detector) annotate(
+	filtered []float64,
+	idx int,
+	value float64,
+	width int,
+) peakAt {
+	p := peakAt{idx: idx, value: value, rPeak: idx}
+	lo := idx - width
+	if lo < 0 {
+		lo = 0
+	}
+	hi := idx + width
+	if hi > len(filtered)-1 {
+		hi = len(filtered) - 1
+	}
+	for i := lo; i <= hi; i++ {
+		if abs := math.Abs(filtered[i]); abs > p.filtered {
+			p.filtered = abs
+			p.rPeak = i
+		}
+		if i > lo {
+			if slope := math.Abs(filtered[i] - filtered[i-1]); slope > p.slope {
+				p.slope = slope
+			}
+		}
+	}
+	return p
+}
+
+func appendLimited(s []int, v int, limit int) []int {
+	s = append(s, v)
+	if len(s) > limit {
+		s = s[len(s)-limit:]
+	}
+	return s
+}
+
+func reverse(s []float64) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// biquad is a second-order IIR filter, with coefficients from Robert
+// Bristow-Johnson's "Audio EQ Cookbook", normalized so a0 is 1.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+func (b biquad) filter(signal []float64) {
+	var x1, x2, y1, y2 float64
+	for i, x := range signal {
+		y := b.b0*x + b.b1*x1 + b.b2*x2 - b.a1*y1 - b.a2*y2
+		x2, x1 = x1, x
+		y2, y1 = y1, y
+		signal[i] = y
+	}
+}
+
+func lowpass(cutoff, fs float64) biquad {
+	w0 := 2 * math.Pi * cutoff / fs
+	cos := math.Cos(w0)
+	alpha := math.Sin(w0) / math.Sqrt2
+	a0 := 1 + alpha
+	return biquad{
+		b0: (1 - cos) / 2 / a0,
+		b1: (1 - cos) / a0,
+		b2: (1 - cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func highpass(cutoff, fs float64) biquad {
+	w0 := 2 * math.Pi * cutoff / fs
+	cos := math.Cos(w0)
+	alpha := math.Sin(w0) / math.Sqrt2
+	a0 := 1 + alpha
+	return biquad{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
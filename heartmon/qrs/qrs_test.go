@@ -0,0 +1,106 @@
+package qrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// ecg returns a synthetic ECG sampled at fs, with a beat at the given
+// rate starting half a second in, and how many beats there are in it.
+func ecg(fs, bpm float64, length time.Duration) ([]uint16, int) {
+	r := rand.New(rand.NewSource(1))
+	period := 60 / bpm
+	n := int(length.Seconds() * fs)
+	beats := int((length.Seconds()-0.5-period/2)/period) + 1
+
+	gaussian := func(t, at, width float64) float64 {
+		return math.Exp(-(t - at) * (t - at) / (2 * width * width))
+	}
+	samples := make([]uint16, n)
+	for i := range samples {
+		t := float64(i) / fs
+		v := 512 + float64(r.Intn(5)-2)
+		for beat := 0; beat < beats; beat++ {
+			at := 0.5 + float64(beat)*period
+			v += 300*gaussian(t, at, 0.012) -
+				40*gaussian(t, at-0.03, 0.01) -
+				60*gaussian(t, at+0.03, 0.01) +
+				60*gaussian(t, at+0.25*math.Sqrt(period), 0.05)
+		}
+		samples[i] = uint16(math.Round(v))
+	}
+	return samples, beats
+}
+
+func TestPeaks(t *testing.T) {
+	for _, fs := range []float64{50, 250} {
+		for _, bpm := range []float64{60, 120} {
+			samples, beats := ecg(fs, bpm, 30*time.Second)
+			d := New(fs)
+			peaks := d.Peaks(samples)
+			if len(peaks) != beats {
+				t.Fatalf("%v Hz, %v bpm: found %d beats, not %d: %v",
+					fs, bpm, len(peaks), beats, peaks)
+			}
+
+			period := 60 / bpm * fs
+			for i, peak := range peaks {
+				at := 0.5*fs + float64(i)*period
+				if math.Abs(float64(peak)-at) > 1 {
+					t.Fatalf("%v Hz, %v bpm: beat %d at sample %d, not %v",
+						fs, bpm, i, peak, at)
+				}
+				if i == 0 {
+					continue
+				}
+				if rr := float64(peak - peaks[i-1]); math.Abs(rr-period) > 1 {
+					t.Fatalf("%v Hz, %v bpm: RR of %v samples, not %v",
+						fs, bpm, rr, period)
+				}
+			}
+			if got := d.BPM(peaks); math.Abs(got-bpm) > 0.5 {
+				t.Fatalf("%v Hz: got %v bpm, not %v", fs, got, bpm)
+			}
+
+			start := time.Unix(1556595000, 0)
+			for i, beat := range d.Beats(samples, start) {
+				expected := start.Add(d.SampleDuration(peaks[i]))
+				if beat.Sample != peaks[i] || !beat.Time.Equal(expected) {
+					t.Fatalf("%v Hz, %v bpm: got beat %v, expected %v at %v",
+						fs, bpm, beat, peaks[i], expected)
+				}
+			}
+		}
+	}
+}
+
+func TestPeaksTooLittle(t *testing.T) {
+	samples, _ := ecg(50, 60, 1900*time.Millisecond)
+	if peaks := New(50).Peaks(samples); peaks != nil {
+		t.Fatalf("found %v in less than two seconds", peaks)
+	}
+	if peaks := New(0).Peaks(samples); peaks != nil {
+		t.Fatalf("found %v at 0 Hz", peaks)
+	}
+	flat := make([]uint16, 500)
+	for i := range flat {
+		flat[i] = 512
+	}
+	if peaks := New(50).Peaks(flat); len(peaks) != 0 {
+		t.Fatalf("found %v in a flatline", peaks)
+	}
+}
+
+func TestBandpassStable(t *testing.T) {
+	// Down where 5Hz is past Nyquist, the filters have to stay stable.
+	for _, fs := range []float64{4, 8, 10, 12, 20} {
+		samples, _ := ecg(fs, 60, 60*time.Second)
+		for _, v := range New(fs).bandpass(samples) {
+			if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) > 1e4 {
+				t.Fatalf("%v Hz: the bandpass blew up to %v", fs, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package heartmon
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The AD8232 has a lead-off detect, but the firmware doesn't read it, and
+// when an electrode comes loose the output doesn't go anywhere tidy. It
+// either pins to one rail or the other (the long runs of 0004 and 03f0 in
+// the sample data), sits flat, or picks up a great deal of noise and
+// wander from the loose lead flapping about. None of that is a heart
+// signal, but the beat detection will cheerfully find beats in it, and
+// they look wonderfully irregular.
+//
+// So we look at the signal itself and score how much it looks like an
+// ECG, and if it doesn't, we tell the user to check the electrodes rather
+// than either waking them up for AF or saying nothing.
+
+// QualityWindow is how much of the most recent data the signal quality is
+// judged on. It's shorter than the detection window, so that a lead
+// coming off is noticed quickly, and a lead going back on is too.
+const QualityWindow = 10 * time.Second
+
+// Thresholds for the signal quality metrics. They're guesses, not
+// measured from anything, set loose enough that a clean ECG passes with
+// room to spare; quality_test.go has the synthetic signals they're
+// checked against.
+const (
+	// More than this fraction of samples at a rail is saturated.
+	maxSaturation = 0.2
+	// More than this fraction of samples in flat runs is flatlined.
+	maxFlatline = 0.5
+	// Sample-to-sample jitter of more than this fraction of the ADC
+	// range between beats is noise. A clean signal is a count or two.
+	maxNoise = 0.02
+	// A slow swing of more than this fraction of the ADC range is
+	// baseline wander.
+	maxWander = 0.4
+	// An ECG is spiky; its kurtosis is well above that of noise, which
+	// is 3 for gaussian noise and lower for a sine.
+	minKurtosis = 4
+)
+
+// Quality is the assessment of a window of heart data.
+type Quality struct {
+	// Score runs from 0 for no usable signal to 1 for a clean one.
+	Score float64
+
+	// Saturation is the fraction of samples at or near either rail.
+	Saturation float64
+	// Flatline is the fraction of samples in runs of a half a second or
+	// more that don't change.
+	Flatline float64
+	// Noise is the median high-frequency residual after a three-point
+	// smooth, as a fraction of the ADC's range.
+	Noise float64
+	// Wander is the swing of the one-second moving average, as a
+	// fraction of the ADC's range.
+	Wander float64
+	// Kurtosis is the kurtosis of the signal, after removing the
+	// baseline.
+	Kurtosis float64
+
+	// Problems is a human-readable list of what's wrong, if anything.
+	Problems []string
+}
+
+// Good returns true if the signal is good enough to trust the detectors.
+func (q Quality) Good() bool {
+	return len(q.Problems) == 0
+}
+
+func (q Quality) String() string {
+	if q.Good() {
+		return fmt.Sprintf("signal quality %.2f", q.Score)
+	}
+	return fmt.Sprintf("signal quality %.2f: %s", q.Score,
+		strings.Join(q.Problems, ", "))
+}
+
+// AssessQuality judges the quality of the given heart data.
+func AssessQuality(samples []uint16, info StreamInfoRecord) Quality {
+	q := Quality{}
+	n := len(samples)
+	if n < 2 {
+		q.Problems = []string{"no data"}
+		return q
+	}
+
+	max := float64(info.MaxSample())
+	rate := info.SampleRate
+
+	// Saturation: within 2% of either rail.
+	margin := max / 50
+	saturated := 0
+	for _, s := range samples {
+		if float64(s) <= margin || float64(s) >= max-margin {
+			saturated++
+		}
+	}
+	q.Saturation = float64(saturated) / float64(n)
+
+	// Flatline: runs of at least half a second where the sample doesn't
+	// move by more than the ADC's noise floor of a count or so.
+	minRun := int(rate / 2)
+	if minRun < 2 {
+		minRun = 2
+	}
+	flat := 0
+	run := 1
+	for i := 1; i < n; i++ {
+		if absDiff(samples[i], samples[i-1]) <= 1 {
+			run++
+			continue
+		}
+		if run >= minRun {
+			flat += run
+		}
+		run = 1
+	}
+	if run >= minRun {
+		flat += run
+	}
+	q.Flatline = float64(flat) / float64(n)
+
+	// Kurtosis, of the signal with the one-second moving average taken
+	// out; otherwise a bit of baseline wander spreads the distribution
+	// and a perfectly good ECG stops looking spiky.
+	width := int(rate)
+	if width < 1 {
+		width = 1
+	}
+	detrended := make([]float64, n)
+	half := width / 2
+	sum := float64(0)
+	count := 0
+	lo, hi := 0, 0
+	for i := range samples {
+		for hi < n && hi <= i+half {
+			sum += float64(samples[hi])
+			hi++
+			count++
+		}
+		for lo < i-half {
+			sum -= float64(samples[lo])
+			lo++
+			count--
+		}
+		detrended[i] = float64(samples[i]) - sum/float64(count)
+	}
+
+	variance := float64(0)
+	fourth := float64(0)
+	for _, d := range detrended {
+		variance += d * d
+		fourth += d * d * d * d
+	}
+	variance /= float64(n)
+	fourth /= float64(n)
+	if variance > 0 {
+		q.Kurtosis = fourth / (variance * variance)
+	}
+
+	// Noise: the residual after a three-point smooth is the stuff near
+	// Nyquist. At our sample rates the QRS is only two or three samples
+	// wide, so it has plenty of that too; taking the median rather than
+	// the mean means the handful of samples in each QRS don't count, and
+	// we're left with what the signal is doing between beats.
+	if n > 2 {
+		residuals := make([]float64, n-2)
+		for i := 1; i < n-1; i++ {
+			smooth := (float64(samples[i-1]) + float64(samples[i]) +
+				float64(samples[i+1])) / 3
+			residuals[i-1] = math.Abs(float64(samples[i]) - smooth)
+		}
+		sort.Float64s(residuals)
+		q.Noise = residuals[len(residuals)/2] / max
+	}
+
+	// Wander: the range of the one-second moving average.
+	if width < n {
+		sum := float64(0)
+		for i := 0; i < width; i++ {
+			sum += float64(samples[i])
+		}
+		low, high := sum, sum
+		for i := width; i < n; i++ {
+			sum += float64(samples[i]) - float64(samples[i-width])
+			low = math.Min(low, sum)
+			high = math.Max(high, sum)
+		}
+		q.Wander = (high - low) / float64(width) / max
+	}
+
+	// Work out the score as how far inside the thresholds we are, with
+	// the worst metric setting the score.
+	q.Score = 1
+	penalize := func(value, limit float64, problem string, bad bool) {
+		score := 1 - value/limit
+		if bad {
+			q.Problems = append(q.Problems, problem)
+		}
+		if score < q.Score {
+			q.Score = math.Max(score, 0)
+		}
+	}
+	penalize(q.Saturation, maxSaturation, "saturated",
+		q.Saturation > maxSaturation)
+	penalize(q.Flatline, maxFlatline, "flatline",
+		q.Flatline > maxFlatline)
+	penalize(q.Noise, maxNoise, "noisy", q.Noise > maxNoise)
+	penalize(q.Wander, maxWander, "baseline wander", q.Wander > maxWander)
+	penalize(minKurtosis/math.Max(q.Kurtosis, 0.001), 1, "no QRS peaks",
+		q.Kurtosis < minKurtosis)
+
+	return q
+}
+
+func absDiff(a, b uint16) uint16 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
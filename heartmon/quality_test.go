@@ -0,0 +1,105 @@
+package heartmon
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// syntheticECG returns a QualityWindow of a clean ECG at 60 bpm: a flat
+// baseline with a count of jitter, a sharp QRS, and a T wave after it.
+func syntheticECG(info StreamInfoRecord) []float64 {
+	r := rand.New(rand.NewSource(1))
+	rate := info.SampleRate
+	n := int(rate * QualityWindow.Seconds())
+	middle := float64(info.MaxSample()) / 2
+	height := middle / 2
+
+	signal := make([]float64, n)
+	for i := range signal {
+		t := math.Mod(float64(i)/rate, 1)
+		v := middle + float64(r.Intn(3)-1)
+		// the QRS, 40ms wide
+		if qrs := math.Abs(t-0.2) / 0.02; qrs < 1 {
+			v += height * (1 - qrs)
+		}
+		// the T wave, 200ms wide
+		if tw := math.Abs(t-0.5) / 0.1; tw < 1 {
+			v += height / 6 * math.Cos(tw*math.Pi/2)
+		}
+		signal[i] = v
+	}
+	return signal
+}
+
+// samplesOf returns the signal as samples, clipped to the ADC's range.
+func samplesOf(signal []float64, info StreamInfoRecord) []uint16 {
+	samples := make([]uint16, len(signal))
+	for i, v := range signal {
+		samples[i] = uint16(math.Max(0, math.Min(math.Round(v),
+			float64(info.MaxSample()))))
+	}
+	return samples
+}
+
+func TestAssessQuality(t *testing.T) {
+	for _, info := range []StreamInfoRecord{
+		DefaultStreamInfo(),
+		{SampleRate: 250, ADCBits: 12},
+	} {
+		max := float64(info.MaxSample())
+		n := int(info.SampleRate * QualityWindow.Seconds())
+		r := rand.New(rand.NewSource(2))
+
+		clean := syntheticECG(info)
+
+		flat := make([]float64, n)
+		railed := make([]float64, n)
+		noise := make([]float64, n)
+		wander := make([]float64, n)
+		for i := range flat {
+			flat[i] = max / 2
+			railed[i] = max - float64(r.Intn(3))
+			noise[i] = max/4 + r.Float64()*max/2
+			// breathing, or a loose lead swinging, at 0.2Hz
+			wander[i] = clean[i] + max/3*math.Sin(
+				2*math.Pi*0.2*float64(i)/info.SampleRate)
+		}
+
+		for _, test := range []struct {
+			name     string
+			signal   []float64
+			problems []string
+		}{
+			{"clean ECG", clean, nil},
+			{"flatline", flat, []string{"flatline", "no QRS peaks"}},
+			{"railed", railed, []string{"saturated", "no QRS peaks"}},
+			{"white noise", noise, []string{"noisy", "no QRS peaks"}},
+			{"baseline wander", wander, []string{"baseline wander"}},
+		} {
+			q := AssessQuality(samplesOf(test.signal, info), info)
+			if !reflect.DeepEqual(q.Problems, test.problems) {
+				t.Fatalf("%v Hz, %d bits, %s: got %+v", info.SampleRate,
+					info.ADCBits, test.name, q)
+			}
+			// Good is what decides whether to say to check the
+			// electrodes.
+			if q.Good() != (test.problems == nil) {
+				t.Fatalf("%s: got %v", test.name, q)
+			}
+			if q.Good() && q.Score <= 0 || !q.Good() && q.Score != 0 {
+				t.Fatalf("%s: scored %v", test.name, q.Score)
+			}
+		}
+	}
+}
+
+func TestAssessQualityNoData(t *testing.T) {
+	for _, samples := range [][]uint16{nil, {512}} {
+		q := AssessQuality(samples, DefaultStreamInfo())
+		if q.Good() {
+			t.Fatalf("%d samples were good: %v", len(samples), q)
+		}
+	}
+}
@@ -6,17 +6,40 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"os/exec"
+	"math"
+	"strings"
 	"time"
+
+	"github.com/thejerf/afibmon/heartmon/qrs"
 )
 
 const (
-	Timestamp = byte(1)
-	Heartdata = byte(2)
-	Error     = byte(3)
+	Timestamp  = byte(1)
+	Heartdata  = byte(2)
+	Error      = byte(3)
+	StreamInfo = byte(4)
+	Gap        = byte(5)
+	// The journal records; see journal.go.
+	AlertEvent   = byte(6)
+	EpisodeStart = byte(7)
+	EpisodeEnd   = byte(8)
+	// Sent by the device when it connects; see device.go.
+	Handshake = byte(9)
+	// Heart data, compressed, from version 3 of the format; see
+	// compress.go. It's read as a HeartDataRecord.
+	CompressedHeartdata = byte(10)
 )
 
+// DefaultSampleRate is the rate in Hz at which the firmware samples the
+// heart monitor; see the delay(20) in heart_monitor.ino. It's used for
+// streams that don't start with a StreamInfoRecord.
+const DefaultSampleRate = float64(50)
+
+// DefaultADCBits is the resolution of the Arduino's analogRead.
+const DefaultADCBits = uint8(10)
+
 // This defines a simple record-based format that allows us to mark
 // timestampse periodically into the output file, while allowing us room
 // for future additions if necessary. Not sure what those would be, but
@@ -24,6 +47,10 @@ const (
 
 type RecordWriter struct {
 	buf *bufio.Writer
+	// whether each record is followed by its CRC; see WriteHeader
+	checksums bool
+	// whether heart data is compressed; see WriteHeader
+	compress bool
 }
 
 func NewRecordWriter(w io.Writer) *RecordWriter {
@@ -35,13 +62,21 @@ func NewRecordWriter(w io.Writer) *RecordWriter {
 func (rw *RecordWriter) WriteRecord(
 	recordType byte,
 	record encoding.BinaryMarshaler) error {
-	_ = rw.buf.WriteByte(recordType)
 	output, err := record.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	_ = binary.Write(rw.buf, binary.BigEndian, uint16(len(output)))
+	if len(output) > math.MaxUint16 {
+		return fmt.Errorf("record of %d bytes too long to write", len(output))
+	}
+	head := []byte{recordType, 0, 0}
+	binary.BigEndian.PutUint16(head[1:], uint16(len(output)))
+	_, _ = rw.buf.Write(head)
 	_, err = rw.buf.Write(output)
+	if err == nil && rw.checksums {
+		err = binary.Write(rw.buf, binary.BigEndian,
+			recordChecksum(head, output))
+	}
 	return err
 }
 
@@ -49,56 +84,254 @@ func (rw *RecordWriter) WriteTimestamp() error {
 	return rw.WriteRecord(Timestamp, TimestampRecord{time.Now()})
 }
 
+// Write writes the given record, working out its type from what it is.
+func (rw *RecordWriter) Write(r Record) error {
+	if hdr, isHeartData := r.(HeartDataRecord); isHeartData && rw.compress {
+		return rw.writeHeartData(hdr)
+	}
+	ty, err := recordType(r)
+	if err != nil {
+		return err
+	}
+	return rw.WriteRecord(ty, r.(encoding.BinaryMarshaler))
+}
+
+// recordType returns the record type byte for the given record.
+func recordType(r Record) (byte, error) {
+	switch r.(type) {
+	case TimestampRecord:
+		return Timestamp, nil
+	case HeartDataRecord:
+		return Heartdata, nil
+	case ErrorRecord:
+		return Error, nil
+	case StreamInfoRecord:
+		return StreamInfo, nil
+	case GapRecord:
+		return Gap, nil
+	case AlertRecord:
+		return AlertEvent, nil
+	case EpisodeStartRecord:
+		return EpisodeStart, nil
+	case EpisodeEndRecord:
+		return EpisodeEnd, nil
+	case HandshakeRecord:
+		return Handshake, nil
+	case UnknownRecord:
+		return r.(UnknownRecord).Type, nil
+	default:
+		return 0, fmt.Errorf("can't write record of type %T", r)
+	}
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (rw *RecordWriter) Flush() error {
+	return rw.buf.Flush()
+}
+
+// RecordReader reads records from a .hrt file or stream. If it starts with
+// a FileHeader, that's read first; see Header.
 type RecordReader struct {
+	// KeepUnknown makes NextRecord return records of types it doesn't
+	// know as UnknownRecords, rather than skipping them, for things
+	// like copying a file that mustn't lose anything.
+	KeepUnknown bool
+	// Recover makes NextRecord carry on past corruption rather than
+	// returning an error; see recovery.go.
+	Recover bool
+
 	buf *bufio.Reader
+	// whether the header has been looked for yet
+	started bool
+	header  *FileHeader
+	// whether each record is followed by its CRC, which it is from
+	// version 2 of the format
+	checksums bool
+	// how many bytes Recover has skipped
+	skipped int64
+	// where the next record starts in the stream, where the last one
+	// returned started, and where the header started, if there is one
+	offset   int64
+	recordAt int64
+	headerAt int64
 }
 
 func NewRecordReader(r io.Reader) *RecordReader {
-	return &RecordReader{bufio.NewReader(r)}
+	return &RecordReader{buf: bufio.NewReader(r)}
 }
 
-// FIXME: We really ought to observe the io.EOF coming in at the correct
-// location.
+// NextRecord returns the next record. Records of types it doesn't know,
+// from later versions of the format, are skipped.
+//
+// It returns io.EOF if the stream ends between records, and
+// io.ErrUnexpectedEOF if it ends in the middle of one.
 func (rr *RecordReader) NextRecord() (Record, error) {
+	if !rr.started {
+		_, err := rr.readHeader()
+		if err != nil && !rr.Recover {
+			return nil, err
+		}
+	}
+
+	for {
+		var record Record
+		var known bool
+		var err error
+		if rr.Recover {
+			record, known, err = rr.recoverRecord()
+		} else {
+			record, known, err = rr.nextRecord()
+		}
+		if err != nil || known || (record != nil && rr.KeepUnknown) {
+			return record, err
+		}
+	}
+}
+
+// nextRecord reads the next record, returning whether it's of a type it
+// knows.
+func (rr *RecordReader) nextRecord() (Record, bool, error) {
 	ty, err := rr.buf.ReadByte()
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if ty == 0 {
+		// Files that have been concatenated have headers in the
+		// middle.
+		rr.buf.UnreadByte()
+		isHeader, err := rr.readHeader()
+		if err == nil && !isHeader {
+			err = errors.New("record of type 0")
+		}
+		return nil, false, err
 	}
-	twoB := make([]byte, 2)
-	_, err = io.ReadFull(rr.buf, twoB)
+	head := []byte{ty, 0, 0}
+	_, err = io.ReadFull(rr.buf, head[1:])
 	if err != nil {
-		return nil, err
+		return nil, false, unexpectedEOF(err)
 	}
-	l := binary.BigEndian.Uint16(twoB)
+	l := binary.BigEndian.Uint16(head[1:])
 	record := make([]byte, int(l))
 	_, err = io.ReadFull(rr.buf, record)
 	if err != nil {
-		return nil, err
+		return nil, false, unexpectedEOF(err)
+	}
+	size := len(head) + len(record)
+	if rr.checksums {
+		var crc uint32
+		err = binary.Read(rr.buf, binary.BigEndian, &crc)
+		if err != nil {
+			return nil, false, unexpectedEOF(err)
+		}
+		size += 4
+		if crc != recordChecksum(head, record) {
+			return nil, false, errors.New("record fails its checksum")
+		}
+	}
+	r, known, err := decodeRecord(ty, record)
+	if err == nil {
+		rr.recordAt = rr.offset
+		rr.offset += int64(size)
+	}
+	return r, known, err
+}
+
+// Offset returns where in the stream the next record starts, counting the
+// header. After an error reading a record, it's where that record starts.
+func (rr *RecordReader) Offset() int64 {
+	return rr.offset
+}
+
+// unexpectedEOF turns an io.EOF in the middle of a record into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
+	return err
+}
+
+// recordChecksum returns the CRC of the record with the given type and
+// length, and contents.
+func recordChecksum(head, record []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(head), crc32.IEEETable, record)
+}
+
+// decodeRecord decodes the contents of a record of the given type,
+// returning whether it's a type it knows.
+func decodeRecord(ty byte, record []byte) (Record, bool, error) {
 	switch ty {
 	case Timestamp:
 		r := TimestampRecord{}
 		err := r.UnmarshalBinary(record)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return r, nil
+		return r, true, nil
 	case Heartdata:
 		r := HeartDataRecord{}
 		err := r.UnmarshalBinary(record)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return r, nil
+		return r, true, nil
 	case Error:
 		r := ErrorRecord{}
-		err = r.UnmarshalBinary(record)
+		err := r.UnmarshalBinary(record)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return r, nil
+		return r, true, nil
+	case StreamInfo:
+		r := StreamInfoRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case Gap:
+		r := GapRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case AlertEvent:
+		r := AlertRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case EpisodeStart:
+		r := EpisodeStartRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case EpisodeEnd:
+		r := EpisodeEndRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case Handshake:
+		r := HandshakeRecord{}
+		err := r.UnmarshalBinary(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return r, true, nil
+	case CompressedHeartdata:
+		data, err := decompressSamples(record)
+		if err != nil {
+			return nil, false, err
+		}
+		return HeartDataRecord{data}, true, nil
 	default:
-		return nil, errors.New("unknown record type")
+		return UnknownRecord{Type: ty, Data: record}, false, nil
 	}
 }
 
@@ -185,26 +418,182 @@ func (er *ErrorRecord) UnmarshalBinary(b []byte) error {
 
 func (er ErrorRecord) isRecord() {}
 
-// RateDetector uses a bit of a hacky approach to detect the heart rate.
+// StreamInfoRecord describes the heart data that follows it. It's written
+// at the start of a stream by whatever is recording it, since the Arduino
+// doesn't tell us.
+type StreamInfoRecord struct {
+	// SampleRate is the sample rate in Hz.
+	SampleRate float64
+	// ADCBits is the resolution of the samples; they run from 0 to
+	// 2^ADCBits - 1.
+	ADCBits uint8
+}
+
+// DefaultStreamInfo returns the StreamInfoRecord describing what the
+// firmware sends.
+func DefaultStreamInfo() StreamInfoRecord {
+	return StreamInfoRecord{DefaultSampleRate, DefaultADCBits}
+}
+
+// NewStreamInfo returns the StreamInfoRecord for the given sample rate and
+// resolution, as given on a command line, or an error if they can't be
+// right.
+func NewStreamInfo(sampleRate float64, adcBits uint) (StreamInfoRecord, error) {
+	if adcBits == 0 || adcBits > 16 {
+		return StreamInfoRecord{}, fmt.Errorf(
+			"the ADC resolution has to be from 1 to 16 bits, not %d", adcBits)
+	}
+	sir := StreamInfoRecord{SampleRate: sampleRate, ADCBits: uint8(adcBits)}
+	return sir, sir.check()
+}
+
+// check returns an error if the StreamInfoRecord can't be right.
+func (sir StreamInfoRecord) check() error {
+	if sir.SampleRate <= 0 || math.IsNaN(sir.SampleRate) ||
+		math.IsInf(sir.SampleRate, 0) {
+		return fmt.Errorf("Illegal sample rate %v", sir.SampleRate)
+	}
+	if sir.ADCBits == 0 || sir.ADCBits > 16 {
+		return fmt.Errorf("Illegal ADC resolution %d", sir.ADCBits)
+	}
+	return nil
+}
+
+// MaxSample returns the largest sample value the ADC can produce.
+func (sir StreamInfoRecord) MaxSample() uint16 {
+	return uint16(1)<<sir.ADCBits - 1
+}
+
+func (sir StreamInfoRecord) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 9)
+	binary.BigEndian.PutUint64(b, math.Float64bits(sir.SampleRate))
+	b[8] = sir.ADCBits
+	return b, nil
+}
+
+func (sir *StreamInfoRecord) UnmarshalBinary(b []byte) error {
+	if len(b) != 9 {
+		return errors.New("Illegal size stream info record")
+	}
+	sir.SampleRate = math.Float64frombits(binary.BigEndian.Uint64(b))
+	sir.ADCBits = b[8]
+	return sir.check()
+}
+
+func (sir StreamInfoRecord) isRecord() {}
+
+// GapRecord marks samples that are known to be missing from the stream,
+// so that anything looking at the waveform doesn't splice the two sides
+// together as if they were contiguous. It applies to the heart data that
+// follows it, and is written after the timestamp for that data.
+type GapRecord struct {
+	// Start is roughly when the missing samples would have started.
+	Start time.Time
+	// Duration is how much time the missing samples would have covered.
+	Duration time.Duration
+	// Reason says what we think happened.
+	Reason string
+}
+
+func (gr GapRecord) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 16, 16+len(gr.Reason))
+	binary.BigEndian.PutUint64(b, uint64(gr.Start.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(gr.Duration))
+	return append(b, gr.Reason...), nil
+}
+
+func (gr *GapRecord) UnmarshalBinary(b []byte) error {
+	if len(b) < 16 {
+		return errors.New("Illegal size gap record")
+	}
+	gr.Start = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	gr.Duration = time.Duration(binary.BigEndian.Uint64(b[8:]))
+	gr.Reason = string(b[16:])
+	return nil
+}
+
+func (gr GapRecord) isRecord() {}
+
+// RateDetector watches the heart data and drives the alerter. Once per
+// incoming heart data record it hands the last minute of data to each of
+// its Detectors, combines their findings with its Policy, and raises the
+// alert if the result has been abnormal for long enough.
+//
+// Before any of that it checks the signal quality of the most recent
+// data. If the signal isn't good enough the detectors aren't trusted,
+// the verdict is VerdictSignalLost, and if that goes on for long enough
+// it raises the check electrodes alert instead.
 type RateDetector struct {
 	WriteTimestamp bool
-	rr             *RecordReader
-	output         io.Writer
-	alerter        *Alerter
+	// Detectors are the detectors to run. NewRateDetector sets this to
+	// the DefaultDetectors.
+	Detectors []Detector
+	// Policy combines the detectors' findings. NewRateDetector sets this
+	// to AnyAbnormal.
+	Policy Policy
+	// Events, if set, gets the samples and a status for each record as
+	// they're processed.
+	Events *EventHub
+	// Device names the device in the events, when there's more than one
+	// publishing to the same EventHub.
+	Device string
+	// Alerter is told when to start and stop alerting. Set its
+	// Notifiers to change who gets told.
+	Alerter *Alerter
+	// Journal, if set, gets the EpisodeStartRecords, EpisodeEndRecords
+	// and AlertRecords. It's written to from another goroutine, and may
+	// be the stream the RateDetector is reading.
+	Journal RecordSink
+	// Snapshots, if set, is given the samples and told about each alert,
+	// to write snapshots of the ECG around them.
+	Snapshots *Snapshotter
+
+	sr         *SampleReader
+	output     io.Writer
+	streamInfo StreamInfoRecord
+	quality    Quality
 
 	buffer []uint16
+
+	journal *journal
+	// the episode going on, if any
+	episode *episode
 }
 
-// NewRateDetector returns a new RateDetector.
+// episode is what the RateDetector knows about an episode while it's
+// going on.
+type episode struct {
+	start   EpisodeStartRecord
+	end     time.Time
+	peakBPM float64
+}
+
+// How many consecutive records must be abnormal before the AF alert is
+// raised, how many must have lost the signal before the check electrodes
+// alert is, and how many must not back up an alert that's going before it
+// stops. Records come in every two or three seconds.
+const (
+	afAlertAfter         = 20
+	electrodesAlertAfter = 10
+	alertClearAfter      = 10
+)
+
+// NewRateDetector returns a new RateDetector reading the records from r
+// and logging to w.
 func NewRateDetector(r io.Reader, w io.Writer) *RateDetector {
-	alerter := NewAlerter(w)
+	return NewRecordRateDetector(NewRecordReader(r), w)
+}
 
+// NewRecordRateDetector returns a new RateDetector reading the records
+// from the given RecordSource and logging to w.
+func NewRecordRateDetector(src RecordSource, w io.Writer) *RateDetector {
 	return &RateDetector{
-		false,
-		NewRecordReader(r),
-		w,
-		alerter,
-		nil,
+		Detectors:  DefaultDetectors(),
+		Policy:     AnyAbnormal,
+		sr:         NewSampleReader(src),
+		output:     w,
+		Alerter:    NewAlerter(w),
+		streamInfo: DefaultStreamInfo(),
 	}
 }
 
@@ -212,143 +601,303 @@ func NewRateDetector(r io.Reader, w io.Writer) *RateDetector {
 // stream it through, reporting when all the alerts would have been.
 
 func (rr *RateDetector) Run() {
-	consequetiveBad := 0
-	limit := 90
+	defer rr.Alerter.Close()
 
-	lastTime := time.Time{}
+	rr.journal = newJournal(rr.Journal, func(err error) {
+		fmt.Fprintf(rr.output, "Can't write to the journal: %v\n", err)
+	})
+	defer rr.journal.close()
+	rr.Alerter.setJournal(rr.journal)
+	defer rr.Snapshots.Close()
 
-	for {
-		record, err := rr.rr.NextRecord()
+	consequetiveBad := 0
+	consequetiveLost := 0
+	consequetiveClear := 0
+	// when the current runs of abnormal and lost records started
+	var badSince, lostSince time.Time
+	// the time of the last record
+	var now time.Time
 
-		keep := 50*60 + 1
+	for {
+		block, err := rr.sr.NextBlock()
 
-		if err == io.EOF {
-			return
-		}
 		if err != nil {
-			fmt.Fprintf(rr.output, "Can't read from stream: %v\n", err)
+			if err != io.EOF {
+				fmt.Fprintf(rr.output, "Can't read from stream: %v\n", err)
+			}
+			// Nobody's watching any more, so there's nothing left to
+			// alert about.
+			rr.endEpisode()
+			rr.Alerter.Stop(now)
 			return
 		}
 
-		switch r := record.(type) {
-		case TimestampRecord:
-			fmt.Fprintf(rr.output, "Time: %s\n",
-				r.Time.Format(time.RFC1123),
-			)
-			lastTime = r.Time
-		case ErrorRecord:
-			// Reset the buffer due to error
+		if block.StreamInfo != rr.streamInfo {
+			fmt.Fprintf(rr.output, "Stream: %v Hz, %d bits\n",
+				block.StreamInfo.SampleRate, block.StreamInfo.ADCBits)
+			rr.streamInfo = block.StreamInfo
+		}
+		if block.Gap > 0 {
+			fmt.Fprintf(rr.output, "Gap of %s in the data\n", block.Gap)
+		}
+		if block.Reset {
 			rr.buffer = []uint16{}
+		}
 
-		case HeartDataRecord:
-			rr.buffer = append(rr.buffer, r.Data...)
-			// trim to 60 seconds + 1 sample assuming 50Hz sample rate
-			samples := len(rr.buffer)
-			if samples > keep {
-				rr.buffer = rr.buffer[samples-keep:]
-			}
+		now = block.End()
+		fmt.Fprintf(rr.output, "Time: %s\n", now.Format(time.RFC1123))
+
+		rr.Events.Publish(HeartEvent{Samples: &SampleEvent{
+			Device:     rr.Device,
+			Start:      block.Start,
+			SampleRate: rr.streamInfo.SampleRate,
+			Samples:    block.Data,
+			Reset:      block.Reset,
+		}})
+
+		rr.Snapshots.Add(block)
+
+		rr.buffer = append(rr.buffer, block.Data...)
+		// trim to 60 seconds + 1 sample
+		keep := int(rr.streamInfo.SampleRate)*60 + 1
+		samples := len(rr.buffer)
+		if samples > keep {
+			rr.buffer = rr.buffer[samples-keep:]
+		}
 
-			bpm := DetectHeartbeats(rr.buffer)
+		// The block's timing is good enough to extend back over the
+		// buffer, since anything that would have made it otherwise
+		// would also have reset the buffer.
+		start := block.Start.Add(
+			-time.Duration(len(rr.buffer)-len(block.Data)) * block.Interval)
+		window := NewWindow(rr.buffer, start, rr.streamInfo.SampleRate)
 
-			fmt.Fprintf(rr.output, "Beats per minute: %d\n",
-				bpm)
+		rr.quality = AssessQuality(rr.recent(), rr.streamInfo)
+		fmt.Fprintln(rr.output, rr.quality)
 
-			if bpm > limit {
-				consequetiveBad++
-			} else {
-				consequetiveBad = 0
-			}
+		verdict := VerdictSignalLost
+		var findings []Finding
+		if rr.quality.Good() {
+			verdict, findings = rr.detect(window)
+		}
 
-			if consequetiveBad > 20 {
-				rr.alerter.Alert(lastTime)
-			} else {
-				rr.alerter.Stop(lastTime)
+		// A lost signal neither counts towards the AF alert nor
+		// against it; we just don't know. But it can't count towards
+		// it, or a loose electrode flapping about would wake me up
+		// for AF.
+		switch {
+		case verdict == VerdictSignalLost:
+			if consequetiveLost == 0 {
+				lostSince = now
+			}
+			consequetiveLost++
+			consequetiveBad = 0
+		case verdict.Abnormal():
+			if consequetiveBad == 0 {
+				badSince = now
 			}
+			consequetiveBad++
+			consequetiveLost = 0
+		default:
+			consequetiveBad = 0
+			consequetiveLost = 0
 		}
-	}
-}
 
-var stateNormal = 0
-var stateLow = 1
+		// Once an alert is going, it takes a run of records that
+		// don't back it up to stop it, so one normal record in the
+		// middle of an episode doesn't cancel it.
+		kind, alerting := rr.Alerter.Active()
+		if alerting && supports(kind, verdict) {
+			consequetiveClear = 0
+		} else {
+			consequetiveClear++
+		}
 
-func DetectHeartbeats(ecg []uint16) int {
-	// now, do our crappy heartbeat detection:
-	// 1. Take simple derivative of the heartbeat rate.
-	// 2. Look for anything that is < -100 with a > 100 value 1 or
-	//    2 in front of it.
-	// 3. Call that a heartbeat.
-	// Based on just eyeballing it, it's not necessarily that bad.
-	//
-	// It turns out that this is decent at detecting normal heartbeats, but
-	// if you apply it to the moments I seem to be fibrellating, it tends
-	// to false positive high. However, under the circumstances... that's
-	// not all bad....
-
-	state := stateNormal
-
-	derivative := make([]int16, len(ecg)-1)
-	heartbeats := 0
-	for idx := range ecg {
-		if idx == 0 {
-			continue
+		switch {
+		case consequetiveBad > afAlertAfter:
+			consequetiveClear = 0
+			detail := summarize(findings)
+			rr.startEpisode(now, EpisodeStartRecord{
+				Start:    badSince,
+				Kind:     AlertAF,
+				Detector: abnormalDetectors(findings),
+				Detail:   detail,
+			})
+			rr.Alerter.Alert(AlertAF, now, detail)
+		case consequetiveLost > electrodesAlertAfter:
+			consequetiveClear = 0
+			rr.startEpisode(now, EpisodeStartRecord{
+				Start:    lostSince,
+				Kind:     AlertCheckElectrodes,
+				Detector: "quality",
+				Detail:   rr.quality.String(),
+			})
+			rr.Alerter.Alert(AlertCheckElectrodes, now,
+				rr.quality.String())
+		case alerting && consequetiveClear <= alertClearAfter:
+			// keep it going, and give it the chance to escalate
+			rr.Alerter.Alert(kind, now, "")
+		default:
+			rr.endEpisode()
+			rr.Alerter.Stop(now)
 		}
 
-		derivative[idx-1] = int16(ecg[idx]) - int16(ecg[idx-1])
+		bpm := float64(0)
+		if rr.quality.Good() {
+			bpm = windowBPM(window)
+		}
+		if rr.episode != nil && supports(rr.episode.start.Kind, verdict) {
+			rr.episode.end = now
+			rr.episode.peakBPM = math.Max(rr.episode.peakBPM, bpm)
+		}
 
-		switch state {
-		case stateNormal:
-			if derivative[idx-1] < -50 {
-				heartbeats++
-				state = stateLow
-			}
+		if rr.Events != nil {
+			rr.Events.Publish(HeartEvent{
+				Status: rr.status(now, bpm, verdict, findings),
+			})
+		}
+	}
+}
 
-		case stateLow:
-			if derivative[idx-1] > 25 {
-				state = stateNormal
-			}
+// supports returns true if the verdict backs up the given kind of alert.
+func supports(kind AlertKind, verdict Verdict) bool {
+	switch kind {
+	case AlertAF:
+		return verdict.Abnormal()
+	case AlertCheckElectrodes:
+		return verdict == VerdictSignalLost
+	default:
+		return false
+	}
+}
+
+// startEpisode starts the given episode as of now, unless one of the same
+// kind is already going. If one of a different kind is going, it's ended.
+func (rr *RateDetector) startEpisode(now time.Time, start EpisodeStartRecord) {
+	if rr.episode != nil {
+		if rr.episode.start.Kind == start.Kind {
+			return
 		}
+		rr.endEpisode()
 	}
 
-	return heartbeats
+	rr.episode = &episode{start: start, end: start.Start}
+	rr.journal.write(start)
+	rr.Snapshots.Trigger(now, start.Kind, start.Detail)
 }
 
-type Alerter struct {
-	playing   bool
-	logstream io.Writer
+// endEpisode ends the episode going on, if any.
+func (rr *RateDetector) endEpisode() {
+	if rr.episode == nil {
+		return
+	}
 
-	cmd *exec.Cmd
+	rr.journal.write(EpisodeEndRecord{
+		Start:    rr.episode.start.Start,
+		End:      rr.episode.end,
+		Kind:     rr.episode.start.Kind,
+		PeakBPM:  rr.episode.peakBPM,
+		Detector: rr.episode.start.Detector,
+	})
+	rr.episode = nil
 }
 
-func NewAlerter(out io.Writer) *Alerter {
-	return &Alerter{logstream: out}
+// windowBPM returns the average heart rate over the window.
+func windowBPM(window *Window) float64 {
+	beats := window.Beats()
+	peaks := make([]int, len(beats))
+	for idx, beat := range beats {
+		peaks[idx] = beat.Sample
+	}
+	return window.QRS().BPM(peaks)
 }
 
-func (a *Alerter) Alert(now time.Time) {
-	if a.cmd != nil {
-		return
+// status returns the StatusEvent for the latest window.
+func (rr *RateDetector) status(
+	now time.Time,
+	bpm float64,
+	verdict Verdict,
+	findings []Finding,
+) *StatusEvent {
+	status := &StatusEvent{
+		Device:   rr.Device,
+		Time:     now,
+		BPM:      bpm,
+		Quality:  rr.quality.Score,
+		Problems: rr.quality.Problems,
+		Verdict:  verdict.String(),
+	}
+	for _, finding := range findings {
+		status.Findings = append(status.Findings, finding.String())
+	}
+	state := rr.Alerter.State()
+	if state.Active {
+		status.Alert = state.Alert.Kind.String()
+		status.AlertLevel = state.Alert.Level
+		status.Acknowledged = state.Acknowledged
 	}
+	if state.Snoozed {
+		status.SnoozedUntil = &state.SnoozedUntil
+	}
+	return status
+}
 
-	fmt.Fprintf(a.logstream, "Starting alert at %s\n", now)
+// summarize returns the abnormal findings as a human-readable string.
+func summarize(findings []Finding) string {
+	abnormal := []string{}
+	for _, finding := range findings {
+		if finding.Verdict.Abnormal() {
+			abnormal = append(abnormal, finding.String())
+		}
+	}
+	return strings.Join(abnormal, "; ")
+}
 
-	a.cmd = exec.Command("mplayer", "/home/jerf/StormSounds.m4a")
-	err := a.cmd.Start()
-	if err != nil {
-		fmt.Fprintf(a.logstream, "Couldn't start audio: %v\n", err)
-		a.cmd = nil
+// abnormalDetectors returns the names of the detectors with abnormal
+// findings.
+func abnormalDetectors(findings []Finding) string {
+	names := []string{}
+	for _, finding := range findings {
+		if finding.Verdict.Abnormal() {
+			names = append(names, finding.Detector)
+		}
 	}
+	return strings.Join(names, ",")
 }
 
-func (a *Alerter) Stop(now time.Time) {
-	if a.cmd == nil {
-		return
+// recent returns the last QualityWindow of the buffer.
+func (rr *RateDetector) recent() []uint16 {
+	n := int(rr.streamInfo.SampleRate * QualityWindow.Seconds())
+	if len(rr.buffer) <= n {
+		return rr.buffer
 	}
+	return rr.buffer[len(rr.buffer)-n:]
+}
 
-	fmt.Fprintf(a.logstream, "Stopping alert at %s\n", now)
+// Quality returns the signal quality of the most recent data, as of the
+// last heart data record processed.
+func (rr *RateDetector) Quality() Quality {
+	return rr.quality
+}
 
-	err := a.cmd.Process.Kill()
-	if err != nil {
-		fmt.Fprintf(a.logstream, "Can't kill mplayer: %s\n", err)
+// detect runs all the detectors over the window and combines their
+// findings.
+func (rr *RateDetector) detect(window *Window) (Verdict, []Finding) {
+	findings := make([]Finding, len(rr.Detectors))
+	for idx, detector := range rr.Detectors {
+		findings[idx] = detector.Detect(window)
+		fmt.Fprintln(rr.output, findings[idx])
 	}
-	a.cmd.Wait()
-	a.cmd = nil
+	return rr.Policy(findings), findings
+}
+
+// DetectHeartbeats returns the number of heartbeats found in the given
+// ecg, assuming it was sampled at the DefaultSampleRate.
+//
+// This used to be a crappy derivative threshold that false-positived high
+// whenever I was fibrillating. It's now just a wrapper around the qrs
+// package, which should be used directly by anything that wants to know
+// where the beats actually are.
+func DetectHeartbeats(ecg []uint16) int {
+	return len(qrs.New(DefaultSampleRate).Peaks(ecg))
 }
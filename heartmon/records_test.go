@@ -0,0 +1,194 @@
+package heartmon
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRecords returns one of each kind of record, with times that come
+// back out of the file the same as they went in.
+func testRecords() []Record {
+	t := time.Unix(0, 1556595000123456789)
+	samples := make([]uint16, 50)
+	for i := range samples {
+		samples[i] = uint16(500 + 3*i)
+	}
+	return []Record{
+		HandshakeRecord{DeviceID: "chest-1", Firmware: "test",
+			SampleRate: 50, ADCBits: 10, Protocol: ProtocolV2, Boot: 7},
+		StreamInfoRecord{SampleRate: 50, ADCBits: 10},
+		TimestampRecord{t},
+		HeartDataRecord{samples},
+		// Too noisy to compress.
+		HeartDataRecord{[]uint16{0, 65535, 0, 65535}},
+		GapRecord{Start: t, Duration: time.Second, Reason: "test"},
+		ErrorRecord{"test"},
+		AlertRecord{Time: t, Kind: AlertAF, Action: AlertStarted,
+			Level: 1, Detail: "test"},
+	}
+}
+
+// writeFile writes the records as a file of the given version, or without
+// a header if it's 0.
+func writeFile(t *testing.T, version uint8, records []Record) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	rw := NewRecordWriter(&buf)
+	if version != 0 {
+		err := rw.WriteHeader(FileHeader{Version: version,
+			Created: time.Unix(1556595000, 0), DeviceID: "chest-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range records {
+		err := rw.Write(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := rw.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readAll reads all the records there are, failing the test on an error.
+func readAll(t *testing.T, rr *RecordReader) []Record {
+	t.Helper()
+
+	var records []Record
+	for {
+		r, err := rr.NextRecord()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("after %d records: %v", len(records), err)
+		}
+		records = append(records, r)
+	}
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+	records := testRecords()
+	for _, version := range []uint8{0, 1, 2, 3} {
+		b := writeFile(t, version, records)
+		rr := NewRecordReader(bytes.NewReader(b))
+		got := readAll(t, rr)
+		if !reflect.DeepEqual(got, records) {
+			t.Fatalf("version %d: got %v, expected %v", version, got, records)
+		}
+
+		header, err := rr.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case version == 0 && header != nil:
+			t.Fatalf("got a header %v from a file without one", header)
+		case version != 0 && (header == nil || header.Version != version ||
+			header.DeviceID != "chest-1"):
+			t.Fatalf("version %d: got the header %v", version, header)
+		}
+		if rr.Offset() != int64(len(b)) {
+			t.Fatalf("version %d: ended at %d, not %d", version,
+				rr.Offset(), len(b))
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	records := testRecords()
+	v2 := writeFile(t, 2, records)
+	v3 := writeFile(t, 3, records)
+	if len(v3) >= len(v2) {
+		t.Fatalf("compressed to %d bytes from %d", len(v3), len(v2))
+	}
+
+	for _, samples := range [][]uint16{
+		{0},
+		{65535},
+		{0, 65535, 0, 1, 65534},
+		{100, 100, 100, 101, 99},
+	} {
+		got, err := decompressSamples(compressSamples(samples))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, samples) {
+			t.Fatalf("got %v back from %v", got, samples)
+		}
+	}
+
+	_, err := decompressSamples([]byte{0x80})
+	if err == nil {
+		t.Fatal("a cut off varint decompressed")
+	}
+}
+
+func TestConcatenatedFiles(t *testing.T) {
+	first := []Record{TimestampRecord{time.Unix(0, 1)}, data(1, 2, 3)}
+	second := []Record{TimestampRecord{time.Unix(0, 2)}, data(4, 5, 6)}
+	var b []byte
+	b = append(b, writeFile(t, 1, first)...)
+	b = append(b, writeFile(t, 3, second)...)
+
+	rr := NewRecordReader(bytes.NewReader(b))
+	got := readAll(t, rr)
+	if !reflect.DeepEqual(got, append(first, second...)) {
+		t.Fatalf("got %v", got)
+	}
+	header, _ := rr.Header()
+	if header.Version != 3 {
+		t.Fatalf("expected the second file's header, got %v", header)
+	}
+}
+
+func TestUnknownRecords(t *testing.T) {
+	unknown := UnknownRecord{Type: 200, Data: []byte("from the future")}
+	records := []Record{data(1), unknown, data(2)}
+	b := writeFile(t, 3, records)
+
+	got := readAll(t, NewRecordReader(bytes.NewReader(b)))
+	if !reflect.DeepEqual(got, []Record{data(1), data(2)}) {
+		t.Fatalf("expected the unknown record skipped, got %v", got)
+	}
+
+	rr := NewRecordReader(bytes.NewReader(b))
+	rr.KeepUnknown = true
+	got = readAll(t, rr)
+	if !reflect.DeepEqual(got, records) {
+		t.Fatalf("expected the unknown record kept, got %v", got)
+	}
+}
+
+func TestRecordOffsets(t *testing.T) {
+	records := testRecords()
+	b := writeFile(t, 3, records)
+
+	// Each record can be read on its own from where it was said to
+	// start.
+	rr := NewRecordReader(bytes.NewReader(b))
+	header, _ := rr.Header()
+	for _, expected := range records {
+		r, err := rr.NextRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		single := NewRecordReader(bytes.NewReader(b[rr.recordAt:rr.Offset()]))
+		single.checksums = header.Version >= 2
+		got, err := single.NextRecord()
+		if err != nil {
+			t.Fatalf("%v at %d: %v", r, rr.recordAt, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("got %v at %d, expected %v", got, rr.recordAt, expected)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package heartmon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// One bad length field used to be the end of a night: the RecordReader
+// would read garbage as records until something didn't make sense, return
+// an error, and everything reading the file gave up on the rest of it.
+// With Recover set, a RecordReader instead looks at each record before it
+// believes it, and if it's corrupt, skips forward a byte at a time until it
+// finds something that looks like a record again, and carries on from
+// there. What it skipped is passed on as an ErrorRecord, which also tells a
+// SampleReader the samples don't carry on across it.
+//
+// A record looks right if its contents decode and, from version 2 of the
+// format on, its CRC matches. Before version 2 there is no CRC, so the
+// record after it has to start with a type that's known, if it's there to
+// look at; that catches most bad lengths, but a bad length can still take a
+// record or two with it. A damaged header is taken to be one of the current
+// version; see damagedHeader.
+
+// maxRecordSize is the size of the largest record there can be, with its
+// CRC.
+const maxRecordSize = 3 + 65535 + 4
+
+// Skipped returns how many bytes of corruption Recover has skipped.
+func (rr *RecordReader) Skipped() int64 {
+	return rr.skipped
+}
+
+// recoverRecord reads the next record, skipping past any corruption. If it
+// had to skip any, it returns an ErrorRecord saying so first, and the
+// record after it on the next call.
+func (rr *RecordReader) recoverRecord() (Record, bool, error) {
+	// A record has to be looked at whole before it's believed, which
+	// takes a bigger buffer than just reading it.
+	if rr.buf.Size() < maxRecordSize {
+		rr.buf = bufio.NewReaderSize(rr.buf, maxRecordSize)
+	}
+
+	skipped := 0
+	for {
+		record, known, size, err := rr.peekRecord(skipped > 0)
+		if (err == nil || err == io.EOF) && skipped > 0 {
+			// The record found is left to be read next time.
+			return ErrorRecord{fmt.Sprintf(
+				"skipped %d bytes of corrupt data", skipped)}, true, nil
+		}
+		if err == nil {
+			rr.buf.Discard(size)
+			rr.recordAt = rr.offset
+			rr.offset += int64(size)
+			return record, known, nil
+		}
+		if err != errCorruptRecord {
+			return nil, false, err
+		}
+
+		rr.buf.Discard(1)
+		skipped++
+		rr.skipped++
+		rr.offset++
+	}
+}
+
+// errCorruptRecord is returned by peekRecord when there isn't a record where
+// it looked.
+var errCorruptRecord = errors.New("corrupt record")
+
+// peekRecord looks at what's next in the stream without reading it,
+// returning the record and how big it is if it looks right, and
+// errCorruptRecord if it doesn't. A header that's been run into counts as a
+// record with nothing to return; it's read straight away, since it changes
+// what the following records look like. resyncing says it's looking for
+// where the records start again, which unknown types aren't good enough
+// for without a CRC.
+func (rr *RecordReader) peekRecord(resyncing bool) (Record, bool, int, error) {
+	b, err := rr.buf.Peek(3)
+	if len(b) == 0 && err == io.EOF {
+		return nil, false, 0, io.EOF
+	}
+	if len(b) > 0 && b[0] == 0 {
+		isHeader, err := rr.readHeader()
+		if err == nil && isHeader {
+			return nil, false, 0, nil
+		}
+		return nil, false, 0, errCorruptRecord
+	}
+	if err == io.EOF {
+		// too short to be a record
+		return nil, false, 0, errCorruptRecord
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	size := 3 + int(binary.BigEndian.Uint16(b[1:]))
+	if rr.checksums {
+		size += 4
+	}
+	b, err = rr.buf.Peek(size)
+	if err == io.EOF {
+		return nil, false, 0, errCorruptRecord
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+	contents := b[3:size]
+	if rr.checksums {
+		contents = b[3 : size-4]
+		crc := binary.BigEndian.Uint32(b[size-4:])
+		if crc != recordChecksum(b[:3], contents) {
+			return nil, false, 0, errCorruptRecord
+		}
+	}
+
+	ty := b[0]
+	record, known, err := decodeRecord(ty, append([]byte(nil), contents...))
+	if err != nil {
+		return nil, false, 0, errCorruptRecord
+	}
+	if rr.checksums {
+		return record, known, size, nil
+	}
+	if !known && resyncing {
+		return nil, false, 0, errCorruptRecord
+	}
+
+	// Without a CRC, see if the next record starts where this one says
+	// it ends. This only looks at what's already been read, so a live
+	// stream isn't held up waiting for the next record to arrive.
+	if rr.buf.Buffered() > size {
+		next, _ := rr.buf.Peek(size + 1)
+		if next[size] != 0 && !knownType(next[size]) {
+			return nil, false, 0, errCorruptRecord
+		}
+	}
+	return record, known, size, nil
+}
+
+// knownType returns whether ty is a type of record this code knows.
+func knownType(ty byte) bool {
+	return ty >= Timestamp && ty <= CompressedHeartdata
+}
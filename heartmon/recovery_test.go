@@ -0,0 +1,188 @@
+package heartmon
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// offsets returns where each record in the file starts, and where the
+// last one ends.
+func offsets(t *testing.T, b []byte) []int64 {
+	t.Helper()
+
+	rr := NewRecordReader(bytes.NewReader(b))
+	var offsets []int64
+	for {
+		_, err := rr.NextRecord()
+		if err == io.EOF {
+			return append(offsets, rr.Offset())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, rr.recordAt)
+	}
+}
+
+// recoverAll reads everything with Recover set, returning the records and
+// the ErrorRecords for what was skipped apart.
+func recoverAll(t *testing.T, b []byte) (records []Record, skips []string, rr *RecordReader) {
+	t.Helper()
+
+	rr = NewRecordReader(bytes.NewReader(b))
+	rr.Recover = true
+	for _, r := range readAll(t, rr) {
+		if er, isError := r.(ErrorRecord); isError &&
+			strings.HasPrefix(er.Error, "skipped") {
+			skips = append(skips, er.Error)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, skips, rr
+}
+
+// moreRecords is enough records for there to be some after the
+// corruption.
+func moreRecords() []Record {
+	records := testRecords()
+	for i := uint16(0); i < 5; i++ {
+		records = append(records, TimestampRecord{time.Unix(int64(i), 0)},
+			data(100+i, 200+i, 300+i))
+	}
+	return records
+}
+
+func TestRecoverBadLength(t *testing.T) {
+	records := moreRecords()
+	for _, version := range []uint8{0, 3} {
+		b := writeFile(t, version, records)
+		at := offsets(t, b)
+		// The length of the first heart data now goes past the end
+		// of the file.
+		b[at[3]+1] ^= 0x40
+
+		err := readErr(NewRecordReader(bytes.NewReader(b)))
+		if err == io.EOF {
+			t.Fatalf("version %d: read the bad length without Recover", version)
+		}
+
+		got, skips, _ := recoverAll(t, b)
+		if version != 0 {
+			// The CRCs say exactly which one is bad.
+			expected := append(append([]Record{}, records[:3]...), records[4:]...)
+			if !reflect.DeepEqual(got, expected) || len(skips) != 1 {
+				t.Fatalf("version %d: got %v, skipping %v", version, got, skips)
+			}
+			continue
+		}
+		checkResynced(t, got, skips, records, 3)
+	}
+}
+
+// checkResynced checks that records without CRCs, corrupted at the given
+// record, were found again after it, though it may take another record with
+// it.
+func checkResynced(t *testing.T, got []Record, skips []string, records []Record, at int) {
+	t.Helper()
+
+	after := len(records) - at - 2
+	if len(skips) == 0 || len(got) < at+after ||
+		!reflect.DeepEqual(got[:at], records[:at]) ||
+		!reflect.DeepEqual(got[len(got)-after:], records[len(records)-after:]) {
+		t.Fatalf("got %v, skipping %v", got, skips)
+	}
+}
+
+func TestRecoverGarbage(t *testing.T) {
+	records := moreRecords()
+	for _, version := range []uint8{0, 3} {
+		b := writeFile(t, version, records)
+		at := offsets(t, b)
+		garbage := []byte{0xff, 0xfe, 0x00, 0x12, 0x34, 0xff}
+		var corrupt []byte
+		corrupt = append(corrupt, b[:at[5]]...)
+		corrupt = append(corrupt, garbage...)
+		corrupt = append(corrupt, b[at[5]:]...)
+
+		got, skips, rr := recoverAll(t, corrupt)
+		if version == 0 {
+			// The record before the garbage isn't followed by a
+			// record, so it looks to have a bad length too.
+			checkResynced(t, got, skips, records, 4)
+			continue
+		}
+		if !reflect.DeepEqual(got, records) || len(skips) != 1 {
+			t.Fatalf("version %d: got %v, skipping %v", version, got, skips)
+		}
+		if rr.Skipped() != int64(len(garbage)) {
+			t.Fatalf("version %d: skipped %d bytes, not %d", version,
+				rr.Skipped(), len(garbage))
+		}
+		if rr.Offset() != int64(len(corrupt)) {
+			t.Fatalf("version %d: ended at %d, not %d", version,
+				rr.Offset(), len(corrupt))
+		}
+	}
+}
+
+func TestRecoverTruncated(t *testing.T) {
+	records := moreRecords()
+	for _, version := range []uint8{0, 3} {
+		b := writeFile(t, version, records)
+		at := offsets(t, b)
+		last := len(records) - 1
+		b = b[:at[last]+4]
+
+		err := readErr(NewRecordReader(bytes.NewReader(b)))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("version %d: expected an unexpected EOF without Recover, got %v",
+				version, err)
+		}
+
+		got, skips, _ := recoverAll(t, b)
+		if !reflect.DeepEqual(got, records[:last]) || len(skips) != 1 {
+			t.Fatalf("version %d: got %v, skipping %v", version, got, skips)
+		}
+	}
+}
+
+func TestRecoverDamagedHeader(t *testing.T) {
+	records := moreRecords()
+	for _, version := range []uint8{2, 3} {
+		b := writeFile(t, version, records)
+		// The length of the device ID, which now runs off the end of
+		// the header.
+		b[len(FileMagic)+2+9] = 0xff
+
+		rr := NewRecordReader(bytes.NewReader(b))
+		_, err := rr.Header()
+		if err == nil {
+			t.Fatalf("version %d: read the damaged header without Recover",
+				version)
+		}
+
+		got, skips, rr := recoverAll(t, b)
+		if !reflect.DeepEqual(got, records) || len(skips) != 1 {
+			t.Fatalf("version %d: got %v, skipping %v", version, got, skips)
+		}
+		header, err := rr.Header()
+		if err != nil || header == nil || header.Version != FileVersion {
+			t.Fatalf("version %d: got the header %v, %v", version, header, err)
+		}
+	}
+}
+
+// readErr reads until there's an error, and returns it.
+func readErr(rr *RecordReader) error {
+	for {
+		_, err := rr.NextRecord()
+		if err != nil {
+			return err
+		}
+	}
+}
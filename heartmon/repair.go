@@ -0,0 +1,186 @@
+package heartmon
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"time"
+)
+
+// When the server loses power, the .hrt files it was writing are left with
+// half a record on the end, or less than that if the RecordWriter never got
+// to flush. Then there's whatever else has gone wrong with them over the
+// years. A Repairer goes through a file record by record, says what's
+// wrong with it, and can write out a copy with the problems taken out,
+// which cmd/repair does.
+//
+// What it looks for, and what it does about it in the copy:
+//
+//   - Corruption, which Recover skips, and truncation, which is corruption
+//     at the end of the file. The copy leaves them out.
+//   - Timestamps earlier than the one before them. The copy leaves them
+//     out, and the heart data after them follows on from the one before.
+//   - Samples bigger than the ADC can produce; 1023, unless a
+//     StreamInfoRecord says otherwise. The copy leaves out the heart data
+//     record they're in.
+//   - Records with nothing in them. The copy leaves them out.
+//
+// With Gaps set, the copy goes through a GapTracker, which puts a
+// GapRecord wherever the timestamps show samples went missing, and one in
+// place of each heart data record that was left out, so nothing reading
+// the copy splices the two sides together.
+
+// A Problem is something wrong with a file.
+type Problem struct {
+	// Offset is where in the file the problem is, in bytes.
+	Offset int64
+	// Time is the time of the last good timestamp before it, if there's
+	// been one.
+	Time time.Time
+	// Problem says what the problem is.
+	Problem string
+}
+
+func (p Problem) String() string {
+	if p.Time.IsZero() {
+		return fmt.Sprintf("byte %d: %s", p.Offset, p.Problem)
+	}
+	return fmt.Sprintf("byte %d (after %s): %s", p.Offset,
+		p.Time.Format("2006-01-02 15:04:05.000"), p.Problem)
+}
+
+// A Repairer checks a .hrt file, and optionally writes a repaired copy of
+// it.
+type Repairer struct {
+	// Gaps makes the repaired copy mark where samples are missing with
+	// GapRecords.
+	Gaps bool
+
+	rr *RecordReader
+}
+
+// NewRepairer returns a Repairer reading the file from r.
+func NewRepairer(r io.Reader) *Repairer {
+	rr := NewRecordReader(r)
+	rr.Recover = true
+	// Records this code doesn't know can't be checked, but they're
+	// still copied.
+	rr.KeepUnknown = true
+	return &Repairer{rr: rr}
+}
+
+// Repair reads the whole file and returns the problems with it. If w isn't
+// nil, the repaired copy is written to it, in the current version of the
+// format. The header, if the file has one, is copied; if files have been
+// run together, it's the first one's.
+func (rp *Repairer) Repair(w io.Writer) ([]Problem, error) {
+	var rw *RecordWriter
+	var sink RecordSink
+	var gaps *GapTracker
+	if w != nil {
+		rw = NewRecordWriter(w)
+		// A header that can't be read is skipped as corruption, and
+		// the copy gets a new one.
+		header, _ := rp.rr.Header()
+		fh := FileHeader{}
+		if header != nil {
+			fh = *header
+			fh.Version = 0
+		}
+		err := rw.WriteHeader(fh)
+		if err != nil {
+			return nil, err
+		}
+		sink = rw
+		if rp.Gaps {
+			gaps = NewGapTracker(rw)
+			sink = gaps
+		}
+	}
+
+	problems := []Problem{}
+	streamInfo := DefaultStreamInfo()
+	var last time.Time
+	problem := func(offset int64, format string, args ...interface{}) {
+		problems = append(problems, Problem{offset, last,
+			fmt.Sprintf(format, args...)})
+	}
+
+	// whether the last record was Recover skipping something, and how
+	// much, so that if the file ends there it's reported as truncated
+	skipped := int64(0)
+	for {
+		before := rp.rr.Skipped()
+		record, err := rp.rr.NextRecord()
+		if err == io.EOF {
+			if skipped > 0 {
+				problems[len(problems)-1].Problem = fmt.Sprintf(
+					"file is truncated; the last %d bytes are part of a record",
+					skipped)
+			}
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+		skipped = rp.rr.Skipped() - before
+		if skipped > 0 {
+			// It's stopped at the start of the next good record.
+			problem(rp.rr.Offset()-skipped,
+				"skipped %d bytes of corrupt data", skipped)
+			continue
+		}
+		at := rp.rr.recordAt
+
+		if marshaler, ok := record.(encoding.BinaryMarshaler); ok {
+			b, err := marshaler.MarshalBinary()
+			if err == nil && len(b) == 0 {
+				ty, _ := recordType(record)
+				problem(at, "zero-length record of type %d", ty)
+				continue
+			}
+		}
+
+		switch r := record.(type) {
+		case StreamInfoRecord:
+			streamInfo = r
+		case TimestampRecord:
+			if r.Time.Before(last) {
+				problem(at, "timestamp %s is out of order",
+					r.Time.Format("2006-01-02 15:04:05.000"))
+				continue
+			}
+			last = r.Time
+		case HeartDataRecord:
+			bad := 0
+			for _, sample := range r.Data {
+				if sample > streamInfo.MaxSample() {
+					bad++
+				}
+			}
+			if bad > 0 {
+				problem(at, "%d of %d samples are more than %d",
+					bad, len(r.Data), streamInfo.MaxSample())
+				if gaps != nil {
+					err = gaps.Drop(len(r.Data), "implausible samples")
+					if err != nil {
+						return problems, err
+					}
+				}
+				continue
+			}
+		}
+
+		if sink != nil {
+			err = sink.Write(record)
+			if err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	if rw != nil {
+		return problems, rw.Flush()
+	}
+	return problems, nil
+}
@@ -0,0 +1,120 @@
+package heartmon
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// repairRecords is a file's worth of good records to damage.
+func repairRecords() []Record {
+	return append([]Record{StreamInfoRecord{SampleRate: 50, ADCBits: 10}},
+		stampedData(sampleStart, 20*time.Millisecond, 250, 50, exactly)...)
+}
+
+// repair repairs the file, returning the problems and the records in the
+// repaired copy.
+func repair(t *testing.T, b []byte, gaps bool) ([]Problem, []Record) {
+	t.Helper()
+
+	var repaired bytes.Buffer
+	rp := NewRepairer(bytes.NewReader(b))
+	rp.Gaps = gaps
+	problems, err := rp.Repair(&repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewRecordReader(&repaired)
+	records := readAll(t, rr)
+	header, err := rr.Header()
+	if err != nil || header == nil || header.Version != FileVersion {
+		t.Fatalf("the copy has the header %v, %v", header, err)
+	}
+	return problems, records
+}
+
+func TestRepair(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// damage damages the records; the one at bad is the problem,
+		// unless it's 0, when there isn't one.
+		damage func([]Record) []Record
+		bad    int
+		// cut the file off in the middle of the last record
+		truncate bool
+		problem  string
+	}{
+		{"clean", func(records []Record) []Record { return records },
+			0, false, ""},
+		{"truncated", func(records []Record) []Record { return records },
+			10, true, "file is truncated"},
+		{"timestamp out of order", func(records []Record) []Record {
+			records[5] = TimestampRecord{sampleStart}
+			return records
+		}, 5, false, "is out of order"},
+		{"sample too big", func(records []Record) []Record {
+			data := records[4].(HeartDataRecord).Data
+			data[7] = 1024
+			return records
+		}, 4, false, "1 of 50 samples are more than 1023"},
+		{"sample big enough for the stream info", func(records []Record) []Record {
+			records[0] = StreamInfoRecord{SampleRate: 50, ADCBits: 12}
+			data := records[4].(HeartDataRecord).Data
+			data[7] = 4095
+			return records
+		}, 0, false, ""},
+		{"empty", func(records []Record) []Record {
+			return append(records[:3:3], append([]Record{ErrorRecord{}},
+				records[3:]...)...)
+		}, 3, false, "zero-length record"},
+	} {
+		records := test.damage(repairRecords())
+		b := writeFile(t, FileVersion, records)
+		at := offsets(t, b)
+		if test.truncate {
+			b = b[:at[test.bad]+4]
+		}
+
+		problems, repaired := repair(t, b, false)
+		want := records
+		if test.problem == "" {
+			if len(problems) != 0 {
+				t.Fatalf("%s: found the problems %v", test.name, problems)
+			}
+		} else {
+			if len(problems) != 1 || problems[0].Offset != at[test.bad] ||
+				!strings.Contains(problems[0].Problem, test.problem) {
+				t.Fatalf("%s: expected %q at byte %d, found %v", test.name,
+					test.problem, at[test.bad], problems)
+			}
+			want = append(records[:test.bad:test.bad],
+				records[test.bad+1:]...)
+		}
+		if !reflect.DeepEqual(repaired, want) {
+			t.Fatalf("%s: repaired to %v", test.name, repaired)
+		}
+	}
+}
+
+func TestRepairGaps(t *testing.T) {
+	records := repairRecords()
+	records[4].(HeartDataRecord).Data[7] = 1024
+	problems, repaired := repair(t, writeFile(t, FileVersion, records), true)
+	if len(problems) != 1 {
+		t.Fatalf("found the problems %v", problems)
+	}
+
+	// The heart data left out is replaced with a GapRecord for it.
+	gap, isGap := repaired[4].(GapRecord)
+	if !isGap || gap.Duration != time.Second ||
+		!gap.Start.Equal(sampleStart.Add(50*20*time.Millisecond)) {
+		t.Fatalf("repaired to %v", repaired)
+	}
+	repaired = append(repaired[:4:4], repaired[5:]...)
+	want := append(records[:4:4], records[5:]...)
+	if !reflect.DeepEqual(repaired, want) {
+		t.Fatalf("repaired to %v", repaired)
+	}
+}
@@ -0,0 +1,149 @@
+package heartmon
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// A Replayer plays a recorded .hrt stream back in real time, or some
+// multiple of it, paced by the stream's own timestamps. Pointed at a
+// heartserver it's a fake Arduino; pointed at a MonitorReader it's a fake
+// USB monitor. Either way the whole live pipeline gets exercised with the
+// timing it would really have, which running a file through testalert as
+// fast as it can be read doesn't do.
+type Replayer struct {
+	// Speed is how many times faster than real time to play the stream
+	// back. It has to be more than 0. NewReplayer sets it to 1.
+	Speed float64
+	// MaxWait is the longest the Replayer will wait between one record
+	// and the next. A longer pause in the recording, such as the monitor
+	// being off for a few hours, is skipped over rather than sat through,
+	// though the timestamps still show it. NewReplayer sets it to
+	// DefaultMaxReplayWait.
+	MaxWait time.Duration
+
+	rr *RecordReader
+
+	// the wall clock time and the stream time the pacing is counted from
+	wallStart   time.Time
+	streamStart time.Time
+	last        time.Time
+	started     bool
+}
+
+// DefaultMaxReplayWait is the longest pause a Replayer sits through by
+// default. The firmware sends something every few seconds.
+const DefaultMaxReplayWait = 10 * time.Second
+
+// NewReplayer returns a Replayer reading the recorded stream from r.
+func NewReplayer(r io.Reader) *Replayer {
+	rp := &Replayer{
+		Speed:   1,
+		MaxWait: DefaultMaxReplayWait,
+		rr:      NewRecordReader(r),
+	}
+	// A recording with a bad patch in it plays on past it.
+	rp.rr.Recover = true
+	return rp
+}
+
+// wait sleeps until it's time for something with the given stream time to
+// be played.
+func (rp *Replayer) wait(t time.Time) {
+	// A clock going backwards, or a long gap, starts the pacing again
+	// from here.
+	if !rp.started || t.Before(rp.last) || t.Sub(rp.last) > rp.MaxWait {
+		rp.wallStart = time.Now()
+		rp.streamStart = t
+		rp.last = t
+		rp.started = true
+		return
+	}
+	rp.last = t
+
+	elapsed := time.Duration(float64(t.Sub(rp.streamStart)) / rp.Speed)
+	time.Sleep(time.Until(rp.wallStart.Add(elapsed)))
+}
+
+// Records plays the stream back as records written to w, such as a
+// connection to a heartserver. Each record is written when its timestamp
+// comes due, so the heart data following a timestamp is sent at the time
+// it was collected, the same as the firmware does it.
+//
+// It returns nil at the end of the stream.
+func (rp *Replayer) Records(w io.Writer) error {
+	return rp.play(NewRecordWriter(w), false)
+}
+
+// Frames plays the stream back the same as Records, but through a
+// FrameWriter, in ProtocolV2. Each frame holds the records up to the end of
+// a packet of heart data, as the firmware would send it.
+//
+// It returns nil at the end of the stream.
+func (rp *Replayer) Frames(fw *FrameWriter) error {
+	return rp.play(fw, true)
+}
+
+// recordFlusher is something records are collected in and then sent on
+// together, such as a RecordWriter or a FrameWriter.
+type recordFlusher interface {
+	RecordSink
+	Flush() error
+}
+
+// play plays the stream into the given recordFlusher, flushing it after
+// every record, or if byPacket is set, after each packet of heart data.
+func (rp *Replayer) play(w recordFlusher, byPacket bool) error {
+	for {
+		record, err := rp.rr.NextRecord()
+		if err == io.EOF {
+			return w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if ts, isTimestamp := record.(TimestampRecord); isTimestamp {
+			rp.wait(ts.Time)
+		}
+
+		err = w.Write(record)
+		if _, isData := record.(HeartDataRecord); err == nil &&
+			(isData || !byPacket) {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Samples plays the stream back one sample at a time into the given
+// MonitorReader, each when the sample clock says it was taken, the same as
+// the serial port would deliver them. The timestamps in the stream are
+// not passed on; the MonitorReader makes its own.
+//
+// It returns nil at the end of the stream, and an error if the
+// MonitorReader is stopped first.
+func (rp *Replayer) Samples(mr *MonitorReader) error {
+	sr := NewSampleReader(rp.rr)
+	for {
+		select {
+		case <-mr.stop:
+			return errors.New("monitor stopped")
+		default:
+		}
+
+		sample, err := sr.NextSample()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rp.wait(sample.Time)
+		mr.Reading(sample.Value)
+	}
+}
@@ -0,0 +1,415 @@
+package heartmon
+
+import (
+	"time"
+)
+
+// The record stream only has a TimestampRecord every packet, and those
+// only have whole-second resolution when they come from the Arduino. Both
+// the firmware and the MonitorReader write the timestamp just before the
+// heart data that was collected up to that moment, so a timestamp marks
+// the time of the *last* sample of the heart data that follows it.
+//
+// The sampleClock uses that to work out the time of every sample. It runs
+// at the nominal sample rate and checks itself against each timestamp as
+// it comes in. Small disagreements are jitter or drift in one clock or the
+// other and get nudged out over the following samples, so the
+// whole-second timestamps don't make the sample spacing jump about. Large
+// disagreements mean samples went missing, or the clock jumped, and the
+// clock starts a new run of samples from the timestamp.
+//
+// The same clock is used on the way in, by the GapTracker, to decide when
+// to write GapRecords, and on the way out, by the SampleReader, so they
+// agree on what a gap is.
+//
+// Not every gap is worth starting again over, though. The USB monitor
+// drops the odd garbled reading, and a GapRecord for one sample used to
+// throw away the minute of samples the RateDetector had built up. So a gap
+// of up to filledSamples samples is filled in, with a straight line from
+// the sample before it to the one after, and the samples carry on as if
+// nothing had happened.
+
+// filledSamples is the most missing samples that are filled in rather than
+// starting a new run of samples.
+const filledSamples = 5
+
+// DefaultTimingTolerance is how far the sample clock may disagree with a
+// timestamp before it decides something more than jitter is going on. A
+// bit over a second, since the Arduino's timestamps only have a resolution
+// of a second.
+const DefaultTimingTolerance = 1100 * time.Millisecond
+
+// driftCorrection is how much of the observed disagreement between the
+// sample clock and the timestamps is corrected for on each block.
+const driftCorrection = 0.25
+
+// SampleBlock is a run of samples with their reconstructed times.
+type SampleBlock struct {
+	// Start is the time of Data[0].
+	Start time.Time
+	// Interval is the time between samples in this block.
+	Interval time.Duration
+	// Data is the samples.
+	Data []uint16
+
+	// Reset is true if this block does not carry on from the previous
+	// one; it's the first block, more than a few samples went missing,
+	// the clock jumped, there was an error, or the stream info changed.
+	// Anything keeping a window of samples should start again.
+	Reset bool
+	// Gap is how much time is unaccounted for between the end of the
+	// previous block and the start of this one, if samples went missing.
+	// A few missing samples are filled in at the start of Data instead,
+	// and aren't a gap.
+	Gap time.Duration
+	// Drift is how far the sample clock was from the timestamp at the
+	// end of this block, before correction. Positive means the
+	// timestamps are running ahead of the samples.
+	Drift time.Duration
+
+	// StreamInfo describes the samples.
+	StreamInfo StreamInfoRecord
+}
+
+// Time returns the time of Data[i].
+func (sb SampleBlock) Time(i int) time.Time {
+	return sb.Start.Add(time.Duration(i) * sb.Interval)
+}
+
+// End returns the time of the last sample in the block.
+func (sb SampleBlock) End() time.Time {
+	return sb.Time(len(sb.Data) - 1)
+}
+
+type sampleClock struct {
+	tolerance  time.Duration
+	streamInfo StreamInfoRecord
+
+	// the timestamp that goes with the next heart data, if any
+	timestamp *time.Time
+	// the time of the next sample, according to the clock
+	next time.Time
+	// whether the clock is running at all yet
+	running bool
+	// whether the next block must be marked as a reset
+	reset bool
+	// missing time reported by GapRecords, to go on the next block
+	gap time.Duration
+	// the last sample, to fill in a short gap from
+	last uint16
+	// the current sample interval, as learned from the timestamps
+	interval time.Duration
+}
+
+func newSampleClock() *sampleClock {
+	sc := &sampleClock{
+		tolerance: DefaultTimingTolerance,
+		reset:     true,
+	}
+	sc.setStreamInfo(DefaultStreamInfo())
+	return sc
+}
+
+func (sc *sampleClock) setStreamInfo(info StreamInfoRecord) {
+	if info.SampleRate != sc.streamInfo.SampleRate {
+		sc.reset = true
+		sc.interval = time.Duration(float64(time.Second) / info.SampleRate)
+	}
+	sc.streamInfo = info
+}
+
+func (sc *sampleClock) nominal() time.Duration {
+	return time.Duration(float64(time.Second) / sc.streamInfo.SampleRate)
+}
+
+// observe updates the clock with a record from the stream. It returns a
+// block if the record was heart data.
+func (sc *sampleClock) observe(record Record) (SampleBlock, bool) {
+	switch r := record.(type) {
+	case TimestampRecord:
+		t := r.Time
+		sc.timestamp = &t
+	case StreamInfoRecord:
+		sc.setStreamInfo(r)
+	case ErrorRecord:
+		sc.reset = true
+	case GapRecord:
+		// Whether it's short enough to fill in isn't known until
+		// the heart data after it.
+		sc.gap += r.Duration
+	case HeartDataRecord:
+		if len(r.Data) == 0 {
+			return SampleBlock{}, false
+		}
+		block := sc.place(r.Data)
+		sc.timestamp = nil
+		return block, true
+	}
+	return SampleBlock{}, false
+}
+
+// place works out the timing of the given samples, using the pending
+// timestamp if there is one.
+func (sc *sampleClock) place(data []uint16) SampleBlock {
+	if sc.gap > 0 {
+		data = sc.fill(data)
+	}
+
+	nominal := sc.nominal()
+	n := len(data)
+	block := SampleBlock{
+		Data:       data,
+		StreamInfo: sc.streamInfo,
+	}
+
+	// Where would the clock put the last sample, if we believed it?
+	predictedEnd := sc.next.Add(time.Duration(n-1) * sc.interval)
+	// And where does the timestamp say the first sample is?
+	var stampedStart time.Time
+	if sc.timestamp != nil {
+		stampedStart = sc.timestamp.Add(-time.Duration(n-1) * sc.interval)
+	}
+
+	switch {
+	case sc.timestamp == nil && !sc.running:
+		// No idea what time it is; the best we can do is start from
+		// nothing and count samples.
+		block.Start = time.Time{}
+		sc.reset = true
+
+	case sc.timestamp == nil:
+		// No new timestamp, so just carry on with the clock.
+		block.Start = sc.next
+
+	case !sc.running || sc.reset:
+		// Start the clock from this timestamp.
+		block.Start = stampedStart
+		if sc.running && block.Start.After(sc.next) {
+			block.Gap = block.Start.Sub(sc.next)
+		}
+
+	default:
+		drift := sc.timestamp.Sub(predictedEnd)
+		block.Drift = drift
+		tolerance := sc.tolerance + time.Duration(n)*nominal/10
+
+		switch {
+		case drift > tolerance:
+			// The timestamp is well after where the samples
+			// should have ended; samples went missing.
+			block.Start = stampedStart
+			block.Gap = block.Start.Sub(sc.next)
+			sc.reset = true
+
+		case drift < -tolerance:
+			// More samples than the time allows for. The clock
+			// jumped backwards, or something sent us samples we
+			// already had; either way the clock can't be trusted.
+			block.Start = stampedStart
+			sc.reset = true
+
+		default:
+			// Jitter or drift. Carry on from where the clock says,
+			// spreading a fraction of the correction over this
+			// block's samples. The corrected interval carries on
+			// into the next block, so the clock learns the real
+			// sample rate of the device, which is never quite what
+			// it claims. The interval is kept within 10% of
+			// nominal, so one bad timestamp can't do much damage.
+			block.Start = sc.next
+			correction := time.Duration(float64(drift) * driftCorrection)
+			interval := sc.interval
+			if n > 1 {
+				interval += correction / time.Duration(n-1)
+			}
+			if interval > nominal+nominal/10 {
+				interval = nominal + nominal/10
+			}
+			if interval < nominal-nominal/10 {
+				interval = nominal - nominal/10
+			}
+			sc.interval = interval
+		}
+	}
+
+	// A GapRecord may be describing the same gap the timestamps just
+	// showed us, so take the larger rather than adding them.
+	if sc.gap > block.Gap {
+		block.Gap = sc.gap
+	}
+	sc.gap = 0
+
+	block.Interval = sc.interval
+	block.Reset = sc.reset
+	sc.reset = false
+	sc.running = true
+	sc.next = block.Start.Add(time.Duration(n) * block.Interval)
+	sc.last = data[n-1]
+	return block
+}
+
+// fill fills in the samples missing before data, if there are few enough
+// of them, and returns the samples with them in front. If there are too
+// many, it marks the clock as reset and returns the data as it was.
+func (sc *sampleClock) fill(data []uint16) []uint16 {
+	if !sc.running || sc.reset || sc.interval <= 0 ||
+		sc.gap > time.Duration(filledSamples)*sc.interval+sc.interval/2 {
+		sc.reset = true
+		return data
+	}
+	missing := int((sc.gap + sc.interval/2) / sc.interval)
+	sc.gap = 0
+
+	filled := make([]uint16, missing, missing+len(data))
+	from, to := int(sc.last), int(data[0])
+	for i := range filled {
+		filled[i] = uint16(from + (to-from)*(i+1)/(missing+1))
+	}
+	return append(filled, data...)
+}
+
+// Sample is a single sample with its reconstructed time.
+type Sample struct {
+	Value uint16
+	Time  time.Time
+}
+
+// SampleReader reads a record stream and yields the heart data with a time
+// for each sample.
+type SampleReader struct {
+	// Tolerance is how far the sample clock may disagree with a
+	// timestamp before it is treated as a gap or a clock jump.
+	// NewSampleReader sets it to DefaultTimingTolerance.
+	Tolerance time.Duration
+
+	src   RecordSource
+	clock *sampleClock
+
+	// For NextSample.
+	block SampleBlock
+	idx   int
+}
+
+// NewSampleReader returns a SampleReader reading from the given
+// RecordSource, such as a RecordReader.
+func NewSampleReader(src RecordSource) *SampleReader {
+	return &SampleReader{
+		Tolerance: DefaultTimingTolerance,
+		src:       src,
+		clock:     newSampleClock(),
+	}
+}
+
+// StreamInfo returns the stream info currently in effect.
+func (sr *SampleReader) StreamInfo() StreamInfoRecord {
+	return sr.clock.streamInfo
+}
+
+// NextBlock returns the next run of samples. It returns io.EOF at the end
+// of the stream, and passes through any other error from the
+// RecordReader.
+func (sr *SampleReader) NextBlock() (SampleBlock, error) {
+	for {
+		record, err := sr.src.NextRecord()
+		if err != nil {
+			return SampleBlock{}, err
+		}
+
+		sr.clock.tolerance = sr.Tolerance
+		block, isBlock := sr.clock.observe(record)
+		if isBlock {
+			return block, nil
+		}
+	}
+}
+
+// NextSample returns the next sample. It returns io.EOF at the end of the
+// stream.
+//
+// Samples from the start of a new run can be recognized by the time jumping;
+// use NextBlock if you need to know about gaps explicitly.
+func (sr *SampleReader) NextSample() (Sample, error) {
+	for sr.idx >= len(sr.block.Data) {
+		block, err := sr.NextBlock()
+		if err != nil {
+			return Sample{}, err
+		}
+		sr.block = block
+		sr.idx = 0
+	}
+
+	sample := Sample{
+		Value: sr.block.Data[sr.idx],
+		Time:  sr.block.Time(sr.idx),
+	}
+	sr.idx++
+	return sample, nil
+}
+
+// GapTracker sits in front of a RecordWriter on the way into a .hrt
+// stream. It passes records through, and when the timestamps show that
+// samples have gone missing it writes a GapRecord in front of the heart
+// data that follows the gap.
+type GapTracker struct {
+	rw    RecordSink
+	clock *sampleClock
+
+	// how much gap has already been written out in GapRecords for the
+	// next heart data
+	marked time.Duration
+}
+
+// NewGapTracker returns a GapTracker writing to the given RecordSink,
+// such as a RecordWriter.
+func NewGapTracker(rw RecordSink) *GapTracker {
+	return &GapTracker{rw: rw, clock: newSampleClock()}
+}
+
+// Write writes the given record, preceded by a GapRecord if one is called
+// for.
+func (gt *GapTracker) Write(r Record) error {
+	// The clock consumes the heart data, and the gap has to be written
+	// before that is, so work out the timing first.
+	block, isBlock := gt.clock.observe(r)
+	if isBlock {
+		if block.Gap > gt.marked {
+			err := gt.rw.Write(GapRecord{
+				Start:    block.Start.Add(-block.Gap),
+				Duration: block.Gap - gt.marked,
+				Reason:   "timestamps show missing samples",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		gt.marked = 0
+	}
+	if gap, isGap := r.(GapRecord); isGap {
+		gt.marked += gap.Duration
+	}
+	return gt.rw.Write(r)
+}
+
+// Drop notes that some samples were dropped on the floor before they got
+// to us, such as garbled serial readings, and writes a GapRecord for them.
+// It should be called between the timestamp and the heart data the samples
+// would have been part of.
+func (gt *GapTracker) Drop(samples int, reason string) error {
+	return gt.Write(GapRecord{
+		Start:    gt.clock.next,
+		Duration: time.Duration(samples) * gt.clock.interval,
+		Reason:   reason,
+	})
+}
+
+// Missing notes that the given length of time went by with no samples at
+// all, such as while a device reconnected, and writes a GapRecord for it.
+// If the timestamps show more than that went missing when the samples come
+// back, the rest gets a GapRecord of its own.
+func (gt *GapTracker) Missing(d time.Duration, reason string) error {
+	return gt.Write(GapRecord{
+		Start:    gt.clock.next,
+		Duration: d,
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,305 @@
+package heartmon
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sampleStart is when the samples in these tests start.
+var sampleStart = time.Unix(1556595000, 0)
+
+// stampedData returns the given number of samples, taken the given
+// interval apart starting at the given time, as records of perRecord
+// samples each, with a timestamp in front of each for when its last sample
+// was taken, as the firmware writes them. stamp turns the time into what
+// the timestamp says.
+func stampedData(start time.Time, interval time.Duration, samples, perRecord int,
+	stamp func(time.Time) time.Time) []Record {
+	var records []Record
+	for i := 0; i < samples; i += perRecord {
+		data := make([]uint16, perRecord)
+		for j := range data {
+			data[j] = uint16((i + j) % 1000)
+		}
+		last := start.Add(time.Duration(i+perRecord-1) * interval)
+		records = append(records, TimestampRecord{stamp(last)},
+			HeartDataRecord{data})
+	}
+	return records
+}
+
+func exactly(t time.Time) time.Time { return t }
+
+func wholeSeconds(t time.Time) time.Time { return t.Truncate(time.Second) }
+
+// readBlocks writes the records to a file and reads all the blocks back out
+// of it with a SampleReader.
+func readBlocks(t *testing.T, records []Record) []SampleBlock {
+	t.Helper()
+
+	b := writeFile(t, FileVersion, records)
+	sr := NewSampleReader(NewRecordReader(bytes.NewReader(b)))
+	var blocks []SampleBlock
+	for {
+		block, err := sr.NextBlock()
+		if err == io.EOF {
+			return blocks
+		}
+		if err != nil {
+			t.Fatalf("after %d blocks: %v", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestSampleTimes(t *testing.T) {
+	nominal := 20 * time.Millisecond
+	for _, test := range []struct {
+		name     string
+		interval time.Duration
+		stamp    func(time.Time) time.Time
+		// how far off the times may be once the clock has settled
+		within time.Duration
+	}{
+		{"on time", nominal, exactly, 0},
+		{"slow", nominal + nominal/100, exactly, 2 * time.Millisecond},
+		{"fast", nominal - nominal/50, exactly, 2 * time.Millisecond},
+		// The time of a sample can't be known any better than the
+		// timestamps know it.
+		{"whole seconds", nominal, wholeSeconds, time.Second},
+		{"slow, whole seconds", nominal + nominal/100, wholeSeconds,
+			time.Second},
+	} {
+		blocks := readBlocks(t, stampedData(sampleStart, test.interval,
+			50*60*10, 50, test.stamp))
+		if len(blocks) != 60*10 {
+			t.Fatalf("%s: got %d blocks", test.name, len(blocks))
+		}
+		for i, block := range blocks {
+			if block.Reset != (i == 0) || block.Gap != 0 {
+				t.Fatalf("%s: block %d has Reset %v and Gap %v", test.name,
+					i, block.Reset, block.Gap)
+			}
+			if i > 0 {
+				prev := blocks[i-1]
+				next := prev.Start.Add(time.Duration(len(prev.Data)) *
+					prev.Interval)
+				if !block.Start.Equal(next) {
+					t.Fatalf("%s: block %d starts at %v, not straight after the one before at %v",
+						test.name, i, block.Start, next)
+				}
+			}
+			// It takes the clock a few blocks to learn the rate.
+			if i < 20 {
+				continue
+			}
+			end := sampleStart.Add(time.Duration(i*50+49) * test.interval)
+			off := block.End().Sub(end)
+			if off > test.within || off < -test.within {
+				t.Fatalf("%s: block %d ends %v out", test.name, i, off)
+			}
+		}
+
+		last := blocks[len(blocks)-1].Interval
+		if test.within < time.Second &&
+			(last > test.interval+time.Microsecond ||
+				last < test.interval-time.Microsecond) {
+			t.Fatalf("%s: the clock has an interval of %v, not %v",
+				test.name, last, test.interval)
+		}
+	}
+}
+
+func TestSampleIntervalClamp(t *testing.T) {
+	nominal := 20 * time.Millisecond
+	for _, test := range []struct {
+		name string
+		// how far off the last timestamp is
+		off  time.Duration
+		want time.Duration
+	}{
+		{"a little late", 40 * time.Millisecond,
+			nominal + 10*time.Millisecond/49},
+		{"a little early", -40 * time.Millisecond,
+			nominal - 10*time.Millisecond/49},
+		// These are within the tolerance, so they're taken as drift,
+		// but they can't pull the interval more than 10% off.
+		{"late", time.Second, nominal + nominal/10},
+		{"early", -time.Second, nominal - nominal/10},
+	} {
+		records := stampedData(sampleStart, nominal, 50*11, 50, exactly)
+		stamp := records[len(records)-2].(TimestampRecord)
+		records[len(records)-2] = TimestampRecord{stamp.Time.Add(test.off)}
+
+		blocks := readBlocks(t, records)
+		last := blocks[len(blocks)-1]
+		if last.Reset || last.Gap != 0 {
+			t.Fatalf("%s: the block has Reset %v and Gap %v", test.name,
+				last.Reset, last.Gap)
+		}
+		if last.Drift != test.off {
+			t.Fatalf("%s: the block has a drift of %v", test.name, last.Drift)
+		}
+		if last.Interval != test.want {
+			t.Fatalf("%s: the interval is %v, not %v", test.name,
+				last.Interval, test.want)
+		}
+	}
+}
+
+// recordLog is a RecordSink that keeps what's written to it.
+type recordLog []Record
+
+func (rl *recordLog) Write(r Record) error {
+	*rl = append(*rl, r)
+	return nil
+}
+
+func TestSampleGaps(t *testing.T) {
+	interval := 20 * time.Millisecond
+	for _, test := range []struct {
+		name string
+		// how many samples are missing
+		missing int
+		// whether there's a GapRecord for them, or only the
+		// timestamps show it
+		marked bool
+		filled bool
+	}{
+		{"one", 1, true, true},
+		{"a few", 5, true, true},
+		{"one too many", 6, true, false},
+		{"a lot", 500, true, false},
+		{"a lot, unmarked", 500, false, false},
+	} {
+		gap := time.Duration(test.missing) * interval
+		// ten blocks before the gap, and ten after
+		const before = 10
+		records := stampedData(sampleStart, interval, 500, 50, exactly)
+		if test.marked {
+			records = append(records, GapRecord{
+				Start:    sampleStart.Add(500 * interval),
+				Duration: gap,
+				Reason:   "test",
+			})
+		}
+		after := sampleStart.Add(500*interval + gap)
+		records = append(records, stampedData(after, interval, 500, 50,
+			exactly)...)
+
+		blocks := readBlocks(t, records)
+		if len(blocks) != 20 {
+			t.Fatalf("%s: got %d blocks", test.name, len(blocks))
+		}
+		for i, block := range blocks {
+			if i != before && block.Reset != (i == 0) {
+				t.Fatalf("%s: block %d has Reset %v", test.name, i,
+					block.Reset)
+			}
+		}
+
+		last := blocks[before-1].Data[49]
+		block := blocks[before]
+		first := block.Data[len(block.Data)-50]
+		if !test.filled {
+			if !block.Reset || block.Gap != gap ||
+				!block.Start.Equal(after) || len(block.Data) != 50 {
+				t.Fatalf("%s: got a block of %d from %v with Reset %v and Gap %v",
+					test.name, len(block.Data), block.Start, block.Reset,
+					block.Gap)
+			}
+			continue
+		}
+
+		if block.Reset || block.Gap != 0 ||
+			!block.Start.Equal(sampleStart.Add(500*interval)) ||
+			len(block.Data) != 50+test.missing {
+			t.Fatalf("%s: got a block of %d from %v with Reset %v and Gap %v",
+				test.name, len(block.Data), block.Start, block.Reset,
+				block.Gap)
+		}
+		// The samples before the gap count up to 499, and the ones
+		// after it start again from 0, so the ones filled in have to
+		// come down in between.
+		prev := last
+		for i, sample := range block.Data[:test.missing] {
+			if sample >= prev || sample <= first {
+				t.Fatalf("%s: filled in %v between %d and %d; %d is out of line",
+					test.name, block.Data[:test.missing], last, first, i)
+			}
+			prev = sample
+		}
+	}
+}
+
+func TestGapTrackerMissing(t *testing.T) {
+	interval := 20 * time.Millisecond
+	for _, test := range []struct {
+		name string
+		// how long the device says was missing, and how long
+		// actually was
+		missing, actual time.Duration
+		// the GapRecords it should write
+		gaps []time.Duration
+	}{
+		{"all of it", 3 * time.Second, 3 * time.Second,
+			[]time.Duration{3 * time.Second}},
+		{"some of it", 3 * time.Second, 5 * time.Second,
+			[]time.Duration{3 * time.Second, 2 * time.Second}},
+		{"none of it", 0, 5 * time.Second,
+			[]time.Duration{5 * time.Second}},
+		{"a few samples", 3 * interval, 3 * interval,
+			[]time.Duration{3 * interval}},
+	} {
+		var written recordLog
+		gt := NewGapTracker(&written)
+		for _, r := range stampedData(sampleStart, interval, 500, 50,
+			exactly) {
+			err := gt.Write(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.missing > 0 {
+			err := gt.Missing(test.missing, "reconnecting")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		after := sampleStart.Add(500*interval + test.actual)
+		for _, r := range stampedData(after, interval, 500, 50, exactly) {
+			err := gt.Write(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var gaps []time.Duration
+		for _, r := range written {
+			if gap, isGap := r.(GapRecord); isGap {
+				gaps = append(gaps, gap.Duration)
+			}
+		}
+		if !reflect.DeepEqual(gaps, test.gaps) {
+			t.Fatalf("%s: wrote gaps of %v, not %v", test.name, gaps,
+				test.gaps)
+		}
+
+		// Reading it back, the samples after the gap are put in the
+		// right place.
+		blocks := readBlocks(t, written)
+		block := blocks[10]
+		filled := test.actual <= filledSamples*interval
+		if block.Reset == filled || (!filled && block.Gap != test.actual) {
+			t.Fatalf("%s: read back a block with Reset %v and Gap %v",
+				test.name, block.Reset, block.Gap)
+		}
+		if !block.End().Equal(after.Add(49 * interval)) {
+			t.Fatalf("%s: read back a block ending at %v", test.name,
+				block.End())
+		}
+	}
+}
@@ -1,31 +1,146 @@
 package heartmon
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Server takes connections from the heart monitors, and for each device
+// writes the records to an .hrt file and a human-readable file and runs a
+// RateDetector on them.
+//
+// The Wi-Fi drops now and again, and the monitor reconnects. If it does so
+// within ReconnectGrace, it carries on the session it was in: the records
+// go on into the same files, after a GapRecord, and the same RateDetector
+// carries on with them, so an episode or alert going on carries on too,
+// rather than a flaky night turning into dozens of fragments each with a
+// detector starting from scratch. The detector's window of samples still
+// starts again after the gap, since the samples don't carry on.
+//
+// It's a suture service. Stopping it stops taking connections and shuts
+// down the ones going and the sessions waiting for a reconnect: each one's
+// files are flushed and closed, so they're complete and valid, and its
+// alerts are stopped. Stop returns straight away, but Serve doesn't return
+// until all that's done, which is what suture waits on.
 type Server struct {
-	l net.Listener
+	// StreamInfo describes what the connecting devices send. It is
+	// written at the start of each connection's records, since the
+	// firmware doesn't say. NewServer sets it to DefaultStreamInfo.
+	StreamInfo StreamInfoRecord
+	// Events gets the live events from every connection's RateDetector.
+	// NewServer creates one; serve it with a LiveHeartEvents.
+	Events *EventHub
+	// Notifiers configures who each connection's RateDetector tells
+	// about alerts, unless Devices says otherwise for the person wearing
+	// it. Nil means the DefaultNotifiers.
+	Notifiers NotifierConfigs
+	// Devices configures the devices and the people wearing them. Nil
+	// means every device gets the defaults.
+	Devices *DevicesConfig
+	// Control can acknowledge and snooze the alerts of every
+	// connection. NewServer creates one; serve it over HTTP or with a
+	// ControlSocket.
+	Control *AlertControl
+	// SnapshotDir is where each connection's RateDetector writes the
+	// snapshots of the ECG around its alerts; empty means it doesn't. A
+	// relative directory is under the device's directory. NewServer sets
+	// it to DefaultSnapshotDir.
+	SnapshotDir string
+	// Watchdog raises an alert when a device stops sending. NewServer
+	// creates one, using Notifiers and Control; it needs running as a
+	// service of its own. Nil means nobody's told.
+	Watchdog *Watchdog
+	// ReconnectGrace is how long a device's session waits for it to
+	// reconnect before it's ended. 0 means every connection gets a
+	// session of its own. NewServer sets it to DefaultReconnectGrace.
+	ReconnectGrace time.Duration
+
+	address string
+
+	sync.Mutex
+	// nil once closed; Serve listens again if it's restarted
+	l           net.Listener
+	connections map[*connection]struct{}
+	sessions    map[string]*session
+	// the devices a session is being started for, closed once it's in
+	// sessions or has failed
+	starting map[string]chan struct{}
+	// the connections' goroutines
+	wg sync.WaitGroup
+	// the sessions not yet ended
+	sessionWG sync.WaitGroup
 }
 
+// DefaultReconnectGrace is how long the Server waits for a device to
+// reconnect by default. The monitor tries again straight away, so this is
+// plenty for a Wi-Fi blip, but if it's been off for longer than this
+// something else is going on, and it may as well be a new session.
+const DefaultReconnectGrace = 5 * time.Minute
+
 func (s *Server) Serve() {
+	s.Lock()
+	if s.l == nil {
+		l, err := net.Listen("tcp", s.address)
+		if err != nil {
+			s.Unlock()
+			log.Printf("Can't listen on %s: %v", s.address, err)
+			return
+		}
+		s.l = l
+	}
+	l := s.l
+	s.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		s.wg.Wait()
+		s.endSessions()
+		s.sessionWG.Wait()
+	}()
+
 	for {
-		conn, err := s.l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			s.closeListener(l)
 			return
 		}
 
-		go newInstance(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.newInstance(ctx, conn)
+		}()
 	}
 }
 
 func (s *Server) Stop() {
-	s.l.Close()
+	s.Lock()
+	l := s.l
+	s.Unlock()
+	if l != nil {
+		s.closeListener(l)
+	}
+}
+
+func (s *Server) closeListener(l net.Listener) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.l == l {
+		l.Close()
+		s.l = nil
+	}
 }
 
 type Instance struct {
@@ -37,47 +152,645 @@ func NewServer(address string) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Server{l}, nil
+	s := &Server{
+		StreamInfo:     DefaultStreamInfo(),
+		Events:         NewEventHub(),
+		Control:        NewAlertControl(),
+		SnapshotDir:    DefaultSnapshotDir,
+		ReconnectGrace: DefaultReconnectGrace,
+		address:        address,
+		l:              l,
+		connections:    map[*connection]struct{}{},
+		sessions:       map[string]*session{},
+		starting:       map[string]chan struct{}{},
+	}
+	s.Watchdog = NewWatchdog(s.newAlerter, os.Stderr)
+	s.Watchdog.Control = s.Control
+	return s, nil
+}
+
+// remoteHost returns the address of the other end of the connection
+// without the port, since the port changes each time a device reconnects.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// newAlerter returns an Alerter for the given device, telling whoever is
+// configured for the person wearing it.
+func (s *Server) newAlerter(device string) *Alerter {
+	config := s.Devices.device(device)
+	alerter := NewAlerter(os.Stderr)
+	alerter.Who = config.who(device)
+	alerter.Device = device
+	alerter.Person = config.Person
+	configs := s.Devices.notifiers(config.Person)
+	if configs == nil {
+		configs = s.Notifiers
+	}
+	notifiers, err := configs.Notifiers(os.Stderr)
+	if err != nil {
+		log.Printf("Bad notifier config, using the defaults: %v", err)
+	} else {
+		alerter.Notifiers = notifiers
+	}
+	return alerter
+}
+
+// connection is what the Server knows about a connection while it's
+// going.
+type connection struct {
+	device   string
+	person   string
+	firmware string
+	protocol uint8
+	boot     uint32
+	started  time.Time
+	conn     net.Conn
+	// closed once it's let go of its session
+	done chan struct{}
+
+	// guarded by the Server's lock
+	session *session
+
+	sync.Mutex
+	// set if it's speaking ProtocolV2
+	frames   *FrameReader
+	lastData time.Time
+	records  int64
+	// whether the device connected again, and this one was closed to
+	// let the new one take over
+	replaced bool
+}
+
+// ConnectionState describes a connection to the Server.
+type ConnectionState struct {
+	Device string `json:"device"`
+	// Person is who's wearing it, if that's configured.
+	Person string `json:"person,omitempty"`
+	// Firmware is the version its handshake gave, if it sent one.
+	Firmware string `json:"firmware,omitempty"`
+	// Protocol is the protocol version it's speaking.
+	Protocol uint8     `json:"protocol"`
+	Started  time.Time `json:"started"`
+	// Session is when the session it's carrying on started; the same as
+	// Started unless it's a reconnect.
+	Session time.Time `json:"session"`
+	// Reconnects is how many times the device has reconnected during
+	// the session.
+	Reconnects int `json:"reconnects"`
+	// File is the .hrt file it's being written to.
+	File string `json:"file"`
+	// LastData is when it last sent heart data, or the zero time if it
+	// hasn't.
+	LastData time.Time `json:"last_data"`
+	// Records is how many records it's sent.
+	Records int64 `json:"records"`
+	// Consumers says how each consumer of the records is keeping up.
+	Consumers []SubscriptionStats `json:"consumers"`
+	// Frames says how the frames are arriving, if it's speaking
+	// ProtocolV2.
+	Frames *FrameStats `json:"frames,omitempty"`
+}
+
+// state returns the state of the connection. The Server's lock must be
+// held.
+func (c *connection) state() ConnectionState {
+	c.Lock()
+	defer c.Unlock()
+
+	state := ConnectionState{
+		Device:     c.device,
+		Person:     c.person,
+		Firmware:   c.firmware,
+		Protocol:   c.protocol,
+		Started:    c.started,
+		Session:    c.session.started,
+		Reconnects: c.session.reconnects,
+		File:       c.session.file,
+		LastData:   c.lastData,
+		Records:    c.records,
+		Consumers:  c.session.fanout.Stats(),
+	}
+	if c.frames != nil {
+		stats := c.frames.Stats()
+		state.Frames = &stats
+	}
+	return state
+}
+
+// Connections returns the state of the connections going, oldest first.
+func (s *Server) Connections() []ConnectionState {
+	s.Lock()
+	defer s.Unlock()
+
+	states := []ConnectionState{}
+	for c := range s.connections {
+		states = append(states, c.state())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Started.Before(states[j].Started)
+	})
+	return states
+}
+
+// ServeHTTP serves the Connections as JSON.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(s.Connections())
 }
 
-func newInstance(conn io.Reader) {
-	fmt.Println("Connection started")
-	now := time.Now()
+// session is a device's recording: its files, its RateDetector, and the
+// consumers of its records. It outlives the connections that feed it, one
+// at a time.
+type session struct {
+	device  string
+	started time.Time
+	file    string
+	// what the connections write to
+	tracker *GapTracker
+
+	fanout       *RecordFanout
+	consumers    sync.WaitGroup
+	rateDetector *RateDetector
+	files        []*os.File
+
+	// These are guarded by the Server's lock.
+	// the connection feeding it; nil while it waits for a reconnect
+	conn         *connection
+	disconnected time.Time
+	reconnects   int
+	// the boot of the device the last ProtocolV2 connection came from,
+	// and the last frame it sent
+	boot      uint32
+	lastFrame uint32
+
+	closeOnce sync.Once
+}
+
+// newSession starts a new session for the connection's device.
+func (s *Server) newSession(c *connection) (*session, error) {
+	device, now := c.device, c.started
+	config := s.Devices.device(device)
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
 	ts := now.Format(time.RFC3339)
-	filename := fmt.Sprintf("heartbeat_starting_%s.hrt", ts)
+	filename := filepath.Join(config.Dir,
+		fmt.Sprintf("heartbeat_starting_%s.hrt", ts))
 	f, err := os.Create(filename)
 	if err != nil {
-		log.Printf("Couldn't create %s: %v", filename, err)
-		return
+		return nil, err
+	}
+	// so it isn't recompressed out from under us; see lock.go
+	err = LockFile(f)
+	if err != nil {
+		log.Printf("Can't lock %s: %v", filename, err)
+	}
+	archive := NewRecordWriter(f)
+	err = archive.WriteHeader(FileHeader{
+		Created:  now,
+		DeviceID: device,
+		Person:   config.Person,
+		Firmware: c.firmware,
+	})
+	if err == nil {
+		err = archive.Flush()
+	}
+	if err != nil {
+		closeFile(f)
+		return nil, err
 	}
 
-	filename2 := fmt.Sprintf("human_heartbeat_%s.txt", ts)
+	filename2 := filepath.Join(config.Dir,
+		fmt.Sprintf("human_heartbeat_%s.txt", ts))
 	f2, err := os.Create(filename2)
 	if err != nil {
-		log.Printf("Couldn't create %s: %v", filename2, err)
+		closeFile(f)
+		return nil, err
+	}
+
+	// The connection is parsed once. Everything goes into the file
+	// first, directly, and then out through the fanout to the consumers,
+	// which can fall behind or give up without holding the file up.
+	fanout := NewRecordFanout()
+	hrr := fanout.Subscribe("human readable file", DefaultFanoutBuffer)
+	stderr := fanout.Subscribe("standard error", DefaultFanoutBuffer)
+	rateDetect := fanout.Subscribe("rate detector", DefaultFanoutBuffer)
+	out := &connectionSink{archive: archive, fanout: fanout}
+
+	rateDetector := NewRecordRateDetector(rateDetect, os.Stderr)
+	rateDetector.Device = device
+	rateDetector.Events = s.Events
+	rateDetector.Alerter = s.newAlerter(device)
+	// These were checked when the config was loaded.
+	if config.Detectors != "" {
+		rateDetector.Detectors, _ = ParseDetectors(config.Detectors)
+	}
+	if config.Policy != "" {
+		rateDetector.Policy, _ = ParsePolicy(config.Policy)
+	}
+	if s.SnapshotDir != "" {
+		snapshotDir := s.SnapshotDir
+		if !filepath.IsAbs(snapshotDir) {
+			snapshotDir = filepath.Join(config.Dir, snapshotDir)
+		}
+		rateDetector.Snapshots = NewSnapshotter(snapshotDir, os.Stderr)
+	}
+	// The journal goes in with everything else; the rate detector gets
+	// its own journal back, and ignores it.
+	rateDetector.Journal = out
+	s.Control.Add(rateDetector.Alerter)
+
+	// We parse the records coming in, rather than just copying the bytes
+	// through, so the GapTracker can mark where samples went missing.
+	sess := &session{
+		device:       device,
+		started:      now,
+		file:         filename,
+		tracker:      NewGapTracker(out),
+		fanout:       fanout,
+		rateDetector: rateDetector,
+		files:        []*os.File{f, f2},
+	}
+
+	sess.consumers.Add(3)
+	go func() {
+		defer sess.consumers.Done()
+		HumanReadableRecords(hrr, f2)
+	}()
+	go func() {
+		defer sess.consumers.Done()
+		HumanReadableRecords(stderr, os.Stderr)
+	}()
+	go func() {
+		defer sess.consumers.Done()
+		rateDetector.Run()
+		// If it gave up early, stop queuing records for it.
+		rateDetect.Close()
+	}()
+
+	s.sessionWG.Add(1)
+	return sess, nil
+}
+
+// close ends the session. It waits for the consumers to finish, and the
+// rate detector to finish off its episode and stop its alerts, before the
+// files are closed under them. It's safe to call more than once.
+func (sess *session) close(s *Server) {
+	sess.closeOnce.Do(func() {
+		defer s.sessionWG.Done()
+
+		for _, stats := range sess.fanout.Stats() {
+			log.Printf("Session of %s: %s", sess.device, stats)
+		}
+		sess.fanout.Close()
+		sess.consumers.Wait()
+		s.Control.Remove(sess.rateDetector.Alerter)
+		// Its being quiet from now on isn't the monitor being lost.
+		s.Watchdog.Retire(sess.device)
+		for _, f := range sess.files {
+			closeFile(f)
+		}
+		fmt.Printf("Session of %s ended, written to %s\n", sess.device,
+			sess.file)
+	})
+}
+
+// attach attaches the connection to its device's session: the one waiting
+// for the device to reconnect, if there is one, or else a new one. It
+// returns how long the session went without a connection, or 0 if it's a
+// new one.
+//
+// If the session still has an old connection, that's closed and the new
+// one takes over; when the Wi-Fi drops, the device can notice and
+// reconnect long before the old connection times out.
+func (s *Server) attach(c *connection) (*session, time.Duration, error) {
+	for {
+		s.Lock()
+		sess := s.sessions[c.device]
+		switch {
+		case sess == nil:
+			// The files are made without the lock, so everything else
+			// doesn't wait on the disk. Anything else connecting as
+			// the device in the meantime waits for them, and then
+			// looks again.
+			if starting, ok := s.starting[c.device]; ok {
+				s.Unlock()
+				<-starting
+				continue
+			}
+			starting := make(chan struct{})
+			s.starting[c.device] = starting
+			s.Unlock()
+
+			sess, err := s.newSession(c)
+
+			s.Lock()
+			delete(s.starting, c.device)
+			close(starting)
+			if err != nil {
+				s.Unlock()
+				return nil, 0, err
+			}
+			s.sessions[c.device] = sess
+			sess.conn = c
+			c.session = sess
+			s.connections[c] = struct{}{}
+			s.Unlock()
+			return sess, 0, nil
+
+		case sess.conn != nil:
+			old := sess.conn
+			s.Unlock()
+			log.Printf("%s connected again; closing its old connection",
+				c.device)
+			old.Lock()
+			old.replaced = true
+			old.Unlock()
+			old.conn.Close()
+			<-old.done
+
+		default:
+			sess.conn = c
+			sess.reconnects++
+			c.session = sess
+			s.connections[c] = struct{}{}
+			s.Unlock()
+			return sess, c.started.Sub(sess.disconnected), nil
+		}
+	}
+}
+
+// detach lets go of the connection's session. Unless the server is
+// shutting down, or a new connection is taking over, the session waits
+// ReconnectGrace for the device to reconnect before it's ended.
+func (s *Server) detach(c *connection, shuttingDown bool) {
+	defer close(c.done)
+
+	c.Lock()
+	replaced := c.replaced
+	c.Unlock()
+
+	s.Lock()
+	sess := c.session
+	delete(s.connections, c)
+	sess.conn = nil
+	sess.disconnected = time.Now()
+	if c.frames != nil {
+		sess.boot = c.boot
+		sess.lastFrame = c.frames.Last()
+	}
+	if replaced {
+		s.Unlock()
+		return
+	}
+	if shuttingDown || s.ReconnectGrace <= 0 {
+		delete(s.sessions, sess.device)
+		s.Unlock()
+		sess.close(s)
+		return
+	}
+	reconnects := sess.reconnects
+	time.AfterFunc(s.ReconnectGrace, func() {
+		s.expire(sess, reconnects)
+	})
+	s.Unlock()
+}
+
+// expire ends the session if the device hasn't reconnected since it was
+// given the given number of reconnects to do it in.
+func (s *Server) expire(sess *session, reconnects int) {
+	s.Lock()
+	if s.sessions[sess.device] != sess || sess.conn != nil ||
+		sess.reconnects != reconnects {
+		s.Unlock()
+		return
+	}
+	delete(s.sessions, sess.device)
+	s.Unlock()
+
+	log.Printf("%s didn't reconnect within %s", sess.device,
+		s.ReconnectGrace)
+	sess.close(s)
+}
+
+// endSessions ends the sessions waiting for their devices to reconnect
+// without waiting any longer. The connections must all have finished.
+func (s *Server) endSessions() {
+	s.Lock()
+	sessions := s.sessions
+	s.sessions = map[string]*session{}
+	s.Unlock()
+
+	for _, sess := range sessions {
+		sess.close(s)
+	}
+}
+
+// lastFrame returns the last frame the session got from the given boot of
+// its device, or 0 if it's had nothing from it.
+func (s *Server) lastFrame(sess *session, boot uint32) uint32 {
+	s.Lock()
+	defer s.Unlock()
+
+	if boot == 0 || sess.boot != boot {
+		return 0
+	}
+	return sess.lastFrame
+}
+
+// newInstance handles the connection until it ends, or the context is
+// cancelled.
+func (s *Server) newInstance(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Closing the connection is the only way to interrupt a read.
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	// Firmware that does the handshake says which device it is; for
+	// firmware that doesn't, the address will have to do.
+	device := remoteHost(conn)
+	streamInfo := s.StreamInfo
+	in := NewRecordReader(conn)
+	first, err := in.NextRecord()
+	if err != nil {
+		if err != io.EOF && ctx.Err() == nil {
+			log.Printf("Can't read from connection from %s: %v", device, err)
+		}
+		return
+	}
+	handshake, shookHands := first.(HandshakeRecord)
+	if shookHands {
+		if handshake.DeviceID != "" {
+			device = handshake.DeviceID
+		}
+		streamInfo = handshake.StreamInfo(streamInfo)
+		fmt.Printf("Connection started from %s, firmware %s\n", device,
+			handshake.Firmware)
+	} else {
+		fmt.Printf("Connection started from %s\n", device)
+	}
+
+	c := &connection{
+		device:   device,
+		person:   s.Devices.device(device).Person,
+		protocol: ProtocolV1,
+		started:  time.Now(),
+		conn:     conn,
+		done:     make(chan struct{}),
+	}
+	if shookHands {
+		c.firmware = handshake.Firmware
+		c.boot = handshake.Boot
+		if handshake.Protocol >= ProtocolV2 {
+			c.protocol = ProtocolV2
+		}
+	}
+	sess, disconnected, err := s.attach(c)
+	if err != nil {
+		log.Printf("Can't start a session for %s: %v", device, err)
+		return
+	}
+	defer func() {
+		s.detach(c, ctx.Err() != nil)
+	}()
+	tracker := sess.tracker
+
+	// A device speaking ProtocolV2 is told so straight away, and where
+	// to carry on from if it's reconnected.
+	var src RecordSource = in
+	if c.protocol >= ProtocolV2 {
+		frames := NewFrameReader(in.buf, conn,
+			s.lastFrame(sess, handshake.Boot))
+		c.Lock()
+		c.frames = frames
+		c.Unlock()
+		defer func() {
+			log.Printf("Connection from %s: %s", device, frames.Stats())
+		}()
+		err = frames.Ack()
+		if err != nil {
+			log.Printf("Can't write to connection from %s: %v", device, err)
+			return
+		}
+		src = frames
+	}
+
+	// Put the handshake and the stream info at the front of
+	// everything, so the file and all the consumers know what they're
+	// looking at. A reconnect gets them again, since the device may
+	// have been restarted with something different, after a GapRecord
+	// for the time it was gone.
+	if disconnected > 0 {
+		fmt.Printf("%s reconnected after %s\n", device,
+			disconnected.Round(time.Second))
+		err = tracker.Missing(disconnected, fmt.Sprintf(
+			"%s reconnected after %s", device,
+			disconnected.Round(time.Second)))
+	}
+	if err == nil && shookHands {
+		err = tracker.Write(handshake)
+		first = nil
+	}
+	if err == nil {
+		err = tracker.Write(streamInfo)
+	}
+	if err != nil {
+		log.Printf("Couldn't write to %s: %v", sess.file, err)
 		return
 	}
 
-	hrrR, hrrW := io.Pipe()
-	stderrR, stderrW := io.Pipe()
-	rateDetectR, rateDetectW := io.Pipe()
-
-	rateDetector := NewRateDetector(rateDetectR, os.Stderr)
-
-	packets := io.TeeReader(
-		io.TeeReader(
-			io.TeeReader(
-				conn,
-				hrrW, // write the packets to the human readable file
-			),
-			stderrW, // write all the packets to the standard error
-			// human-readable output
-		),
-		rateDetectW, // write to the rate detector
-	)
-
-	go HumanReadableOutput(hrrR, f2)
-	go HumanReadableOutput(stderrR, os.Stderr)
-	go rateDetector.Run()
-	io.Copy(f, packets)
+	record := first
+	for {
+		if record == nil {
+			record, err = src.NextRecord()
+		}
+		if err == io.EOF {
+			// The device hung up, rather than going quiet, so
+			// it's finished, unless it connects again.
+			s.Watchdog.Retire(device)
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Closing the connection from %s to shut down",
+				device)
+			break
+		}
+		c.Lock()
+		replaced := c.replaced
+		c.Unlock()
+		if err != nil && replaced {
+			break
+		}
+		if err != nil {
+			log.Printf("Can't read from connection from %s: %v", device, err)
+			_ = tracker.Write(ErrorRecord{
+				fmt.Sprintf("can't read from connection: %v", err),
+			})
+			break
+		}
+
+		_, isData := record.(HeartDataRecord)
+		c.Lock()
+		c.records++
+		if isData {
+			c.lastData = time.Now()
+		}
+		c.Unlock()
+		if isData {
+			s.Watchdog.Data(device)
+		}
+
+		err = tracker.Write(record)
+		if err != nil {
+			log.Printf("Couldn't write to %s: %v", sess.file, err)
+			return
+		}
+		record = nil
+	}
+}
+
+func closeFile(f *os.File) {
+	err := f.Close()
+	if err != nil {
+		log.Printf("Couldn't close %s: %v", f.Name(), err)
+	}
+}
+
+// connectionSink writes each record to a connection's archive, flushing it
+// so the file is always up to date, and then to its fanout. It's written
+// to by both the connection and its rate detector's journal. A
+// MonitorReader uses one the same way.
+type connectionSink struct {
+	sync.Mutex
+	archive *RecordWriter
+	fanout  *RecordFanout
+}
+
+func (cs *connectionSink) Write(r Record) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	err := cs.archive.Write(r)
+	if err == nil {
+		err = cs.archive.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return cs.fanout.Write(r)
 }
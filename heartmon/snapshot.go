@@ -0,0 +1,405 @@
+package heartmon
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// When an alert goes off, the evidence is somewhere in an .hrt file hours
+// long, and finding it means knowing exactly when to look. So the
+// Snapshotter keeps the last few minutes of samples in memory, and for each
+// alert writes out the ones from a little before it to a little after it,
+// as a standalone .hrt file and as a PNG that looks enough like ECG paper
+// to show a cardiologist.
+
+// DefaultSnapshotDir is where the heartserver puts the snapshots by
+// default.
+const DefaultSnapshotDir = "snapshots"
+
+// How much of the ECG goes into a snapshot by default, before and after
+// the alert.
+const (
+	DefaultSnapshotBefore = 2 * time.Minute
+	DefaultSnapshotAfter  = time.Minute
+)
+
+// Snapshotter writes snapshots of the ECG around alerts. Hand it every
+// block of samples with Add, and call Trigger when an alert starts; once
+// After has passed, the snapshot is written to Dir as
+// alert_<time>_<kind>.hrt and .png.
+//
+// A Snapshotter is used from one goroutine, the RateDetector's; the files
+// are written on goroutines of their own so it doesn't hold up the
+// detection. All the methods are safe to call on a nil Snapshotter, which
+// does nothing.
+type Snapshotter struct {
+	// Dir is where the snapshots go. It's created if need be.
+	Dir string
+	// Before and After are how much of the ECG to take either side of
+	// the alert. NewSnapshotter sets them to DefaultSnapshotBefore and
+	// DefaultSnapshotAfter. They must not be changed once blocks have
+	// been added.
+	Before time.Duration
+	After  time.Duration
+
+	logstream io.Writer
+
+	// The blocks, as a ring; the oldest is at head. Blocks that fall off
+	// the end have their Data reused.
+	ring  []SampleBlock
+	head  int
+	count int
+
+	// the alerts waiting for their After to pass
+	pending []snapshotTrigger
+
+	wg sync.WaitGroup
+}
+
+type snapshotTrigger struct {
+	time   time.Time
+	kind   AlertKind
+	detail string
+}
+
+// NewSnapshotter returns a Snapshotter writing into the given directory,
+// logging what it writes and any trouble it has to the given writer.
+func NewSnapshotter(dir string, out io.Writer) *Snapshotter {
+	return &Snapshotter{
+		Dir:       dir,
+		Before:    DefaultSnapshotBefore,
+		After:     DefaultSnapshotAfter,
+		logstream: out,
+	}
+}
+
+// Add adds a block of samples to those kept, dropping any that are too
+// old to be wanted, and writes any snapshots whose After has now passed.
+func (s *Snapshotter) Add(block SampleBlock) {
+	if s == nil || len(block.Data) == 0 {
+		return
+	}
+
+	// Drop the oldest blocks that end too far back to be in a
+	// snapshot of anything from now on.
+	oldest := block.End().Add(-s.Before - s.After)
+	for s.count > 0 && s.ring[s.head].End().Before(oldest) {
+		s.head = (s.head + 1) % len(s.ring)
+		s.count--
+	}
+
+	if s.count == len(s.ring) {
+		s.grow()
+	}
+	slot := &s.ring[(s.head+s.count)%len(s.ring)]
+	data := append(slot.Data[:0], block.Data...)
+	*slot = block
+	slot.Data = data
+	s.count++
+
+	now := block.End()
+	for len(s.pending) > 0 && !now.Before(s.pending[0].time.Add(s.After)) {
+		s.write(s.pending[0])
+		s.pending = s.pending[1:]
+	}
+}
+
+// grow doubles the size of the ring, unrolling it as it goes.
+func (s *Snapshotter) grow() {
+	size := len(s.ring) * 2
+	if size == 0 {
+		size = 64
+	}
+	ring := make([]SampleBlock, size)
+	for i := 0; i < s.count; i++ {
+		ring[i] = s.ring[(s.head+i)%len(s.ring)]
+	}
+	s.ring = ring
+	s.head = 0
+}
+
+// Trigger says the given alert started at the given time. The snapshot is
+// written once After has passed.
+func (s *Snapshotter) Trigger(now time.Time, kind AlertKind, detail string) {
+	if s == nil {
+		return
+	}
+	s.pending = append(s.pending, snapshotTrigger{now, kind, detail})
+}
+
+// Close writes the snapshots still waiting, with whatever of their After
+// there is, and waits for all the snapshots to be written.
+func (s *Snapshotter) Close() {
+	if s == nil {
+		return
+	}
+	for _, trigger := range s.pending {
+		s.write(trigger)
+	}
+	s.pending = nil
+	s.wg.Wait()
+}
+
+// write copies the blocks for the snapshot out of the ring and writes them
+// out on a goroutine of their own.
+func (s *Snapshotter) write(trigger snapshotTrigger) {
+	from := trigger.time.Add(-s.Before)
+	to := trigger.time.Add(s.After)
+
+	blocks := []SampleBlock{}
+	for i := 0; i < s.count; i++ {
+		block := s.ring[(s.head+i)%len(s.ring)]
+		if block.End().Before(from) || block.Start.After(to) {
+			continue
+		}
+		block.Data = append([]uint16(nil), block.Data...)
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		base := filepath.Join(s.Dir, fmt.Sprintf("alert_%s_%s",
+			trigger.time.Format(time.RFC3339), trigger.kind.shortName()))
+		err := s.writeFiles(base, blocks, trigger)
+		if err != nil {
+			fmt.Fprintf(s.logstream, "Can't write the snapshot %s: %v\n",
+				base, err)
+			return
+		}
+		fmt.Fprintf(s.logstream, "Wrote the snapshot %s.hrt and .png\n",
+			base)
+	}()
+}
+
+func (s *Snapshotter) writeFiles(
+	base string,
+	blocks []SampleBlock,
+	trigger snapshotTrigger,
+) error {
+	err := os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(base + ".hrt")
+	if err != nil {
+		return err
+	}
+	err = writeSnapshot(f, blocks, trigger)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Create(base + ".png")
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, renderStrip(blocks, trigger.time))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeSnapshot writes the blocks as records. Every block gets its own
+// timestamp, so a SampleReader places the samples exactly where they were,
+// and the alert goes in as an AlertRecord after the block it was raised
+// on.
+func writeSnapshot(w io.Writer, blocks []SampleBlock, trigger snapshotTrigger) error {
+	rw := NewRecordWriter(w)
+	err := rw.WriteHeader(FileHeader{})
+	if err != nil {
+		return err
+	}
+	var streamInfo StreamInfoRecord
+	alerted := false
+
+	for idx, block := range blocks {
+		if idx == 0 || block.StreamInfo != streamInfo {
+			streamInfo = block.StreamInfo
+			err := rw.Write(streamInfo)
+			if err != nil {
+				return err
+			}
+		}
+		if idx > 0 && block.Gap > 0 {
+			err := rw.Write(GapRecord{
+				Start:    block.Start.Add(-block.Gap),
+				Duration: block.Gap,
+				Reason:   "missing from the original",
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !alerted && block.End().After(trigger.time) {
+			alerted = true
+			err := rw.Write(AlertRecord{
+				Time:   trigger.time,
+				Kind:   trigger.kind,
+				Action: AlertStarted,
+				Detail: trigger.detail,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err := rw.Write(TimestampRecord{block.End()})
+		if err != nil {
+			return err
+		}
+		err = rw.Write(HeartDataRecord{block.Data})
+		if err != nil {
+			return err
+		}
+	}
+	return rw.Flush()
+}
+
+// The layout of the PNG: ten seconds to a row, at 100 pixels a second, so
+// the small squares are 0.2 seconds like on ECG paper.
+const (
+	stripRow          = 10 * time.Second
+	stripPixelsPerSec = 100
+	stripWidth        = 10 * stripPixelsPerSec
+	stripRowHeight    = 160
+	stripMargin       = 10
+	stripSmallSquare  = stripPixelsPerSec / 5
+)
+
+var (
+	stripPaper     = color.RGBA{0xff, 0xf4, 0xf4, 0xff}
+	stripMinorGrid = color.RGBA{0xf8, 0xc8, 0xc8, 0xff}
+	stripMajorGrid = color.RGBA{0xe8, 0x80, 0x80, 0xff}
+	stripTrace     = color.RGBA{0x00, 0x00, 0x00, 0xff}
+	stripAlert     = color.RGBA{0x00, 0x00, 0xff, 0xff}
+)
+
+// renderStrip draws the blocks as rows of ECG trace on pink grid paper,
+// with a blue line where the alert went off. Gaps are left blank.
+func renderStrip(blocks []SampleBlock, alertTime time.Time) image.Image {
+	start := blocks[0].Start.Truncate(time.Second)
+	end := blocks[len(blocks)-1].End()
+	rows := int(end.Sub(start)/stripRow) + 1
+
+	img := image.NewRGBA(image.Rect(0, 0, stripWidth,
+		rows*stripRowHeight+stripMargin))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < stripWidth; x++ {
+			c := stripPaper
+			switch {
+			case x%stripPixelsPerSec == 0 || y%(5*stripSmallSquare) == 0:
+				c = stripMajorGrid
+			case x%stripSmallSquare == 0 || y%stripSmallSquare == 0:
+				c = stripMinorGrid
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	// Scale so the bulk of the samples fill the row, without a spike
+	// or two squashing everything else flat.
+	low, high := sampleRange(blocks)
+	scale := float64(stripRowHeight-2*stripMargin) / float64(high-low)
+
+	// where a time and sample go
+	place := func(t time.Time, sample uint16) (row, x, y int) {
+		offset := t.Sub(start)
+		row = int(offset / stripRow)
+		x = int((offset % stripRow) * stripPixelsPerSec / time.Second)
+		level := float64(sample) - float64(low)
+		if level < 0 {
+			level = 0
+		}
+		if level > float64(high-low) {
+			level = float64(high - low)
+		}
+		y = row*stripRowHeight + stripRowHeight - stripMargin -
+			int(level*scale)
+		return
+	}
+
+	alertRow, alertX, _ := place(alertTime, low)
+	for y := alertRow * stripRowHeight; y < (alertRow+1)*stripRowHeight; y++ {
+		img.SetRGBA(alertX, y, stripAlert)
+	}
+
+	lastRow, lastX, lastY := -1, 0, 0
+	for _, block := range blocks {
+		if block.Reset {
+			lastRow = -1
+		}
+		for idx, sample := range block.Data {
+			row, x, y := place(block.Time(idx), sample)
+			if row == lastRow {
+				drawLine(img, lastX, lastY, x, y, stripTrace)
+			} else {
+				img.SetRGBA(x, y, stripTrace)
+			}
+			lastRow, lastX, lastY = row, x, y
+		}
+	}
+
+	return img
+}
+
+// sampleRange returns the range of the middle 99% of the samples, widened
+// a little.
+func sampleRange(blocks []SampleBlock) (uint16, uint16) {
+	samples := []uint16{}
+	for _, block := range blocks {
+		samples = append(samples, block.Data...)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	low := int(samples[len(samples)/200])
+	high := int(samples[len(samples)-1-len(samples)/200])
+	margin := (high-low)/10 + 1
+	low -= margin
+	high += margin
+	if low < 0 {
+		low = 0
+	}
+	if high > 65535 {
+		high = 65535
+	}
+	return uint16(low), uint16(high)
+}
+
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	steps := abs(x1 - x0)
+	if dy := abs(y1 - y0); dy > steps {
+		steps = dy
+	}
+	if steps == 0 {
+		img.SetRGBA(x0, y0, c)
+		return
+	}
+	for i := 0; i <= steps; i++ {
+		img.SetRGBA(x0+(x1-x0)*i/steps, y0+(y1-y0)*i/steps, c)
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
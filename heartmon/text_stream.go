@@ -9,9 +9,22 @@ import (
 // logging and verifying that connections are still alive.
 func HumanReadableOutput(r io.Reader, w io.Writer) {
 	rr := NewRecordReader(r)
+	header, err := rr.Header()
+	if err != nil {
+		fmt.Fprintf(w, "Can't read from stream: %v\n", err)
+		return
+	}
+	if header != nil {
+		fmt.Fprintf(w, "File: %s\n", header)
+	}
+	HumanReadableRecords(rr, w)
+}
 
+// HumanReadableRecords is HumanReadableOutput for records that have already
+// been read.
+func HumanReadableRecords(src RecordSource, w io.Writer) {
 	for {
-		record, err := rr.NextRecord()
+		record, err := src.NextRecord()
 		if err == io.EOF {
 			return
 		}
@@ -27,6 +40,29 @@ func HumanReadableOutput(r io.Reader, w io.Writer) {
 			fmt.Fprintf(w, "Heart data: %v\n", r.Data)
 		case ErrorRecord:
 			fmt.Fprintf(w, "***\n*** ERROR: %v\n***\n", r.Error)
+		case GapRecord:
+			fmt.Fprintf(w, "Gap: %s missing from %s (%s)\n", r.Duration,
+				r.Start, r.Reason)
+		case StreamInfoRecord:
+			fmt.Fprintf(w, "Stream: %v Hz, %d bits\n", r.SampleRate,
+				r.ADCBits)
+		case AlertRecord:
+			fmt.Fprintf(w, "Alert: %s %s at level %d at %s %s\n", r.Kind,
+				r.Action, r.Level, r.Time, r.Detail)
+		case EpisodeStartRecord:
+			fmt.Fprintf(w, "Episode: %s started at %s (%s: %s)\n", r.Kind,
+				r.Start, r.Detector, r.Detail)
+		case EpisodeEndRecord:
+			fmt.Fprintf(w, "Episode: %s from %s to %s, %s, peak %.0f BPM\n",
+				r.Kind, r.Start, r.End, r.Duration(), r.PeakBPM)
+		case HandshakeRecord:
+			fmt.Fprintf(w, "Device: %s, firmware %s, %v Hz, %d bits",
+				r.DeviceID, r.Firmware, r.SampleRate, r.ADCBits)
+			if r.Protocol > ProtocolV1 {
+				fmt.Fprintf(w, ", protocol %d, boot %08x", r.Protocol,
+					r.Boot)
+			}
+			fmt.Fprintln(w)
 		}
 	}
 }
@@ -0,0 +1,207 @@
+package heartmon
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// If the monitor's Wi-Fi drops in the night, the connection just goes
+// quiet. The RateDetector sees no data, so it sees nothing wrong, and I
+// sleep on thinking I'm being watched. The Watchdog keeps track of when
+// each device last sent anything, and raises the monitor disconnected alert
+// for any that's been quiet too long.
+
+// DefaultWatchdogSilence is how long a device can go without sending data
+// before the Watchdog raises the alert by default.
+const DefaultWatchdogSilence = 2 * time.Minute
+
+// Watchdog raises the monitor disconnected alert for each device that's
+// gone Silence without sending data, and stops it when data comes in again.
+// It only knows about devices that have sent something.
+//
+// Each device gets an Alerter of its own, separate from the RateDetector's,
+// since the RateDetector goes away with the connection. It runs on the
+// wall clock, not the time of the heart data.
+//
+// A device that's finished for the night, as when it's closed its
+// connection or its session has ended, can be retired, so it being quiet
+// isn't taken for it being lost; see Retire.
+//
+// Stopping the Watchdog stops its alerts and forgets the devices; if it's
+// started again, it starts watching each one again when it next sends.
+type Watchdog struct {
+	// Silence is how long a device can go without sending data before
+	// the alert is raised. NewWatchdog sets it to
+	// DefaultWatchdogSilence.
+	Silence time.Duration
+	// Control, if set, gets the devices' Alerters added to it, so the
+	// alerts can be acknowledged and snoozed.
+	Control *AlertControl
+
+	newAlerter func(device string) *Alerter
+	logstream  io.Writer
+
+	// Data is called for every record from every device, so all it does
+	// is store the time, in the watchedDevice for the device, which it
+	// adds if it has to. Everything else is done by Serve.
+	devices sync.Map
+
+	sync.Mutex
+	// closed by Stop; made by Serve
+	stop chan struct{}
+	// set by a Stop that came when Serve wasn't running, so Serve knows
+	// not to start
+	stopped bool
+}
+
+type watchedDevice struct {
+	// when the device last sent data, in Unix nanoseconds; accessed
+	// atomically
+	lastData int64
+	// 1 if the device has been retired and hasn't sent anything since;
+	// accessed atomically
+	retired int32
+
+	// only used by Serve; nil until Serve sees the device
+	alerter *Alerter
+}
+
+// NewWatchdog returns a Watchdog that makes the Alerter for each device
+// with the given function, and logs to the given writer.
+func NewWatchdog(newAlerter func(device string) *Alerter, out io.Writer) *Watchdog {
+	return &Watchdog{
+		Silence:    DefaultWatchdogSilence,
+		newAlerter: newAlerter,
+		logstream:  out,
+	}
+}
+
+// Data tells the Watchdog the device just sent data. It never waits for
+// anything. It is safe to call on a nil Watchdog, which does nothing.
+func (w *Watchdog) Data(device string) {
+	if w == nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	d, known := w.devices.Load(device)
+	if !known {
+		d, _ = w.devices.LoadOrStore(device, &watchedDevice{})
+	}
+	atomic.StoreInt64(&d.(*watchedDevice).lastData, now)
+	atomic.StoreInt32(&d.(*watchedDevice).retired, 0)
+}
+
+// Retire tells the Watchdog the device has finished, so it stops watching
+// it, and stops its alert if that's going. If the device sends data again,
+// it's watched again. It never waits for anything. It is safe to call on
+// a nil Watchdog, which does nothing.
+func (w *Watchdog) Retire(device string) {
+	if w == nil {
+		return
+	}
+
+	d, known := w.devices.Load(device)
+	if known {
+		atomic.StoreInt32(&d.(*watchedDevice).retired, 1)
+	}
+}
+
+// check raises or keeps going the alert for each device that's been quiet
+// too long, and stops it for any that has sent data again.
+func (w *Watchdog) check(now time.Time) {
+	w.devices.Range(func(key, value interface{}) bool {
+		device, d := key.(string), value.(*watchedDevice)
+		if atomic.LoadInt32(&d.retired) != 0 {
+			fmt.Fprintf(w.logstream, "%s has finished; not watching it\n",
+				device)
+			w.forgetDevice(key, d, now)
+			return true
+		}
+		if d.alerter == nil {
+			d.alerter = w.newAlerter(device)
+			if w.Control != nil {
+				w.Control.Add(d.alerter)
+			}
+		}
+
+		lastData := time.Unix(0, atomic.LoadInt64(&d.lastData))
+		if now.Sub(lastData) < w.Silence {
+			if kind, alerting := d.alerter.Active(); alerting &&
+				kind == AlertDisconnected {
+				fmt.Fprintf(w.logstream, "%s is sending data again\n",
+					device)
+				d.alerter.Stop(now)
+			}
+			return true
+		}
+		d.alerter.Alert(AlertDisconnected, now, fmt.Sprintf(
+			"no data from %s since %s", device,
+			lastData.Format(time.RFC1123)))
+		return true
+	})
+}
+
+func (w *Watchdog) Serve() {
+	w.Lock()
+	if w.stopped {
+		w.stopped = false
+		w.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	w.stop = stop
+	w.Unlock()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer w.forget()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			w.check(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// forget stops the alerts and forgets the devices.
+func (w *Watchdog) forget() {
+	now := time.Now()
+	w.devices.Range(func(key, value interface{}) bool {
+		w.forgetDevice(key, value.(*watchedDevice), now)
+		return true
+	})
+}
+
+// forgetDevice stops the device's alert and forgets it. Only Serve calls
+// it, since only Serve touches the Alerter.
+func (w *Watchdog) forgetDevice(key interface{}, d *watchedDevice, now time.Time) {
+	if d.alerter != nil {
+		d.alerter.Stop(now)
+		d.alerter.Close()
+		if w.Control != nil {
+			w.Control.Remove(d.alerter)
+		}
+	}
+	w.devices.Delete(key)
+}
+
+// Stop stops Serve. If Serve isn't running, the next Serve returns
+// straight away.
+func (w *Watchdog) Stop() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	} else {
+		w.stopped = true
+	}
+}